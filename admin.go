@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type readinessCheck struct {
+	name  string
+	check func() error
+}
+
+type admin struct {
+	logger *zap.Logger
+	config *config
+	checks []readinessCheck
+	server *http.Server
+}
+
+func newAdmin(lg *zap.Logger, cfg *config, m *metrics, checks ...readinessCheck) admin {
+	a := admin{
+		logger: lg,
+		config: cfg,
+		checks: checks,
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m.handler())
+	mux.HandleFunc("/healthz", a.healthz)
+	mux.HandleFunc("/readyz", a.readyz)
+	a.server = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	return a
+}
+
+func (a admin) listen() (net.Listener, error) {
+	return net.Listen("tcp", a.config.AdminListen)
+}
+
+func (a admin) serve(listener net.Listener) {
+	listenField := zap.String("admin_listen", a.config.AdminListen)
+	a.logger.Info("admin HTTP service started", listenField)
+	if err := a.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		a.logger.Error("admin HTTP service stopped", listenField, zap.Error(err))
+	}
+}
+
+func (a admin) close() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_ = a.server.Shutdown(ctx)
+}
+
+func (a admin) healthz(w http.ResponseWriter, r *http.Request) {
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+func (a admin) readyz(w http.ResponseWriter, r *http.Request) {
+	var failures []string
+	for _, c := range a.checks {
+		if err := c.check(); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %s", c.name, err))
+		}
+	}
+	if len(failures) > 0 {
+		a.logger.Warn("not ready", zap.Strings("failures", failures))
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte(strings.Join(failures, "\n") + "\n"))
+		return
+	}
+	_, _ = w.Write([]byte("ok\n"))
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestAdminMetrics(t *testing.T) {
+	t.Parallel()
+
+	m := newMetrics()
+	m.connectionAccepted()
+	a := newAdmin(zap.NewNop(), &config{}, m)
+
+	recorder := httptest.NewRecorder()
+	a.server.Handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	require.Equal(t, http.StatusOK, recorder.Code)
+	body, err := ioutil.ReadAll(recorder.Body)
+	require.NoError(t, err)
+	assert.Contains(t, string(body), "pacman_connections_accepted_total 1")
+	assert.Contains(t, string(body), "pacman_registry_packages 0")
+}
+
+func TestAdminHealthz(t *testing.T) {
+	t.Parallel()
+
+	a := newAdmin(zap.NewNop(), &config{}, newMetrics(), readinessCheck{
+		name:  "failing",
+		check: func() error { return errors.New("expected unit test error") },
+	})
+
+	recorder := httptest.NewRecorder()
+	a.server.Handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "ok\n", recorder.Body.String())
+}
+
+func TestAdminReadyz(t *testing.T) {
+	t.Parallel()
+
+	passing := readinessCheck{name: "passing", check: func() error { return nil }}
+	failing := readinessCheck{name: "failing", check: func() error { return errors.New("expected unit test error") }}
+
+	tests := []struct {
+		name        string
+		givenChecks []readinessCheck
+		wantCode    int
+		wantBody    string
+	}{
+		{
+			name:        "no checks",
+			givenChecks: nil,
+			wantCode:    http.StatusOK,
+			wantBody:    "ok\n",
+		},
+		{
+			name:        "all checks pass",
+			givenChecks: []readinessCheck{passing, passing},
+			wantCode:    http.StatusOK,
+			wantBody:    "ok\n",
+		},
+		{
+			name:        "one check fails",
+			givenChecks: []readinessCheck{passing, failing},
+			wantCode:    http.StatusServiceUnavailable,
+			wantBody:    "failing: expected unit test error\n",
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			a := newAdmin(zap.NewNop(), &config{}, newMetrics(), tc.givenChecks...)
+
+			recorder := httptest.NewRecorder()
+			a.server.Handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+			assert.Equal(t, tc.wantCode, recorder.Code)
+			assert.Equal(t, tc.wantBody, recorder.Body.String())
+		})
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+type auditRecord struct {
+	Time       time.Time `json:"time"`
+	Identity   string    `json:"identity"`
+	RemoteAddr string    `json:"remote_addr"`
+	Command    string    `json:"command"`
+	Args       []string  `json:"args"`
+	Outcome    string    `json:"outcome"`
+	Error      string    `json:"error,omitempty"`
+}
+
+func (r auditRecord) String() string {
+	line := fmt.Sprintf("%s %s %s %s %q %s",
+		r.Time.Format(time.RFC3339), r.Identity, r.RemoteAddr, r.Command, r.Args, r.Outcome)
+	if r.Error != "" {
+		line += ": " + r.Error
+	}
+	return line
+}
+
+type auditFilter struct {
+	since   time.Time
+	until   time.Time
+	pkgName string
+}
+
+func parseAuditFilter(args []string) (auditFilter, error) {
+	var filter auditFilter
+	for _, arg := range args {
+		key, value, ok := cut(arg, "=")
+		if !ok {
+			return filter, fmt.Errorf("invalid filter %q, expecting key=value", arg)
+		}
+		var err error
+		switch key {
+		case "since":
+			filter.since, err = time.Parse(time.RFC3339, value)
+		case "until":
+			filter.until, err = time.Parse(time.RFC3339, value)
+		case "package":
+			filter.pkgName = value
+		default:
+			err = errors.New("unknown filter")
+		}
+		if err != nil {
+			return filter, fmt.Errorf("invalid filter %q: %s", arg, err)
+		}
+	}
+	return filter, nil
+}
+
+func (f auditFilter) match(r auditRecord) bool {
+	if !f.since.IsZero() && r.Time.Before(f.since) {
+		return false
+	}
+	if !f.until.IsZero() && r.Time.After(f.until) {
+		return false
+	}
+	if f.pkgName != "" && (len(r.Args) == 0 || r.Args[0] != f.pkgName) {
+		return false
+	}
+	return true
+}
+
+// auditLog writes every registry mutation to a JSON sink and keeps the most
+// recent records in memory so they can be queried with the AuditLog command.
+// It is safe to use as a nil pointer, in which case nothing is recorded.
+type auditLog struct {
+	sync.RWMutex
+	sink    *zap.Logger
+	records []auditRecord
+	retain  int
+}
+
+func newAuditLog(cfg *config) *auditLog {
+	var writer zapcore.WriteSyncer = zapcore.Lock(os.Stdout)
+	if cfg.AuditFile != "" {
+		writer = zapcore.AddSync(&lumberjack.Logger{
+			Filename:   cfg.AuditFile,
+			MaxSize:    cfg.AuditMaxSizeMB,
+			MaxBackups: cfg.AuditMaxBackups,
+			MaxAge:     cfg.AuditMaxAgeDays,
+		})
+	}
+	encoderConfig := zap.NewProductionEncoderConfig()
+	encoderConfig.EncodeTime = zapcore.RFC3339NanoTimeEncoder
+	encoderConfig.MessageKey = "event"
+	encoderConfig.LevelKey = ""
+	encoderConfig.CallerKey = ""
+	core := zapcore.NewCore(zapcore.NewJSONEncoder(encoderConfig), writer, zapcore.InfoLevel)
+	return &auditLog{
+		sink:   zap.New(core),
+		retain: cfg.AuditRetain,
+	}
+}
+
+func (a *auditLog) record(ctx context.Context, command string, args []string, err error) {
+	if a == nil {
+		return
+	}
+	if trail := auditTrailFrom(ctx); trail != nil {
+		trail.recorded = true
+	}
+	r := auditRecord{
+		Time:       time.Now().UTC(),
+		Identity:   identityFrom(ctx),
+		RemoteAddr: remoteAddrFrom(ctx),
+		Command:    command,
+		Args:       append([]string(nil), args...),
+		Outcome:    outcomeSuccess,
+	}
+	if err != nil {
+		r.Outcome = outcomeError
+		r.Error = err.Error()
+	}
+	a.sink.Info("registry mutation",
+		zap.String("identity", r.Identity),
+		zap.String("remote_addr", r.RemoteAddr),
+		zap.String("command", r.Command),
+		zap.Strings("args", r.Args),
+		zap.String("outcome", r.Outcome),
+		zap.String("error", r.Error),
+	)
+
+	a.Lock()
+	defer a.Unlock()
+	a.records = append(a.records, r)
+	if a.retain > 0 && len(a.records) > a.retain {
+		a.records = append([]auditRecord(nil), a.records[len(a.records)-a.retain:]...)
+	}
+}
+
+func (a *auditLog) query(filter auditFilter) []auditRecord {
+	if a == nil {
+		return nil
+	}
+	a.RLock()
+	defer a.RUnlock()
+
+	var found []auditRecord
+	for _, r := range a.records {
+		if filter.match(r) {
+			found = append(found, r)
+		}
+	}
+	return found
+}
+
+func (a *auditLog) close() {
+	if a == nil {
+		return
+	}
+	_ = a.sink.Sync()
+}
+
+func clientIdentity(connection net.Conn) string {
+	if tlsConn, ok := connection.(interface{ ConnectionState() tls.ConnectionState }); ok {
+		if certs := tlsConn.ConnectionState().PeerCertificates; len(certs) > 0 {
+			return certs[0].Subject.CommonName
+		}
+	}
+	return "anonymous"
+}
+
+func cut(s, sep string) (before, after string, found bool) {
+	if i := strings.Index(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
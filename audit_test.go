@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestParseAuditFilter(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		givenArgs []string
+		want      auditFilter
+		wantError error
+	}{
+		{
+			name:      "no filters",
+			givenArgs: nil,
+			want:      auditFilter{},
+		},
+		{
+			name:      "all filters",
+			givenArgs: []string{"since=2021-11-01T00:00:00Z", "until=2021-11-02T00:00:00Z", "package=AAA"},
+			want: auditFilter{
+				since:   time.Date(2021, 11, 1, 0, 0, 0, 0, time.UTC),
+				until:   time.Date(2021, 11, 2, 0, 0, 0, 0, time.UTC),
+				pkgName: "AAA",
+			},
+		},
+		{
+			name:      "not key value",
+			givenArgs: []string{"AAA"},
+			wantError: errors.New(`invalid filter "AAA", expecting key=value`),
+		},
+		{
+			name:      "unknown filter",
+			givenArgs: []string{"user=me"},
+			wantError: errors.New(`invalid filter "user=me": unknown filter`),
+		},
+		{
+			name:      "invalid time",
+			givenArgs: []string{"since=yesterday"},
+			wantError: errors.New(`invalid filter "since=yesterday": parsing time "yesterday" as "2006-01-02T15:04:05Z07:00": cannot parse "yesterday" as "2006"`),
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			filter, err := parseAuditFilter(tc.givenArgs)
+			if tc.wantError != nil {
+				assert.EqualError(t, err, tc.wantError.Error())
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, tc.want, filter)
+			}
+		})
+	}
+}
+
+func TestAuditLogRecord(t *testing.T) {
+	t.Parallel()
+
+	ctx := withRequest(context.Background(), "anonymous", "127.0.0.1:1234", "")
+	audit := &auditLog{sink: zap.NewNop(), retain: 2}
+	audit.record(ctx, AddPackage, []string{"AAA"}, nil)
+	audit.record(ctx, AddPackage, []string{"BBB", "AAA"}, nil)
+	audit.record(ctx, RemovePackage, []string{"AAA"}, errors.New("expected unit test error"))
+
+	records := audit.query(auditFilter{})
+	require.Len(t, records, 2)
+	assert.Equal(t, "anonymous", records[0].Identity)
+	assert.Equal(t, "127.0.0.1:1234", records[0].RemoteAddr)
+	assert.Equal(t, AddPackage, records[0].Command)
+	assert.Equal(t, []string{"BBB", "AAA"}, records[0].Args)
+	assert.Equal(t, outcomeSuccess, records[0].Outcome)
+	assert.Equal(t, RemovePackage, records[1].Command)
+	assert.Equal(t, outcomeError, records[1].Outcome)
+	assert.Equal(t, "expected unit test error", records[1].Error)
+
+	assert.Len(t, audit.query(auditFilter{pkgName: "AAA"}), 1)
+	assert.Len(t, audit.query(auditFilter{since: time.Now().Add(time.Hour)}), 0)
+	assert.Len(t, audit.query(auditFilter{until: time.Now().Add(-time.Hour)}), 0)
+}
+
+func TestAuditLogNil(t *testing.T) {
+	t.Parallel()
+
+	var audit *auditLog
+	assert.NotPanics(t, func() {
+		audit.record(context.Background(), AddPackage, nil, nil)
+		audit.close()
+	})
+	assert.Empty(t, audit.query(auditFilter{}))
+}
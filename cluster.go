@@ -0,0 +1,685 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+	"go.uber.org/zap"
+)
+
+const (
+	opJoin   = "join"
+	opLeave  = "leave"
+	opRevert = "revert"
+)
+
+// clusterCommand is a write proposed to the leader of the cluster. Registry
+// writes are decided when applying the Raft log, so every node reaches the
+// same decision on the same registry.
+type clusterCommand struct {
+	Op      string        `json:"op"`
+	Name    string        `json:"name"`
+	Deps    []string      `json:"deps,omitempty"`
+	Upsert  bool          `json:"upsert,omitempty"`
+	Group   bool          `json:"group,omitempty"`
+	Quota   int           `json:"quota,omitempty"` // of the namespace added to, given by the leader
+	Address string        `json:"address,omitempty"`
+	Revert  *revertTarget `json:"revert,omitempty"`
+	Time    time.Time     `json:"time"` // given by the leader, for every node to agree
+}
+
+// clusterResult is the outcome of a command, along with the revision the
+// registry was at once applied.
+type clusterResult struct {
+	result   addResult
+	reverted revertResult
+	revision uint64
+	err      error
+}
+
+// forwardTimeout bounds writes forwarded to the leader without a deadline.
+const forwardTimeout = 10 * time.Second
+
+// clusterStore is the registry of a node of a Raft cluster. Writes are
+// committed to the Raft log by a quorum of nodes before being applied to the
+// inMemoryStore of every node, nodes other than the leader forward them.
+// Reads are served by the node, which may lag behind the leader.
+type clusterStore struct {
+	*inMemoryStore
+	logger    *zap.Logger
+	config    *config
+	raft      *raft.Raft
+	layer     *clusterLayer
+	transport *raft.NetworkTransport
+}
+
+func newClusterStore(lg *zap.Logger, cfg *config, store *inMemoryStore) *clusterStore {
+	return &clusterStore{
+		inMemoryStore: store,
+		logger:        lg,
+		config:        cfg,
+	}
+}
+
+func (c *clusterStore) listen() (net.Listener, error) {
+	listener, err := net.Listen("tcp", c.config.RaftAddr)
+	if err != nil {
+		return nil, err
+	}
+	if !c.config.UseMTLS {
+		return listener, nil
+	}
+	tlsConfig, err := c.config.tls()
+	if err != nil {
+		_ = listener.Close()
+		return nil, err
+	}
+	return tls.NewListener(listener, tlsConfig), nil
+}
+
+// start runs the Raft node on the listener, and bootstraps a new cluster
+// with the configured peers. The Raft log is kept in memory like the
+// registry, a restarted node catches up with a snapshot from the leader.
+func (c *clusterStore) start(listener net.Listener) error {
+	var peerTLS *tls.Config
+	if c.config.UseMTLS {
+		var err error
+		if peerTLS, err = c.config.peerTLS(c.config.RaftAddr); err != nil {
+			return err
+		}
+	}
+	logger := hclog.New(&hclog.LoggerOptions{
+		Name:   "raft",
+		Level:  hclog.Info,
+		Output: zap.NewStdLog(c.logger).Writer(),
+	})
+	c.layer = newClusterLayer(listener, c.config.RaftAddr, peerTLS, c.authorizePeer, c.serveForward)
+	go c.layer.serve()
+	c.transport = raft.NewNetworkTransportWithLogger(c.layer, 3, forwardTimeout, logger)
+
+	raftConfig := raft.DefaultConfig()
+	raftConfig.LocalID = raft.ServerID(c.config.RaftID)
+	raftConfig.HeartbeatTimeout = c.config.RaftHeartbeat
+	raftConfig.ElectionTimeout = c.config.RaftHeartbeat
+	raftConfig.LeaderLeaseTimeout = c.config.RaftHeartbeat / 2
+	raftConfig.SnapshotThreshold = c.config.RaftSnapshotAfter
+	raftConfig.TrailingLogs = c.config.RaftSnapshotAfter
+	raftConfig.Logger = logger
+	logs := raft.NewInmemStore()
+	node, err := raft.NewRaft(raftConfig, clusterFSM{store: c.inMemoryStore, logger: c.logger},
+		logs, logs, raft.NewInmemSnapshotStore(), c.transport)
+	if err != nil {
+		_ = c.transport.Close()
+		return fmt.Errorf("cannot start raft: %w", err)
+	}
+	c.raft = node
+
+	if len(c.config.RaftPeers) == 0 {
+		return nil
+	}
+	var servers []raft.Server
+	for id, addr := range c.config.RaftPeers {
+		servers = append(servers, raft.Server{ID: raft.ServerID(id), Address: raft.ServerAddress(addr)})
+	}
+	sort.Slice(servers, func(i, j int) bool {
+		return servers[i].ID < servers[j].ID
+	})
+	if err := c.raft.BootstrapCluster(raft.Configuration{Servers: servers}).Error(); err != nil {
+		c.stop()
+		return fmt.Errorf("cannot bootstrap cluster: %w", err)
+	}
+	return nil
+}
+
+func (c *clusterStore) stop() {
+	if err := c.raft.Shutdown().Error(); err != nil {
+		c.logger.Error("cannot stop raft", zap.Error(err))
+	}
+	_ = c.transport.Close()
+}
+
+func (c *clusterStore) add(ctx context.Context, name string, deps []string, upsert bool) (addResult, error) {
+	return c.insert(ctx, name, deps, upsert, false)
+}
+
+func (c *clusterStore) createGroup(ctx context.Context, name string, members []string, upsert bool) (addResult, error) {
+	return c.insert(ctx, name, members, upsert, true)
+}
+
+func (c *clusterStore) insert(ctx context.Context, name string, deps []string, upsert, group bool) (addResult, error) {
+	if err := validatePackageName(name); err != nil {
+		return packageUnchanged, err
+	}
+	deps, err := normalizeDeps(name, deps)
+	if err != nil {
+		return packageUnchanged, err
+	}
+	res := c.propose(ctx, clusterCommand{Op: opAdd, Name: name, Deps: deps, Upsert: upsert, Group: group})
+	return res.result, res.err
+}
+
+func (c *clusterStore) remove(ctx context.Context, name string) error {
+	return c.propose(ctx, clusterCommand{Op: opRemove, Name: name}).err
+}
+
+func (c *clusterStore) revert(ctx context.Context, target revertTarget) (revertResult, error) {
+	res := c.propose(ctx, clusterCommand{Op: opRevert, Revert: &target})
+	return res.reverted, res.err
+}
+
+// join adds a node as a voter, which then catches up with the leader.
+func (c *clusterStore) join(ctx context.Context, id, addr string) error {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return fmt.Errorf("invalid raft address %q: %s", addr, err)
+	}
+	return c.propose(ctx, clusterCommand{Op: opJoin, Name: id, Address: addr}).err
+}
+
+func (c *clusterStore) leave(ctx context.Context, id string) error {
+	return c.propose(ctx, clusterCommand{Op: opLeave, Name: id}).err
+}
+
+func (c *clusterStore) ready() error {
+	if addr, _ := c.raft.LeaderWithID(); addr == "" {
+		return errors.New("no cluster leader elected yet")
+	}
+	return nil
+}
+
+// propose runs the command on the leader, and waits for this node to apply
+// it so clients read their writes.
+func (c *clusterStore) propose(ctx context.Context, cmd clusterCommand) clusterResult {
+	// don't commit for a client that's gone
+	if err := ctx.Err(); err != nil {
+		return clusterResult{err: err}
+	}
+	if c.raft.State() == raft.Leader {
+		return c.lead(ctx, cmd)
+	}
+	res := c.forward(ctx, cmd)
+	if res.err == nil {
+		res.err = c.awaitApplied(ctx, res.revision)
+	}
+	return res
+}
+
+// awaitApplied waits for this node to apply the revision the leader
+// committed, as long as lead waits for a commit, so a lagging node doesn't
+// hold the client forever.
+func (c *clusterStore) awaitApplied(ctx context.Context, rev uint64) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, forwardTimeout)
+		defer cancel()
+	}
+	err := c.waitRevision(ctx, rev)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("%w: committed at revision %d, not applied by this node yet", ErrUnavailable, rev)
+	}
+	return err
+}
+
+// lead commits the command when this node is the leader.
+func (c *clusterStore) lead(ctx context.Context, cmd clusterCommand) clusterResult {
+	timeout := forwardTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+	var future raft.Future
+	switch cmd.Op {
+	case opJoin:
+		future = c.raft.AddVoter(raft.ServerID(cmd.Name), raft.ServerAddress(cmd.Address), 0, timeout)
+	case opLeave:
+		future = c.raft.RemoveServer(raft.ServerID(cmd.Name), 0, timeout)
+	default:
+		cmd.Time = time.Now().UTC()
+		if cmd.Op == opAdd {
+			cmd.Quota = c.config.NamespaceQuotas[namespaceOf(cmd.Name)]
+		}
+		data, err := json.Marshal(cmd)
+		if err != nil {
+			return clusterResult{err: err}
+		}
+		future = c.raft.Apply(data, timeout)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- future.Error()
+	}()
+	select {
+	case <-ctx.Done():
+		return clusterResult{err: ctx.Err()}
+	case err := <-done:
+		if err != nil {
+			return clusterResult{err: fmt.Errorf("%w: %s", ErrUnavailable, err)}
+		}
+	}
+	if cmd.Op == opJoin || cmd.Op == opLeave {
+		return clusterResult{revision: c.latest().revision}
+	}
+	return future.(raft.ApplyFuture).Response().(clusterResult)
+}
+
+// forwardResponse is what the leader answers to a forwarded command.
+type forwardResponse struct {
+	Result   addResult     `json:"result"`
+	Reverted *revertResult `json:"reverted,omitempty"`
+	Revision uint64        `json:"revision"`
+	Error    string        `json:"error,omitempty"`
+	Code     string        `json:"code,omitempty"`
+}
+
+// forward sends the command to the leader over its Raft address.
+func (c *clusterStore) forward(ctx context.Context, cmd clusterCommand) clusterResult {
+	addr, id := c.raft.LeaderWithID()
+	if addr == "" {
+		return clusterResult{err: fmt.Errorf("%w: no leader elected", ErrUnavailable)}
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, forwardTimeout)
+		defer cancel()
+	}
+	connection, err := c.layer.dial(ctx, string(addr), streamForward)
+	if err != nil {
+		return clusterResult{err: fmt.Errorf("%w: cannot reach the leader %s at %s: %s", ErrUnavailable, id, addr, err)}
+	}
+	defer connection.Close()
+	deadline, _ := ctx.Deadline()
+	if err := connection.SetDeadline(deadline); err != nil {
+		return clusterResult{err: err}
+	}
+	var response forwardResponse
+	if err := json.NewEncoder(connection).Encode(cmd); err == nil {
+		err = json.NewDecoder(connection).Decode(&response)
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return clusterResult{err: ctx.Err()}
+		}
+		return clusterResult{err: fmt.Errorf("%w: lost the leader %s at %s: %s", ErrUnavailable, id, addr, err)}
+	}
+	if response.Error != "" {
+		return clusterResult{err: &remoteError{code: response.Code, message: response.Error}}
+	}
+	res := clusterResult{result: response.Result, revision: response.Revision}
+	if response.Reverted != nil {
+		res.reverted = *response.Reverted
+	}
+	return res
+}
+
+// authorizePeer only lets in other nodes, whose certs must grant admin like
+// JoinCluster requires, as they can write anything to the registry. Without
+// mTLS, anyone reaching the Raft address is let in when allowed explicitly.
+func (c *clusterStore) authorizePeer(connection net.Conn) bool {
+	peerField := zap.Stringer("peer_addr", connection.RemoteAddr())
+	if !c.config.UseMTLS {
+		if !c.config.RaftInsecure {
+			c.logger.Warn("refused raft connection without mTLS", peerField)
+		}
+		return c.config.RaftInsecure
+	}
+	if tlsConn, ok := connection.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err != nil {
+			c.logger.Warn("failed raft connection handshake", peerField, zap.Error(err))
+			return false
+		}
+	}
+	identity := clientIdentity(connection)
+	if granted := c.config.permissionOf(identity); granted < permissionAdmin {
+		c.logger.Warn("refused raft connection of a client lacking admin permission", peerField,
+			zap.String("identity", identity), zap.Stringer("permission", granted))
+		return false
+	}
+	return true
+}
+
+// serveForward commits a command forwarded by another node.
+func (c *clusterStore) serveForward(connection net.Conn) {
+	defer connection.Close()
+	if err := connection.SetDeadline(time.Now().Add(forwardTimeout)); err != nil {
+		return
+	}
+	var cmd clusterCommand
+	if err := json.NewDecoder(connection).Decode(&cmd); err != nil {
+		c.logger.Warn("cannot read forwarded command", zap.Stringer("peer_addr", connection.RemoteAddr()), zap.Error(err))
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), forwardTimeout)
+	defer cancel()
+	res := c.lead(ctx, cmd)
+	response := forwardResponse{Result: res.result, Revision: res.revision}
+	if cmd.Op == opRevert {
+		response.Reverted = &res.reverted
+	}
+	if res.err != nil {
+		response.Error, response.Code = res.err.Error(), errorCode(res.err)
+	}
+	_ = json.NewEncoder(connection).Encode(response)
+}
+
+// waitRevision waits for the registry to reach the revision.
+func (store *inMemoryStore) waitRevision(ctx context.Context, rev uint64) error {
+	for {
+		h := store.history.Load().(*history)
+		if h.snapshots[len(h.snapshots)-1].revision >= rev {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-h.published:
+		}
+	}
+}
+
+// remoteError is an error returned by the leader, which matches the errors
+// of its code with errors.Is.
+type remoteError struct {
+	code    string
+	message string
+}
+
+func (e *remoteError) Error() string {
+	return e.message
+}
+
+func (e *remoteError) Is(target error) bool {
+	for _, c := range errorCodes {
+		if c.err == target {
+			return c.code == e.code
+		}
+	}
+	return false
+}
+
+// clusterMember is a node of the cluster configuration.
+type clusterMember struct {
+	ID      string `json:"id"`
+	Address string `json:"address"`
+}
+
+func (c *clusterStore) replication() replicationStatus {
+	addr, leader := c.raft.LeaderWithID()
+	status := replicationStatus{
+		Role:      roleCluster,
+		State:     strings.ToLower(c.raft.State().String()),
+		Leader:    string(leader),
+		Connected: addr != "",
+		Revision:  c.latest().revision,
+	}
+	future := c.raft.GetConfiguration()
+	if err := future.Error(); err == nil {
+		for _, server := range future.Configuration().Servers {
+			status.Members = append(status.Members, clusterMember{ID: string(server.ID), Address: string(server.Address)})
+		}
+	}
+	return status
+}
+
+// join and leave fail on a registry that is not part of a cluster.
+func (store *inMemoryStore) join(ctx context.Context, id, addr string) error {
+	return fmt.Errorf("%w, start it with a raft node ID", ErrNotClustered)
+}
+
+func (store *inMemoryStore) leave(ctx context.Context, id string) error {
+	return fmt.Errorf("%w, start it with a raft node ID", ErrNotClustered)
+}
+
+// clusterFSM applies the Raft log to the registry of the node.
+type clusterFSM struct {
+	store  *inMemoryStore
+	logger *zap.Logger
+}
+
+func (fsm clusterFSM) Apply(entry *raft.Log) interface{} {
+	var cmd clusterCommand
+	if err := json.Unmarshal(entry.Data, &cmd); err != nil {
+		fsm.logger.Error("cannot decode raft log entry", zap.Uint64("index", entry.Index), zap.Error(err))
+		return clusterResult{revision: fsm.store.latest().revision, err: err}
+	}
+	return fsm.store.execute(cmd)
+}
+
+// execute decides and commits a registry write of the Raft log.
+func (store *inMemoryStore) execute(cmd clusterCommand) clusterResult {
+	store.lock()
+	defer store.Unlock()
+
+	current := store.latest()
+	var c *change
+	res := clusterResult{result: packageUnchanged}
+	switch cmd.Op {
+	case opAdd:
+		c, res.result, res.err = current.addChange(cmd.Name, cmd.Deps, cmd.Upsert, cmd.Group)
+		if res.err == nil && res.result == packageAdded {
+			if res.err = current.checkQuota(cmd.Name, cmd.Quota); res.err != nil {
+				c, res.result = nil, packageUnchanged
+			}
+		}
+	case opRemove:
+		c, res.err = current.removeChange(cmd.Name)
+	case opRevert:
+		if cmd.Revert == nil {
+			res.err = errors.New("revert command without a target")
+			break
+		}
+		res.reverted, res.err = store.revertTo(*cmd.Revert, cmd.Time)
+	default:
+		res.err = fmt.Errorf("unknown command operation %q", cmd.Op)
+	}
+	if c != nil {
+		c.Time = cmd.Time
+		store.commit(current, *c)
+	}
+	res.revision = store.latest().revision
+	return res
+}
+
+// clusterSnapshot is the registry as persisted in Raft snapshots, with the
+// retained mutations so that nodes restoring it keep the package history.
+type clusterSnapshot struct {
+	Revision  uint64            `json:"revision"`
+	Packages  []packageInfo     `json:"packages"`
+	Mutations []clusterMutation `json:"mutations,omitempty"`
+	Since     time.Time         `json:"since"`
+}
+
+type clusterMutation struct {
+	change
+	Existed  bool     `json:"existed,omitempty"`
+	Previous []string `json:"previous,omitempty"`
+}
+
+// Snapshot is called in between applying log entries, so the latest
+// snapshot of the registry matches the last applied one.
+func (fsm clusterFSM) Snapshot() (raft.FSMSnapshot, error) {
+	return fsmSnapshot{history: fsm.store.history.Load().(*history)}, nil
+}
+
+// Restore replaces the registry, in a new generation as followers of the
+// node cannot catch up with changes anymore.
+func (fsm clusterFSM) Restore(reader io.ReadCloser) error {
+	defer reader.Close()
+	var snap clusterSnapshot
+	if err := json.NewDecoder(reader).Decode(&snap); err != nil {
+		return fmt.Errorf("cannot decode raft snapshot: %w", err)
+	}
+	mutations := make([]mutation, 0, len(snap.Mutations))
+	for _, m := range snap.Mutations {
+		mutations = append(mutations, mutation{change: m.change, existed: m.Existed, previous: m.Previous})
+	}
+	fsm.store.restore(newGeneration(), snap.Revision, snap.Packages, mutations, snap.Since)
+	return nil
+}
+
+// fsmSnapshot persists the latest snapshot of a history, which is never
+// modified once published.
+type fsmSnapshot struct {
+	history *history
+}
+
+func (s fsmSnapshot) Persist(sink raft.SnapshotSink) error {
+	latest := s.history.snapshots[len(s.history.snapshots)-1]
+	persisted := clusterSnapshot{Revision: latest.revision, Packages: latest.infos(), Since: s.history.since}
+	for _, m := range s.history.mutations {
+		persisted.Mutations = append(persisted.Mutations, clusterMutation{change: m.change, Existed: m.existed, Previous: m.previous})
+	}
+	err := json.NewEncoder(sink).Encode(persisted)
+	if err != nil {
+		_ = sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s fsmSnapshot) Release() {}
+
+// Connections to the Raft address start with a byte telling what they carry.
+const (
+	streamRaft    byte = 'R'
+	streamForward byte = 'F'
+)
+
+// clusterLayer carries both the Raft transport and the commands forwarded to
+// the leader on the Raft address, for the connections authorize lets in.
+type clusterLayer struct {
+	net.Listener
+	advertise raftAddr
+	tls       *tls.Config // of outgoing connections, nil without mTLS
+	authorize func(net.Conn) bool
+	forward   func(net.Conn)
+	raftConns chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newClusterLayer(listener net.Listener, advertise string, peerTLS *tls.Config, authorize func(net.Conn) bool, forward func(net.Conn)) *clusterLayer {
+	return &clusterLayer{
+		Listener:  listener,
+		advertise: raftAddr(advertise),
+		tls:       peerTLS,
+		authorize: authorize,
+		forward:   forward,
+		raftConns: make(chan net.Conn),
+		closed:    make(chan struct{}),
+	}
+}
+
+func (l *clusterLayer) serve() {
+	for {
+		connection, err := l.Listener.Accept()
+		if err != nil {
+			select {
+			case <-l.closed:
+				return
+			default:
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+		}
+		go l.dispatch(connection)
+	}
+}
+
+func (l *clusterLayer) dispatch(connection net.Conn) {
+	kind := make([]byte, 1)
+	_ = connection.SetDeadline(time.Now().Add(forwardTimeout))
+	if !l.authorize(connection) {
+		_ = connection.Close()
+		return
+	}
+	if _, err := io.ReadFull(connection, kind); err != nil {
+		_ = connection.Close()
+		return
+	}
+	_ = connection.SetDeadline(time.Time{})
+	switch kind[0] {
+	case streamRaft:
+		select {
+		case l.raftConns <- connection:
+		case <-l.closed:
+			_ = connection.Close()
+		}
+	case streamForward:
+		l.forward(connection)
+	default:
+		_ = connection.Close()
+	}
+}
+
+// Addr is the address other nodes reach this one at, which Raft gives them
+// as the leader's, instead of the one the listener is bound to.
+func (l *clusterLayer) Addr() net.Addr {
+	return l.advertise
+}
+
+// raftAddr is the configured Raft address of a node, as given.
+type raftAddr string
+
+func (a raftAddr) Network() string {
+	return "tcp"
+}
+
+func (a raftAddr) String() string {
+	return string(a)
+}
+
+// Accept returns the Raft connections to the transport.
+func (l *clusterLayer) Accept() (net.Conn, error) {
+	select {
+	case connection := <-l.raftConns:
+		return connection, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *clusterLayer) Close() error {
+	err := net.ErrClosed
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		err = l.Listener.Close()
+	})
+	return err
+}
+
+func (l *clusterLayer) Dial(address raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return l.dial(ctx, string(address), streamRaft)
+}
+
+func (l *clusterLayer) dial(ctx context.Context, address string, kind byte) (net.Conn, error) {
+	dialer := &net.Dialer{}
+	var connection net.Conn
+	var err error
+	if l.tls == nil {
+		connection, err = dialer.DialContext(ctx, "tcp", address)
+	} else {
+		host, _, _ := net.SplitHostPort(address)
+		tlsConfig := l.tls.Clone()
+		tlsConfig.ServerName = host
+		connection, err = (&tls.Dialer{NetDialer: dialer, Config: tlsConfig}).DialContext(ctx, "tcp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := connection.Write([]byte{kind}); err != nil {
+		_ = connection.Close()
+		return nil, err
+	}
+	return connection, nil
+}
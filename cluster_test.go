@@ -0,0 +1,386 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// startClusterNodes starts a node over loopback for every ID, bootstrapped
+// as a new cluster of the nodes when bootstrap.
+func startClusterNodes(t *testing.T, bootstrap bool, snapshotAfter uint64, ids ...string) []*clusterStore {
+	t.Helper()
+	listeners := make([]net.Listener, len(ids))
+	peers := make(raftPeers, len(ids))
+	for i, id := range ids {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		listeners[i], peers[id] = listener, listener.Addr().String()
+	}
+	if !bootstrap {
+		peers = nil
+	}
+	nodes := make([]*clusterStore, len(ids))
+	for i, id := range ids {
+		cfg := &config{
+			RaftID:            id,
+			RaftAddr:          listeners[i].Addr().String(),
+			RaftPeers:         peers,
+			RaftHeartbeat:     300 * time.Millisecond,
+			RaftSnapshotAfter: snapshotAfter,
+			RaftInsecure:      true,
+		}
+		nodes[i] = newClusterStore(zap.NewNop(), cfg, newInMemoryStore(nil, 4, 4, nil))
+		require.NoError(t, nodes[i].start(listeners[i]))
+		t.Cleanup(nodes[i].stop)
+	}
+	return nodes
+}
+
+// newClusterStoreWith starts a single node cluster seeded with packages at
+// revision 1 when given.
+func newClusterStoreWith(t *testing.T, m *metrics, retain int, pkgs map[string]onePackage) registry {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := listener.Addr().String()
+	cfg := &config{
+		RaftID:            "n1",
+		RaftAddr:          addr,
+		RaftPeers:         raftPeers{"n1": addr},
+		RaftHeartbeat:     50 * time.Millisecond,
+		RaftSnapshotAfter: 8192,
+		RaftInsecure:      true,
+	}
+	node := newClusterStore(zap.NewNop(), cfg, newInMemoryStoreWith(m, retain, pkgs))
+	require.NoError(t, node.start(listener))
+	t.Cleanup(node.stop)
+	clusterLeader(t, node)
+	return node
+}
+
+// clusterLeader waits for one of the nodes to lead and every node to know it.
+func clusterLeader(t *testing.T, nodes ...*clusterStore) *clusterStore {
+	t.Helper()
+	var leader *clusterStore
+	require.Eventually(t, func() bool {
+		leader = nil
+		for _, node := range nodes {
+			if node.ready() != nil {
+				return false
+			}
+			if node.raft.State() == raft.Leader {
+				leader = node
+			}
+		}
+		return leader != nil
+	}, 10*time.Second, 10*time.Millisecond)
+	return leader
+}
+
+// requireConverged waits for the nodes to reach the same revision, with the
+// same packages changed at the same times.
+func requireConverged(t *testing.T, nodes ...*clusterStore) {
+	t.Helper()
+	ctx := context.Background()
+	require.Eventually(t, func() bool {
+		for _, node := range nodes[1:] {
+			if node.revision(ctx) != nodes[0].revision(ctx) {
+				return false
+			}
+		}
+		return true
+	}, 10*time.Second, 10*time.Millisecond)
+	want, err := nodes[0].list(ctx, latestRevision)
+	require.NoError(t, err)
+	for _, node := range nodes[1:] {
+		got, err := node.list(ctx, latestRevision)
+		require.NoError(t, err)
+		assert.Equal(t, want, got, node.config.RaftID)
+		problems, err := node.check(ctx)
+		require.NoError(t, err)
+		assert.Empty(t, problems)
+		for _, pkg := range want {
+			wantHistory, err := nodes[0].packageHistory(ctx, pkg.Name)
+			require.NoError(t, err)
+			gotHistory, err := node.packageHistory(ctx, pkg.Name)
+			require.NoError(t, err)
+			assert.Equal(t, wantHistory, gotHistory, node.config.RaftID)
+		}
+	}
+}
+
+func TestClusterStore(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	nodes := startClusterNodes(t, true, 8192, "n1", "n2", "n3")
+	leader := clusterLeader(t, nodes...)
+	var followers []*clusterStore
+	for _, node := range nodes {
+		if node != leader {
+			followers = append(followers, node)
+		}
+	}
+
+	// writes to followers are forwarded, and read back right away
+	result, err := followers[0].add(ctx, "AAA", nil, false)
+	require.NoError(t, err)
+	assert.Equal(t, packageAdded, result)
+	_, err = followers[0].get(ctx, "AAA", latestRevision)
+	require.NoError(t, err)
+
+	result, err = followers[1].add(ctx, "BBB", []string{"AAA", "AAA"}, false)
+	require.NoError(t, err)
+	assert.Equal(t, packageAdded, result)
+	result, err = leader.add(ctx, "BBB", []string{"AAA"}, false)
+	require.NoError(t, err)
+	assert.Equal(t, packageUnchanged, result)
+
+	// errors of the leader keep their code
+	_, err = followers[0].add(ctx, "BBB", []string{"CCC"}, false)
+	assert.True(t, errors.Is(err, ErrAlreadyExists), err)
+	err = followers[1].remove(ctx, "AAA")
+	assert.EqualError(t, err, `package AAA cannot be removed, it's required by ["BBB"]`)
+	assert.Equal(t, "still_required", errorCode(err))
+	_, err = followers[0].add(ctx, "AAA", []string{"BBB"}, true)
+	assert.Equal(t, "dependency_cycle", errorCode(err))
+	_, err = followers[0].add(ctx, "", nil, false)
+	assert.Equal(t, "invalid_name", errorCode(err))
+
+	require.NoError(t, followers[0].remove(ctx, "BBB"))
+
+	// reverts are forwarded too, along with what they did
+	reverted, err := followers[1].revert(ctx, revertTarget{Last: 1})
+	require.NoError(t, err)
+	assert.Equal(t, revertResult{To: 3, Changes: 1, Revision: 5}, reverted)
+	_, err = followers[1].get(ctx, "BBB", latestRevision)
+	require.NoError(t, err)
+	_, err = followers[0].revert(ctx, revertTarget{Revision: 9})
+	assert.Equal(t, "unknown_revision", errorCode(err))
+	requireConverged(t, nodes...)
+	assert.Equal(t, uint64(5), leader.revision(ctx))
+
+	status := followers[0].replication()
+	assert.Equal(t, roleCluster, status.Role)
+	assert.Equal(t, "follower", status.State)
+	assert.Equal(t, leader.config.RaftID, status.Leader)
+	assert.True(t, status.Connected)
+	assert.Equal(t, []clusterMember{
+		{ID: "n1", Address: nodes[0].config.RaftAddr},
+		{ID: "n2", Address: nodes[1].config.RaftAddr},
+		{ID: "n3", Address: nodes[2].config.RaftAddr},
+	}, status.Members)
+
+	// the remaining quorum elects another leader and keeps committing
+	leader.stop()
+	newLeader := clusterLeader(t, followers...)
+	for _, node := range followers {
+		if node != newLeader {
+			_, err = node.add(ctx, "CCC", []string{"AAA"}, false)
+			require.NoError(t, err)
+		}
+	}
+	requireConverged(t, followers...)
+	assert.Equal(t, uint64(6), newLeader.revision(ctx))
+}
+
+func TestClusterStoreHostnameAddr(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	listeners := make([]net.Listener, 2)
+	peers := make(raftPeers, len(listeners))
+	for i := range listeners {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		_, port, err := net.SplitHostPort(listener.Addr().String())
+		require.NoError(t, err)
+		listeners[i], peers[fmt.Sprintf("n%d", i+1)] = listener, net.JoinHostPort("localhost", port)
+	}
+	nodes := make([]*clusterStore, len(listeners))
+	for i, listener := range listeners {
+		id := fmt.Sprintf("n%d", i+1)
+		cfg := &config{
+			RaftID:            id,
+			RaftAddr:          peers[id],
+			RaftPeers:         peers,
+			RaftHeartbeat:     300 * time.Millisecond,
+			RaftSnapshotAfter: 8192,
+			RaftInsecure:      true,
+		}
+		nodes[i] = newClusterStore(zap.NewNop(), cfg, newInMemoryStore(nil, 4, 4, nil))
+		require.NoError(t, nodes[i].start(listener))
+		t.Cleanup(nodes[i].stop)
+	}
+	leader := clusterLeader(t, nodes...)
+
+	// nodes know the leader by its configured address, not the bound one
+	for _, node := range nodes {
+		assert.Equal(t, raft.ServerAddress(leader.config.RaftAddr), node.raft.Leader(), node.config.RaftID)
+	}
+	for _, node := range nodes {
+		if node != leader {
+			result, err := node.add(ctx, "AAA", nil, false)
+			require.NoError(t, err)
+			assert.Equal(t, packageAdded, result)
+		}
+	}
+}
+
+func TestClusterStoreAwaitApplied(t *testing.T) {
+	t.Parallel()
+
+	node := startClusterNodes(t, true, 8192, "n1")[0]
+	clusterLeader(t, node)
+
+	require.NoError(t, node.awaitApplied(context.Background(), node.revision(context.Background())))
+
+	// a revision committed but not applied here gives up with the deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := node.awaitApplied(ctx, 42)
+	assert.True(t, errors.Is(err, ErrUnavailable), err)
+	assert.EqualError(t, err, "cluster unavailable: committed at revision 42, not applied by this node yet")
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, node.awaitApplied(ctx, 42))
+}
+
+func TestClusterStoreJoinFromSnapshot(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	first := startClusterNodes(t, true, 2, "n1")[0]
+	clusterLeader(t, first)
+	for i := 0; i < 10; i++ {
+		var deps []string
+		if i > 0 {
+			deps = []string{fmt.Sprintf("P%d", i-1)}
+		}
+		_, err := first.add(ctx, fmt.Sprintf("P%d", i), deps, false)
+		require.NoError(t, err)
+	}
+	require.NoError(t, first.raft.Snapshot().Error())
+
+	// the log was compacted, the new node catches up with the snapshot
+	second := startClusterNodes(t, false, 2, "n2")[0]
+	require.NoError(t, first.join(ctx, "n2", second.config.RaftAddr))
+	requireConverged(t, first, second)
+	assert.Equal(t, uint64(11), second.revision(ctx))
+	assert.NotEqual(t, first.latest().generation, second.latest().generation)
+
+	_, err := second.add(ctx, "P10", []string{"P9"}, false)
+	require.NoError(t, err)
+	requireConverged(t, first, second)
+
+	require.NoError(t, second.leave(ctx, "n1"))
+	assert.Eventually(t, func() bool {
+		return second.raft.State() == raft.Leader
+	}, 10*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []clusterMember{{ID: "n2", Address: second.config.RaftAddr}}, second.replication().Members)
+
+	err = second.join(ctx, "n3", "nowhere")
+	assert.EqualError(t, err, `invalid raft address "nowhere": address nowhere: missing port in address`)
+}
+
+func TestRemoteError(t *testing.T) {
+	t.Parallel()
+
+	err := fmt.Errorf("failed removing package: %w", &remoteError{code: "still_required", message: "package AAA is required"})
+	assert.True(t, errors.Is(err, ErrStillRequired))
+	assert.False(t, errors.Is(err, ErrNotFound))
+	assert.Equal(t, "still_required", errorCode(err))
+	assert.EqualError(t, err, "failed removing package: package AAA is required")
+
+	err = newInMemoryStore(nil, 1, 1, nil).join(context.Background(), "n2", "127.0.0.1:9200")
+	assert.Equal(t, "not_clustered", errorCode(err))
+}
+
+func TestClusterStoreAuthorizePeer(t *testing.T) {
+	t.Parallel()
+
+	rootCA, err := ioutil.ReadFile("testdata/Test_Root_CA.crt")
+	require.NoError(t, err)
+	serverKey, err := ioutil.ReadFile("testdata/unit_test.key")
+	require.NoError(t, err)
+	serverCert, err := ioutil.ReadFile("testdata/unit_test.crt")
+	require.NoError(t, err)
+	clientCert, err := tls.X509KeyPair(serverCert, serverKey)
+	require.NoError(t, err)
+	// the unit_test cert has expired, handshake as if it was still valid
+	validAt := func() time.Time { return time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC) }
+
+	// forward sends a write to a single node cluster as a client holding the
+	// unit_test cert, which is granted the permission
+	forward := func(t *testing.T, permission string) (forwardResponse, error) {
+		cfg := &config{
+			UseMTLS:           true,
+			RootCA:            string(rootCA),
+			ServerCert:        string(serverCert),
+			ServerKey:         string(serverKey),
+			DefaultPermission: "admin",
+			ClientPermissions: clientPermissions{"unit_test": permission},
+			RaftID:            "n1",
+			RaftHeartbeat:     50 * time.Millisecond,
+			RaftSnapshotAfter: 8192,
+		}
+		tlsConfig, err := cfg.tls()
+		require.NoError(t, err)
+		tlsConfig.Time = validAt
+		listener, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+		require.NoError(t, err)
+		cfg.RaftAddr = listener.Addr().String()
+		cfg.RaftPeers = raftPeers{"n1": cfg.RaftAddr}
+		node := newClusterStore(zap.NewNop(), cfg, newInMemoryStore(nil, 1, 1, nil))
+		require.NoError(t, node.start(listener))
+		t.Cleanup(node.stop)
+		clusterLeader(t, node)
+
+		connection, err := tls.Dial("tcp", cfg.RaftAddr, &tls.Config{Certificates: []tls.Certificate{clientCert}, InsecureSkipVerify: true, Time: validAt})
+		require.NoError(t, err)
+		defer connection.Close()
+		require.NoError(t, connection.SetDeadline(time.Now().Add(5*time.Second)))
+		_, err = connection.Write([]byte{streamForward})
+		require.NoError(t, err)
+		var response forwardResponse
+		if err = json.NewEncoder(connection).Encode(clusterCommand{Op: opAdd, Name: "AAA"}); err == nil {
+			err = json.NewDecoder(connection).Decode(&response)
+		}
+		assert.Equal(t, err == nil, node.revision(context.Background()) == 2)
+		return response, err
+	}
+
+	t.Run("admin", func(t *testing.T) {
+		t.Parallel()
+		response, err := forward(t, "admin")
+		require.NoError(t, err)
+		assert.Equal(t, forwardResponse{Result: packageAdded, Revision: 2}, response)
+	})
+	t.Run("read only", func(t *testing.T) {
+		t.Parallel()
+		_, err := forward(t, "read")
+		assert.Error(t, err)
+	})
+	t.Run("without mTLS", func(t *testing.T) {
+		t.Parallel()
+		server, client := net.Pipe()
+		defer client.Close()
+		node := newClusterStore(zap.NewNop(), &config{}, nil)
+		assert.False(t, node.authorizePeer(server))
+		node.config.RaftInsecure = true
+		assert.True(t, node.authorizePeer(server))
+	})
+}
@@ -3,24 +3,405 @@ package main
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/pem"
 	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/kelseyhightower/envconfig"
+	"gopkg.in/yaml.v3"
 )
 
+// config is resolved in order of precedence: command-line flags, env vars,
+// the YAML config file given by -config or PACMAN_CONFIG, then defaults.
 type config struct {
-	Listen     string `default:":9000"`
-	UseMTLS    bool   `envconfig:"USE_MTLS" default:"true"`
-	RootCA     string `envconfig:"TLS_ROOT_CA"`
-	ServerKey  string `envconfig:"TLS_SERVER_KEY"`
-	ServerCert string `envconfig:"TLS_SERVER_CERT"`
+	File               string            `envconfig:"PACMAN_CONFIG" yaml:"-"`
+	PrintConfig        bool              `ignored:"true" yaml:"-"`
+	Listen             string            `yaml:"listen"`
+	AdminListen        string            `envconfig:"ADMIN_LISTEN" yaml:"admin_listen"`
+	UseMTLS            bool              `envconfig:"USE_MTLS" yaml:"use_mtls"`
+	RootCA             string            `envconfig:"TLS_ROOT_CA" yaml:"tls_root_ca"`
+	RootCAFile         string            `envconfig:"TLS_ROOT_CA_FILE" yaml:"tls_root_ca_file"`
+	ServerKey          string            `envconfig:"TLS_SERVER_KEY" yaml:"tls_server_key"`
+	ServerKeyFile      string            `envconfig:"TLS_SERVER_KEY_FILE" yaml:"tls_server_key_file"`
+	ServerCert         string            `envconfig:"TLS_SERVER_CERT" yaml:"tls_server_cert"`
+	ServerCertFile     string            `envconfig:"TLS_SERVER_CERT_FILE" yaml:"tls_server_cert_file"`
+	TLSExpiryThreshold time.Duration     `envconfig:"TLS_EXPIRY_THRESHOLD" yaml:"tls_expiry_threshold"`
+	AuditFile          string            `envconfig:"AUDIT_FILE" yaml:"audit_file"`
+	AuditMaxSizeMB     int               `envconfig:"AUDIT_MAX_SIZE_MB" yaml:"audit_max_size_mb"`
+	AuditMaxBackups    int               `envconfig:"AUDIT_MAX_BACKUPS" yaml:"audit_max_backups"`
+	AuditMaxAgeDays    int               `envconfig:"AUDIT_MAX_AGE_DAYS" yaml:"audit_max_age_days"`
+	AuditRetain        int               `envconfig:"AUDIT_RETAIN" yaml:"audit_retain"`
+	IdleTimeout        time.Duration     `envconfig:"IDLE_TIMEOUT" yaml:"idle_timeout"`
+	ReadTimeout        time.Duration     `envconfig:"READ_TIMEOUT" yaml:"read_timeout"`
+	WriteTimeout       time.Duration     `envconfig:"WRITE_TIMEOUT" yaml:"write_timeout"`
+	MaxLineLength      int               `envconfig:"MAX_LINE_LENGTH" yaml:"max_line_length"`
+	MaxDependencies    int               `envconfig:"MAX_DEPENDENCIES" yaml:"max_dependencies"`
+	MaxPipelined       int               `envconfig:"MAX_PIPELINED" yaml:"max_pipelined"`
+	SnapshotRetain     int               `envconfig:"SNAPSHOT_RETAIN" yaml:"snapshot_retain"`
+	HistoryRetain      int               `envconfig:"HISTORY_RETAIN" yaml:"history_retain"`
+	SQLiteFile         string            `envconfig:"SQLITE_FILE" yaml:"sqlite_file"`
+	PrimaryAddr        string            `envconfig:"PRIMARY_ADDR" yaml:"primary_addr"`
+	ReplicaHeartbeat   time.Duration     `envconfig:"REPLICATION_HEARTBEAT" yaml:"replication_heartbeat"`
+	RaftID             string            `envconfig:"RAFT_ID" yaml:"raft_id"`
+	RaftAddr           string            `envconfig:"RAFT_ADDR" yaml:"raft_addr"`
+	RaftPeers          raftPeers         `envconfig:"RAFT_PEERS" yaml:"raft_peers"`
+	RaftHeartbeat      time.Duration     `envconfig:"RAFT_HEARTBEAT" yaml:"raft_heartbeat"`
+	RaftSnapshotAfter  uint64            `envconfig:"RAFT_SNAPSHOT_AFTER" yaml:"raft_snapshot_after"`
+	RaftInsecure       bool              `envconfig:"RAFT_INSECURE" yaml:"raft_insecure"`
+	DefaultPermission  string            `envconfig:"DEFAULT_PERMISSION" yaml:"default_permission"`
+	ClientPermissions  clientPermissions `envconfig:"CLIENT_PERMISSIONS" yaml:"client_permissions"`
+	ClientNamespaces   clientNamespaces  `envconfig:"CLIENT_NAMESPACES" yaml:"client_namespaces"`
+	NamespaceQuotas    namespaceQuotas   `envconfig:"NAMESPACE_QUOTAS" yaml:"namespace_quotas"`
 }
 
-func newConfig() (*config, error) {
-	var conf config
-	err := envconfig.Process("", &conf)
-	return &conf, err
+func defaultConfig() config {
+	return config{
+		Listen:             ":9000",
+		AdminListen:        ":9100",
+		UseMTLS:            true,
+		TLSExpiryThreshold: 168 * time.Hour,
+		AuditMaxSizeMB:     100,
+		AuditMaxBackups:    10,
+		AuditMaxAgeDays:    30,
+		AuditRetain:        10000,
+		IdleTimeout:        time.Minute,
+		ReadTimeout:        10 * time.Second,
+		WriteTimeout:       10 * time.Second,
+		MaxLineLength:      1024,
+		MaxDependencies:    100,
+		MaxPipelined:       16,
+		SnapshotRetain:     64,
+		HistoryRetain:      10000,
+		ReplicaHeartbeat:   time.Second,
+		RaftHeartbeat:      time.Second,
+		RaftSnapshotAfter:  8192,
+		DefaultPermission:  "admin",
+	}
+}
+
+func newConfig(args []string) (*config, error) {
+	conf := defaultConfig()
+
+	// flags are parsed twice, first only to find out the config file path
+	var preParsed config
+	preFlags := preParsed.flagSet(ioutil.Discard)
+	_ = preFlags.Parse(args)
+	file := preParsed.File
+	if file == "" {
+		file = os.Getenv("PACMAN_CONFIG")
+	}
+	if file != "" {
+		if err := conf.withTLSFiles(func() error { return conf.load(file) }); err != nil {
+			return nil, err
+		}
+	}
+	if err := conf.withTLSFiles(func() error { return envconfig.Process("", &conf) }); err != nil {
+		return nil, err
+	}
+	if err := conf.withTLSFiles(func() error { return conf.flagSet(os.Stderr).Parse(args) }); err != nil {
+		return nil, err
+	}
+	if err := conf.validate(); err != nil {
+		return nil, err
+	}
+	return &conf, nil
+}
+
+func (c *config) validate() error {
+	if c.ReplicaHeartbeat <= 0 {
+		return errors.New("replication heartbeat must be positive")
+	}
+	if c.MaxLineLength <= 0 {
+		return errors.New("max line length must be positive")
+	}
+	if c.MaxDependencies < 0 {
+		return errors.New("max dependencies cannot be negative")
+	}
+	if c.MaxPipelined < 0 {
+		return errors.New("max pipelined cannot be negative")
+	}
+	if err := c.validateRaft(); err != nil {
+		return err
+	}
+	if c.SQLiteFile != "" && (c.PrimaryAddr != "" || c.RaftID != "") {
+		return errors.New("followers and cluster nodes keep the registry in memory, not in SQLite")
+	}
+	if _, err := parsePermission(c.DefaultPermission); err != nil {
+		return fmt.Errorf("invalid default permission: %s", err)
+	}
+	for identity, name := range c.ClientPermissions {
+		if _, err := parsePermission(name); err != nil {
+			return fmt.Errorf("invalid permission for client %s: %s", identity, err)
+		}
+	}
+	for identity, ns := range c.ClientNamespaces {
+		if err := validateNamespace(ns); err != nil {
+			return fmt.Errorf("invalid namespace for client %s: %s", identity, err)
+		}
+	}
+	for ns, quota := range c.NamespaceQuotas {
+		if err := validateNamespace(ns); err != nil {
+			return fmt.Errorf("invalid namespace quota: %s", err)
+		}
+		if quota <= 0 {
+			return fmt.Errorf("quota of namespace %s must be positive", ns)
+		}
+	}
+	return nil
+}
+
+func (c *config) validateRaft() error {
+	if c.RaftID == "" {
+		if len(c.RaftPeers) > 0 {
+			return errors.New("raft peers given without a raft node ID")
+		}
+		return nil
+	}
+	if c.RaftAddr == "" {
+		return errors.New("raft node ID given without a raft address")
+	}
+	if c.PrimaryAddr != "" {
+		return errors.New("a cluster node cannot follow a primary")
+	}
+	if c.RaftHeartbeat <= 0 {
+		return errors.New("raft heartbeat must be positive")
+	}
+	if c.RaftSnapshotAfter == 0 {
+		return errors.New("raft snapshot after must be positive")
+	}
+	if !c.UseMTLS && !c.RaftInsecure {
+		return errors.New("a cluster node without mTLS lets anyone write to the registry on its raft address, allow it with raft insecure")
+	}
+	if addr := c.RaftPeers[c.RaftID]; len(c.RaftPeers) > 0 && addr != c.RaftAddr {
+		return fmt.Errorf("raft peers must include this node as %s=%s", c.RaftID, c.RaftAddr)
+	}
+	return nil
+}
+
+// permissionOf falls back to the least privileged permission when the
+// configured one is invalid, which validate rejects up front.
+func (c *config) permissionOf(identity string) permission {
+	name, found := c.ClientPermissions[identity]
+	if !found {
+		name = c.DefaultPermission
+	}
+	granted, err := parsePermission(name)
+	if err != nil {
+		return permissionRead
+	}
+	return granted
+}
+
+// clientPermissions maps client cert common names to permission names. It
+// is given as name:permission,... in env vars and flags.
+type clientPermissions map[string]string
+
+func (p clientPermissions) String() string {
+	pairs := make([]string, 0, len(p))
+	for identity, name := range p {
+		pairs = append(pairs, identity+":"+name)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (p *clientPermissions) Set(value string) error {
+	parsed := make(clientPermissions)
+	for _, pair := range strings.Split(value, ",") {
+		identity, name, found := cut(pair, ":")
+		if !found {
+			return fmt.Errorf("invalid client permission %q, expecting name:permission", pair)
+		}
+		parsed[identity] = name
+	}
+	*p = parsed
+	return nil
+}
+
+// clientNamespaces confines clients to a namespace by their cert common
+// name. It is given as name:namespace,... in env vars and flags.
+type clientNamespaces map[string]string
+
+func (n clientNamespaces) String() string {
+	pairs := make([]string, 0, len(n))
+	for identity, ns := range n {
+		pairs = append(pairs, identity+":"+ns)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (n *clientNamespaces) Set(value string) error {
+	parsed := make(clientNamespaces)
+	for _, pair := range strings.Split(value, ",") {
+		identity, ns, found := cut(pair, ":")
+		if !found {
+			return fmt.Errorf("invalid client namespace %q, expecting name:namespace", pair)
+		}
+		parsed[identity] = ns
+	}
+	*n = parsed
+	return nil
+}
+
+// namespaceQuotas limits how many packages namespaces hold. It is given as
+// namespace:count,... in env vars and flags.
+type namespaceQuotas map[string]int
+
+func (q namespaceQuotas) String() string {
+	pairs := make([]string, 0, len(q))
+	for ns, quota := range q {
+		pairs = append(pairs, ns+":"+strconv.Itoa(quota))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (q *namespaceQuotas) Set(value string) error {
+	parsed := make(namespaceQuotas)
+	for _, pair := range strings.Split(value, ",") {
+		ns, count, found := cut(pair, ":")
+		quota, err := strconv.Atoi(count)
+		if !found || err != nil {
+			return fmt.Errorf("invalid namespace quota %q, expecting namespace:count", pair)
+		}
+		parsed[ns] = quota
+	}
+	*q = parsed
+	return nil
+}
+
+// raftPeers maps the node IDs of a new cluster to their Raft addresses. It is
+// given as id=address,... in env vars and flags.
+type raftPeers map[string]string
+
+func (p raftPeers) String() string {
+	pairs := make([]string, 0, len(p))
+	for id, addr := range p {
+		pairs = append(pairs, id+"="+addr)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (p *raftPeers) Set(value string) error {
+	parsed := make(raftPeers)
+	for _, pair := range strings.Split(value, ",") {
+		id, addr, found := cut(pair, "=")
+		if !found || id == "" || addr == "" {
+			return fmt.Errorf("invalid raft peer %q, expecting id=address", pair)
+		}
+		parsed[id] = addr
+	}
+	*p = parsed
+	return nil
+}
+
+func (c *config) flagSet(output io.Writer) *flag.FlagSet {
+	fs := flag.NewFlagSet("pacman", flag.ContinueOnError)
+	fs.SetOutput(output)
+	fs.StringVar(&c.File, "config", c.File, "path to YAML config file [PACMAN_CONFIG]")
+	fs.BoolVar(&c.PrintConfig, "print-config", c.PrintConfig, "print effective config with secrets redacted and exit")
+	fs.StringVar(&c.Listen, "listen", c.Listen, "TCP address to listen on [LISTEN]")
+	fs.StringVar(&c.AdminListen, "admin-listen", c.AdminListen, "admin HTTP address to listen on [ADMIN_LISTEN]")
+	fs.BoolVar(&c.UseMTLS, "use-mtls", c.UseMTLS, "require mutual TLS from clients [USE_MTLS]")
+	fs.StringVar(&c.RootCA, "tls-root-ca", c.RootCA, "PEM encoded root CA cert [TLS_ROOT_CA]")
+	fs.StringVar(&c.RootCAFile, "tls-root-ca-file", c.RootCAFile, "path to PEM encoded root CA cert [TLS_ROOT_CA_FILE]")
+	fs.StringVar(&c.ServerKey, "tls-server-key", c.ServerKey, "PEM encoded server key [TLS_SERVER_KEY]")
+	fs.StringVar(&c.ServerKeyFile, "tls-server-key-file", c.ServerKeyFile, "path to PEM encoded server key [TLS_SERVER_KEY_FILE]")
+	fs.StringVar(&c.ServerCert, "tls-server-cert", c.ServerCert, "PEM encoded server cert [TLS_SERVER_CERT]")
+	fs.StringVar(&c.ServerCertFile, "tls-server-cert-file", c.ServerCertFile, "path to PEM encoded server cert [TLS_SERVER_CERT_FILE]")
+	fs.DurationVar(&c.TLSExpiryThreshold, "tls-expiry-threshold", c.TLSExpiryThreshold, "report not ready when server cert expires within this duration [TLS_EXPIRY_THRESHOLD]")
+	fs.StringVar(&c.AuditFile, "audit-file", c.AuditFile, "path to rotating audit log file, stdout if empty [AUDIT_FILE]")
+	fs.IntVar(&c.AuditMaxSizeMB, "audit-max-size-mb", c.AuditMaxSizeMB, "max size of audit log file before rotation [AUDIT_MAX_SIZE_MB]")
+	fs.IntVar(&c.AuditMaxBackups, "audit-max-backups", c.AuditMaxBackups, "max number of rotated audit log files to keep [AUDIT_MAX_BACKUPS]")
+	fs.IntVar(&c.AuditMaxAgeDays, "audit-max-age-days", c.AuditMaxAgeDays, "max days to keep rotated audit log files [AUDIT_MAX_AGE_DAYS]")
+	fs.IntVar(&c.AuditRetain, "audit-retain", c.AuditRetain, "number of audit records kept in memory for AuditLog [AUDIT_RETAIN]")
+	fs.DurationVar(&c.IdleTimeout, "idle-timeout", c.IdleTimeout, "max wait for the next command on a connection, 0 to disable [IDLE_TIMEOUT]")
+	fs.DurationVar(&c.ReadTimeout, "read-timeout", c.ReadTimeout, "max time to receive a command once it started, 0 to disable [READ_TIMEOUT]")
+	fs.DurationVar(&c.WriteTimeout, "write-timeout", c.WriteTimeout, "max time for every response write, 0 to disable [WRITE_TIMEOUT]")
+	fs.IntVar(&c.MaxLineLength, "max-line-length", c.MaxLineLength, "max bytes in a single command line [MAX_LINE_LENGTH]")
+	fs.IntVar(&c.MaxDependencies, "max-dependencies", c.MaxDependencies, "max dependencies per AddPackage or members per CreateGroup, 0 for no limit [MAX_DEPENDENCIES]")
+	fs.IntVar(&c.MaxPipelined, "max-pipelined", c.MaxPipelined, "max read-only commands with request IDs running at once per connection [MAX_PIPELINED]")
+	fs.IntVar(&c.SnapshotRetain, "snapshot-retain", c.SnapshotRetain, "number of recent registry revisions kept whole in memory for fast reads with at= [SNAPSHOT_RETAIN]")
+	fs.IntVar(&c.HistoryRetain, "history-retain", c.HistoryRetain, "number of recent registry revisions readable with at= and listed by PackageHistory [HISTORY_RETAIN]")
+	fs.StringVar(&c.SQLiteFile, "sqlite-file", c.SQLiteFile, "keep the registry in this SQLite database instead of memory [SQLITE_FILE]")
+	fs.StringVar(&c.PrimaryAddr, "primary-addr", c.PrimaryAddr, "follow the primary at this address as a read-only replica [PRIMARY_ADDR]")
+	fs.DurationVar(&c.ReplicaHeartbeat, "replication-heartbeat", c.ReplicaHeartbeat, "interval of replication heartbeats sent to followers [REPLICATION_HEARTBEAT]")
+	fs.StringVar(&c.RaftID, "raft-id", c.RaftID, "join a Raft cluster as the node with this ID [RAFT_ID]")
+	fs.StringVar(&c.RaftAddr, "raft-addr", c.RaftAddr, "TCP address of this node for Raft and forwarded writes, as reached by the other nodes [RAFT_ADDR]")
+	fs.Var(&c.RaftPeers, "raft-peers", "bootstrap a new cluster with these nodes, as id=address,... [RAFT_PEERS]")
+	fs.DurationVar(&c.RaftHeartbeat, "raft-heartbeat", c.RaftHeartbeat, "time without contact with the leader before electing another one [RAFT_HEARTBEAT]")
+	fs.Uint64Var(&c.RaftSnapshotAfter, "raft-snapshot-after", c.RaftSnapshotAfter, "snapshot the registry after this many Raft log entries, and keep as many [RAFT_SNAPSHOT_AFTER]")
+	fs.BoolVar(&c.RaftInsecure, "raft-insecure", c.RaftInsecure, "let anyone reaching the raft address in without mTLS, on trusted networks only [RAFT_INSECURE]")
+	fs.StringVar(&c.DefaultPermission, "default-permission", c.DefaultPermission, "permission of clients not in client-permissions: read, write or admin [DEFAULT_PERMISSION]")
+	fs.Var(&c.ClientPermissions, "client-permissions", "permissions by client cert common name, as name:permission,... [CLIENT_PERMISSIONS]")
+	fs.Var(&c.ClientNamespaces, "client-namespaces", "namespaces clients are confined to by cert common name, as name:namespace,... [CLIENT_NAMESPACES]")
+	fs.Var(&c.NamespaceQuotas, "namespace-quotas", "max packages by namespace, as namespace:count,... [NAMESPACE_QUOTAS]")
+	return fs
+}
+
+func (c *config) load(file string) error {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("cannot read config file: %s", err)
+	}
+	if err := yaml.Unmarshal(content, c); err != nil {
+		return fmt.Errorf("cannot parse config file %s: %s", file, err)
+	}
+	return nil
+}
+
+// withTLSFiles loads a config source, then reads the TLS files it gives paths
+// of, so their PEM takes the precedence of that source over inline PEM from
+// the others, e.g. a server key flag beats a server key file env var.
+func (c *config) withTLSFiles(load func() error) error {
+	files := []struct {
+		path *string
+		pem  *string
+	}{
+		{&c.RootCAFile, &c.RootCA},
+		{&c.ServerKeyFile, &c.ServerKey},
+		{&c.ServerCertFile, &c.ServerCert},
+	}
+	before := make([]string, len(files))
+	for i, f := range files {
+		before[i] = *f.path
+	}
+	if err := load(); err != nil {
+		return err
+	}
+	for i, f := range files {
+		if *f.path == "" || *f.path == before[i] {
+			continue
+		}
+		content, err := ioutil.ReadFile(*f.path)
+		if err != nil {
+			return fmt.Errorf("cannot read TLS file: %s", err)
+		}
+		*f.pem = string(content)
+	}
+	return nil
+}
+
+func (c config) redacted() string {
+	if c.ServerKey != "" {
+		c.ServerKey = "<redacted>"
+	}
+	out, err := yaml.Marshal(c)
+	if err != nil {
+		return fmt.Sprintf("cannot print config: %s\n", err)
+	}
+	return string(out)
 }
 
 func (c *config) tls() (*tls.Config, error) {
@@ -38,3 +419,52 @@ func (c *config) tls() (*tls.Config, error) {
 		ClientCAs:    certPool,
 	}, nil
 }
+
+// peerTLS is used by followers and cluster nodes, which present the server
+// cert to their peer at addr as their client cert.
+func (c *config) peerTLS(addr string) (*tls.Config, error) {
+	certPool := x509.NewCertPool()
+	if !certPool.AppendCertsFromPEM([]byte(c.RootCA)) {
+		return nil, errors.New("cannot append root CA cert")
+	}
+	certificate, err := tls.X509KeyPair([]byte(c.ServerCert), []byte(c.ServerKey))
+	if err != nil {
+		return nil, fmt.Errorf("cannot load server TLS key and cert: %s", err)
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid peer address: %s", err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		RootCAs:      certPool,
+		ServerName:   host,
+	}, nil
+}
+
+func (c *config) checkTLS(now time.Time) error {
+	if !c.UseMTLS {
+		return nil
+	}
+	if _, err := c.tls(); err != nil {
+		return err
+	}
+	block, _ := pem.Decode([]byte(c.ServerCert))
+	if block == nil {
+		return errors.New("cannot decode server cert PEM")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("cannot parse server cert: %s", err)
+	}
+	if now.Before(cert.NotBefore) {
+		return fmt.Errorf("server cert is not valid before %s", cert.NotBefore.Format(time.RFC3339))
+	}
+	if now.After(cert.NotAfter) {
+		return fmt.Errorf("server cert expired at %s", cert.NotAfter.Format(time.RFC3339))
+	}
+	if now.Add(c.TLSExpiryThreshold).After(cert.NotAfter) {
+		return fmt.Errorf("server cert expires soon at %s", cert.NotAfter.Format(time.RFC3339))
+	}
+	return nil
+}
@@ -0,0 +1,1030 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"testing/quick"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newRegistryFunc builds a registry seeded with packages at revision 1 when
+// given, keeping retain revisions. Backends storing every dependency once need
+// the packages to be consistent.
+type newRegistryFunc func(t *testing.T, m *metrics, retain int, pkgs map[string]onePackage) registry
+
+var registryBackends = []struct {
+	name string
+	new  newRegistryFunc
+}{
+	{
+		name: "memory",
+		new: func(t *testing.T, m *metrics, retain int, pkgs map[string]onePackage) registry {
+			return newInMemoryStoreWith(m, retain, pkgs)
+		},
+	},
+	{
+		name: "sqlite",
+		new:  newSQLiteStoreWith,
+	},
+	{
+		name: "cluster",
+		new:  newClusterStoreWith,
+	},
+}
+
+// TestRegistryConformance runs every registry implementation through the same
+// tests, which a new backend only needs to be added to registryBackends for.
+func TestRegistryConformance(t *testing.T) {
+	t.Parallel()
+
+	for _, backend := range registryBackends {
+		backend := backend
+		t.Run(backend.name, func(t *testing.T) {
+			t.Parallel()
+			testRegistryConformance(t, backend.new)
+		})
+	}
+}
+
+func testRegistryConformance(t *testing.T, newRegistry newRegistryFunc) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, newRegistry newRegistryFunc)
+	}{
+		{name: "add", test: testRegistryAdd},
+		{name: "remove", test: testRegistryRemove},
+		{name: "list", test: testRegistryList},
+		{name: "get", test: testRegistryGet},
+		{name: "names", test: testRegistryNames},
+		{name: "revisions", test: testRegistryRevisions},
+		{name: "history", test: testRegistryHistory},
+		{name: "revert", test: testRegistryRevert},
+		{name: "quota", test: testRegistryQuota},
+		{name: "groups", test: testRegistryGroups},
+		{name: "canceled", test: testRegistryCanceled},
+		{name: "concurrent access", test: testRegistryConcurrentAccess},
+		{name: "random operations", test: testRegistryRandomOperations},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			tc.test(t, newRegistry)
+		})
+	}
+}
+
+// packagesOf reads every package back the way they are seeded.
+func packagesOf(t *testing.T, store registry) map[string]onePackage {
+	t.Helper()
+	infos, err := store.list(context.Background(), latestRevision)
+	require.NoError(t, err)
+	pkgs := make(map[string]onePackage, len(infos))
+	for _, info := range infos {
+		pkgs[info.Name] = onePackage{name: info.Name, dependsOn: sortedNames(info.DependsOn), requiredBy: sortedNames(info.RequiredBy)}
+	}
+	return pkgs
+}
+
+// registryOp is a random AddPackage or RemovePackage. Names are picked from a
+// few, some invalid, so that operations often collide.
+type registryOp struct {
+	remove bool
+	name   string
+	deps   []string
+	upsert bool
+}
+
+func (registryOp) Generate(rnd *rand.Rand, size int) reflect.Value {
+	name := func() string {
+		switch rnd.Intn(30) {
+		case 0:
+			return ""
+		case 1:
+			return "-P-"
+		}
+		return fmt.Sprintf("P%d", rnd.Intn(6))
+	}
+	op := registryOp{remove: rnd.Intn(3) == 0, name: name(), upsert: rnd.Intn(2) == 0}
+	for d := rnd.Intn(4); d > 0; d-- {
+		op.deps = append(op.deps, name())
+	}
+	return reflect.ValueOf(op)
+}
+
+// registryModel is the simplest registry, every package with its sorted
+// dependencies, which every backend must agree with.
+type registryModel map[string][]string
+
+func modelOf(infos []packageInfo) registryModel {
+	model := make(registryModel, len(infos))
+	for _, info := range infos {
+		model[info.Name] = nil
+		if len(info.DependsOn) > 0 {
+			model[info.Name] = info.DependsOn
+		}
+	}
+	return model
+}
+
+func (model registryModel) clone() registryModel {
+	next := make(registryModel, len(model))
+	for name, deps := range model {
+		next[name] = deps
+	}
+	return next
+}
+
+func (model registryModel) reaches(from, to string) bool {
+	for _, dep := range model[from] {
+		if dep == to || model.reaches(dep, to) {
+			return true
+		}
+	}
+	return false
+}
+
+// apply returns what the operation must result in, with the code of the
+// error when it must fail.
+func (model registryModel) apply(op registryOp) (addResult, string) {
+	if op.remove {
+		if _, exists := model[op.name]; !exists {
+			return packageUnchanged, "not_found"
+		}
+		for _, deps := range model {
+			for _, dep := range deps {
+				if dep == op.name {
+					return packageUnchanged, "still_required"
+				}
+			}
+		}
+		delete(model, op.name)
+		return packageUnchanged, ""
+	}
+	if validatePackageName(op.name) != nil {
+		return packageUnchanged, "invalid_name"
+	}
+	for _, dep := range op.deps {
+		if validatePackageName(dep) != nil {
+			return packageUnchanged, "invalid_name"
+		}
+		if dep == op.name {
+			return packageUnchanged, "dependency_cycle"
+		}
+	}
+	var deps []string
+	for _, dep := range op.deps {
+		if _, exists := model[dep]; exists {
+			deps = insertName(deps, dep)
+		}
+	}
+	current, exists := model[op.name]
+	switch {
+	case !exists:
+		model[op.name] = deps
+		return packageAdded, ""
+	case equalNames(current, deps):
+		return packageUnchanged, ""
+	case !op.upsert:
+		return packageUnchanged, "already_exists"
+	}
+	for _, dep := range deps {
+		if model.reaches(dep, op.name) {
+			return packageUnchanged, "dependency_cycle"
+		}
+	}
+	model[op.name] = deps
+	return packageUpdated, ""
+}
+
+// testRegistryRandomOperations runs random sequences of operations, checking
+// every outcome against the model and the graph invariants after each one.
+func testRegistryRandomOperations(t *testing.T, newRegistry newRegistryFunc) {
+	const retain = 4
+	ctx := context.Background()
+	property := func(ops []registryOp) bool {
+		store := newRegistry(t, nil, retain, nil)
+		model := registryModel{}
+		revisions := []registryModel{model.clone()}
+		for _, op := range ops {
+			result, err := packageUnchanged, error(nil)
+			if op.remove {
+				err = store.remove(ctx, op.name)
+			} else {
+				result, err = store.add(ctx, op.name, op.deps, op.upsert)
+			}
+			wantResult, wantCode := model.apply(op)
+			code := ""
+			if err != nil {
+				code = errorCode(err)
+			}
+			if !assert.Equal(t, wantCode, code, "%+v: %v", op, err) || !assert.Equal(t, wantResult, result, "%+v", op) {
+				return false
+			}
+			if !reflect.DeepEqual(model, revisions[len(revisions)-1]) {
+				revisions = append(revisions, model.clone())
+			}
+			if !assert.Equal(t, uint64(len(revisions)), store.revision(ctx), "%+v", op) || !registryInvariantsHold(t, store, model) {
+				return false
+			}
+		}
+		// retained revisions read back the way they were
+		oldest := len(revisions)
+		for ; oldest > 0 && oldest > len(revisions)-retain; oldest-- {
+			pkgs, err := store.list(ctx, uint64(oldest))
+			if !assert.NoError(t, err) || !assert.Equal(t, revisions[oldest-1], modelOf(pkgs), "revision %d", oldest) {
+				return false
+			}
+		}
+		// and the oldest one is reverted to
+		reverted, err := store.revert(ctx, revertTarget{Revision: uint64(oldest + 1)})
+		return assert.NoError(t, err) &&
+			assert.Equal(t, reverted.Revision, store.revision(ctx)) &&
+			registryInvariantsHold(t, store, revisions[oldest])
+	}
+	err := quick.Check(property, &quick.Config{MaxCount: 20, Rand: rand.New(rand.NewSource(1))})
+	assert.NoError(t, err)
+}
+
+// registryInvariantsHold checks the registry holds the packages of the model,
+// sorted, with every dependency existing and requiring back its dependents,
+// and without cycles.
+func registryInvariantsHold(t *testing.T, store registry, model registryModel) bool {
+	t.Helper()
+	ctx := context.Background()
+	pkgs, err := store.list(ctx, latestRevision)
+	if !assert.NoError(t, err) || !assert.Equal(t, model, modelOf(pkgs)) {
+		return false
+	}
+	problems, err := store.check(ctx)
+	if !assert.NoError(t, err) || !assert.Empty(t, problems) {
+		return false
+	}
+	requiredBy := make(map[string][]string, len(pkgs))
+	for _, pkg := range pkgs {
+		for _, dep := range pkg.DependsOn {
+			requiredBy[dep] = append(requiredBy[dep], pkg.Name)
+		}
+	}
+	names := []string{}
+	for _, pkg := range pkgs {
+		names = append(names, pkg.Name)
+		if !assert.Equal(t, append([]string{}, requiredBy[pkg.Name]...), append([]string{}, pkg.RequiredBy...), pkg.Name) ||
+			!assert.True(t, sort.StringsAreSorted(pkg.DependsOn), pkg.Name) ||
+			!assert.False(t, model.reaches(pkg.Name, pkg.Name), "%s depends on itself", pkg.Name) {
+			return false
+		}
+	}
+	return assert.True(t, sort.StringsAreSorted(names)) && assert.Equal(t, names, append([]string{}, store.names(ctx)...))
+}
+
+func testRegistryAdd(t *testing.T, newRegistry newRegistryFunc) {
+	tests := []struct {
+		name        string
+		givenPkgs   map[string]onePackage
+		givenName   string
+		givenDeps   []string
+		givenUpsert bool
+		want        addResult
+		wantError   error
+		wantPkgs    map[string]onePackage
+	}{
+		{
+			name: "package already exists with other deps",
+			givenPkgs: map[string]onePackage{
+				"AAA": {name: "AAA"},
+				"BBB": {name: "BBB"},
+			},
+			givenName: "BBB",
+			givenDeps: []string{"AAA"},
+			wantError: fmt.Errorf("%w: package BBB with deps [] and required by []", ErrAlreadyExists),
+		},
+		{
+			name: "package already exists with the same deps",
+			givenPkgs: map[string]onePackage{
+				"AAA": {name: "AAA", requiredBy: []string{"CCC"}},
+				"BBB": {name: "BBB", requiredBy: []string{"CCC"}},
+				"CCC": {name: "CCC", dependsOn: []string{"AAA", "BBB"}},
+			},
+			givenName: "CCC",
+			givenDeps: []string{"BBB", "AAA", "DDD"},
+			want:      packageUnchanged,
+			wantPkgs: map[string]onePackage{
+				"AAA": {name: "AAA", requiredBy: []string{"CCC"}},
+				"BBB": {name: "BBB", requiredBy: []string{"CCC"}},
+				"CCC": {name: "CCC", dependsOn: []string{"AAA", "BBB"}},
+			},
+		},
+		{
+			name: "upsert replaces deps",
+			givenPkgs: map[string]onePackage{
+				"AAA": {name: "AAA", requiredBy: []string{"CCC"}},
+				"BBB": {name: "BBB"},
+				"CCC": {name: "CCC", dependsOn: []string{"AAA"}, requiredBy: []string{"DDD"}},
+				"DDD": {name: "DDD", dependsOn: []string{"CCC"}},
+			},
+			givenName:   "CCC",
+			givenDeps:   []string{"BBB"},
+			givenUpsert: true,
+			want:        packageUpdated,
+			wantPkgs: map[string]onePackage{
+				"AAA": {name: "AAA"},
+				"BBB": {name: "BBB", requiredBy: []string{"CCC"}},
+				"CCC": {name: "CCC", dependsOn: []string{"BBB"}, requiredBy: []string{"DDD"}},
+				"DDD": {name: "DDD", dependsOn: []string{"CCC"}},
+			},
+		},
+		{
+			name: "upsert rejects dependency cycles",
+			givenPkgs: map[string]onePackage{
+				"AAA": {name: "AAA", requiredBy: []string{"BBB"}},
+				"BBB": {name: "BBB", dependsOn: []string{"AAA"}, requiredBy: []string{"CCC"}},
+				"CCC": {name: "CCC", dependsOn: []string{"BBB"}},
+			},
+			givenName:   "AAA",
+			givenDeps:   []string{"CCC"},
+			givenUpsert: true,
+			want:        packageUpdated,
+			wantError:   fmt.Errorf("%w: AAA cannot depend on CCC, which depends on AAA", ErrDependencyCycle),
+		},
+		{
+			name: "invalid package name",
+			givenPkgs: map[string]onePackage{
+				"AAA": {name: "AAA"},
+			},
+			givenName: "BB/B/B",
+			givenDeps: []string{},
+			wantError: fmt.Errorf("%w %q: it contains invalid character %q", ErrInvalidName, "BB/B/B", '/'),
+		},
+		{
+			name: "invalid dependency name",
+			givenPkgs: map[string]onePackage{
+				"AAA": {name: "AAA"},
+			},
+			givenName: "BBB",
+			givenDeps: []string{"AAA", ""},
+			wantError: fmt.Errorf("invalid dependency: %w", fmt.Errorf("%w %q: it is empty", ErrInvalidName, "")),
+		},
+		{
+			name: "self dependency",
+			givenPkgs: map[string]onePackage{
+				"AAA": {name: "AAA"},
+			},
+			givenName: "BBB",
+			givenDeps: []string{"AAA", "BBB"},
+			wantError: fmt.Errorf("%w: BBB cannot depend on itself", ErrDependencyCycle),
+		},
+		{
+			name: "self dependency on upsert",
+			givenPkgs: map[string]onePackage{
+				"AAA": {name: "AAA"},
+			},
+			givenName:   "AAA",
+			givenDeps:   []string{"AAA"},
+			givenUpsert: true,
+			wantError:   fmt.Errorf("%w: AAA cannot depend on itself", ErrDependencyCycle),
+		},
+		{
+			name: "duplicated deps",
+			givenPkgs: map[string]onePackage{
+				"AAA": {name: "AAA"},
+				"BBB": {name: "BBB"},
+			},
+			givenName: "CCC",
+			givenDeps: []string{"AAA", "BBB", "AAA"},
+			wantPkgs: map[string]onePackage{
+				"AAA": {name: "AAA", requiredBy: []string{"CCC"}},
+				"BBB": {name: "BBB", requiredBy: []string{"CCC"}},
+				"CCC": {name: "CCC", dependsOn: []string{"AAA", "BBB"}},
+			},
+		},
+		{
+			name: "add a package without deps",
+			givenPkgs: map[string]onePackage{
+				"AAA": {name: "AAA"},
+			},
+			givenName: "BBB",
+			givenDeps: []string{},
+			wantError: nil,
+			wantPkgs: map[string]onePackage{
+				"AAA": {name: "AAA"},
+				"BBB": {name: "BBB"},
+			},
+		},
+		{
+			name: "add a package with nonexistent deps",
+			givenPkgs: map[string]onePackage{
+				"AAA": {name: "AAA"},
+			},
+			givenName: "BBB",
+			givenDeps: []string{"CCC"},
+			wantError: nil,
+			wantPkgs: map[string]onePackage{
+				"AAA": {name: "AAA"},
+				"BBB": {name: "BBB"},
+			},
+		},
+		{
+			name: "happy path",
+			givenPkgs: map[string]onePackage{
+				"AAA": {name: "AAA"},
+			},
+			givenName: "BBB",
+			givenDeps: []string{"AAA"},
+			wantError: nil,
+			wantPkgs: map[string]onePackage{
+				"AAA": {name: "AAA", requiredBy: []string{"BBB"}},
+				"BBB": {name: "BBB", dependsOn: []string{"AAA"}},
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			store := newRegistry(t, nil, 1, tc.givenPkgs)
+
+			result, err := store.add(context.Background(), tc.givenName, tc.givenDeps, tc.givenUpsert)
+			if tc.wantError != nil {
+				assert.Equal(t, tc.wantError, err)
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, tc.want, result)
+				assert.Equal(t, tc.wantPkgs, packagesOf(t, store))
+			}
+		})
+	}
+}
+
+func testRegistryRemove(t *testing.T, newRegistry newRegistryFunc) {
+	tests := []struct {
+		name      string
+		givenPkgs map[string]onePackage
+		givenName string
+		wantError error
+		wantPkgs  map[string]onePackage
+	}{
+		{
+			name: "package not exists",
+			givenPkgs: map[string]onePackage{
+				"AAA": {name: "AAA"},
+			},
+			givenName: "BBB",
+			wantError: fmt.Errorf("%w: BBB", ErrNotFound),
+		},
+		{
+			name: "package cannot be removed when required by others",
+			givenPkgs: map[string]onePackage{
+				"AAA": {name: "AAA", requiredBy: []string{"BBB"}},
+				"BBB": {name: "BBB", dependsOn: []string{"AAA"}},
+			},
+			givenName: "AAA",
+			wantError: &StillRequiredError{Name: "AAA", RequiredBy: []string{"BBB"}},
+		},
+		{
+			name: "happy path",
+			givenPkgs: map[string]onePackage{
+				"AAA": {name: "AAA", requiredBy: []string{"BBB", "CCC"}},
+				"BBB": {name: "BBB", dependsOn: []string{"AAA"}},
+				"CCC": {name: "CCC", dependsOn: []string{"AAA"}},
+			},
+			givenName: "CCC",
+			wantError: nil,
+			wantPkgs: map[string]onePackage{
+				"AAA": {name: "AAA", requiredBy: []string{"BBB"}},
+				"BBB": {name: "BBB", dependsOn: []string{"AAA"}},
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			store := newRegistry(t, nil, 1, tc.givenPkgs)
+
+			err := store.remove(context.Background(), tc.givenName)
+			if tc.wantError != nil {
+				assert.Equal(t, tc.wantError, err)
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, tc.wantPkgs, packagesOf(t, store))
+			}
+		})
+	}
+}
+
+func testRegistryList(t *testing.T, newRegistry newRegistryFunc) {
+	tests := []struct {
+		name  string
+		given map[string]onePackage
+		want  string
+	}{
+		{
+			name:  "no packages",
+			given: map[string]onePackage{},
+			want: "Packages and Dependencies\n" +
+				"- No packages found",
+		},
+		{
+			name: "one package no deps",
+			given: map[string]onePackage{
+				"AAA": {name: "AAA"},
+			},
+			want: "Packages and Dependencies\n" +
+				"- AAA",
+		},
+		{
+			name: "two packages and one depends another",
+			given: map[string]onePackage{
+				"AAA": {name: "AAA", requiredBy: []string{"BBB"}},
+				"BBB": {name: "BBB", dependsOn: []string{"AAA"}},
+			},
+			want: "Packages and Dependencies\n" +
+				"- AAA\n" +
+				"- BBB\n" +
+				"    - AAA",
+		},
+		{
+			name: "more packages and dependencies",
+			given: map[string]onePackage{
+				"AAA": {name: "AAA", requiredBy: []string{"BBB", "DDD"}},
+				"BBB": {name: "BBB", dependsOn: []string{"AAA"}, requiredBy: []string{"CCC", "DDD"}},
+				"CCC": {name: "CCC", dependsOn: []string{"BBB"}},
+				"DDD": {name: "DDD", dependsOn: []string{"AAA", "BBB"}},
+				"EEE": {name: "EEE", dependsOn: []string{"DDD"}},
+			},
+			want: "Packages and Dependencies\n" +
+				"- AAA\n" +
+				"- BBB\n" +
+				"    - AAA\n" +
+				"- CCC\n" +
+				"    - BBB\n" +
+				"        - AAA\n" +
+				"- DDD\n" +
+				"    - AAA\n" +
+				"    - BBB\n" +
+				"        - AAA\n" +
+				"- EEE\n" +
+				"    - DDD\n" +
+				"        - AAA\n" +
+				"        - BBB\n" +
+				"            - AAA",
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			store := newRegistry(t, nil, 1, tc.given)
+
+			pkgs, err := store.list(context.Background(), latestRevision)
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, packageList(pkgs).text())
+		})
+	}
+}
+
+func testRegistryGet(t *testing.T, newRegistry newRegistryFunc) {
+	tests := []struct {
+		name      string
+		givenPkgs map[string]onePackage
+		givenName string
+		want      string
+		wantError error
+	}{
+		{
+			name:      "package not exists",
+			givenPkgs: map[string]onePackage{},
+			givenName: "AAA",
+			wantError: fmt.Errorf("%w: AAA", ErrNotFound),
+		},
+		{
+			name: "package without deps",
+			givenPkgs: map[string]onePackage{
+				"AAA": {name: "AAA"},
+			},
+			givenName: "AAA",
+			want: "Package AAA\n" +
+				"- Depends on: none\n" +
+				"- Required by: none",
+		},
+		{
+			name: "package with deps and required by others",
+			givenPkgs: map[string]onePackage{
+				"AAA": {name: "AAA", requiredBy: []string{"CCC"}},
+				"BBB": {name: "BBB", requiredBy: []string{"CCC"}},
+				"CCC": {name: "CCC", dependsOn: []string{"AAA", "BBB"}, requiredBy: []string{"DDD", "EEE"}},
+				"DDD": {name: "DDD", dependsOn: []string{"CCC"}},
+				"EEE": {name: "EEE", dependsOn: []string{"CCC"}},
+			},
+			givenName: "CCC",
+			want: "Package CCC\n" +
+				"- Depends on: AAA, BBB\n" +
+				"- Required by: DDD, EEE",
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			store := newRegistry(t, nil, 1, tc.givenPkgs)
+
+			pkg, err := store.get(context.Background(), tc.givenName, latestRevision)
+			if tc.wantError != nil {
+				assert.Equal(t, tc.wantError, err)
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, tc.want, pkg.text())
+			}
+		})
+	}
+}
+
+func testRegistryConcurrentAccess(t *testing.T, newRegistry newRegistryFunc) {
+	const (
+		workers    = 16
+		iterations = 300
+		packages   = 8
+	)
+	m := newMetrics()
+	store := newRegistry(t, m, 4, nil)
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(seed))
+			name := func() string {
+				return fmt.Sprintf("P%d", rnd.Intn(packages))
+			}
+			for i := 0; i < iterations; i++ {
+				switch rnd.Intn(5) {
+				case 0:
+					pkgName := name()
+					var deps []string
+					for d := rnd.Intn(4); d > 0; d-- {
+						if dep := name(); dep != pkgName {
+							deps = append(deps, dep)
+						}
+					}
+					_, _ = store.add(ctx, pkgName, deps, rnd.Intn(2) == 0)
+				case 1:
+					_ = store.remove(ctx, name())
+				case 2:
+					pkgs, err := store.list(ctx, latestRevision)
+					assert.NoError(t, err)
+					for _, pkg := range pkgs {
+						assert.True(t, sort.StringsAreSorted(pkg.DependsOn), pkg.Name)
+						assert.True(t, sort.StringsAreSorted(pkg.RequiredBy), pkg.Name)
+						// copies handed out must not be shared with the registry
+						sort.Sort(sort.Reverse(sort.StringSlice(pkg.DependsOn)))
+						sort.Sort(sort.Reverse(sort.StringSlice(pkg.RequiredBy)))
+					}
+				case 3:
+					if pkg, err := store.get(ctx, name(), latestRevision); err == nil {
+						assert.True(t, sort.StringsAreSorted(pkg.RequiredBy), pkg.Name)
+					}
+				case 4:
+					_, err := store.check(ctx)
+					assert.NoError(t, err)
+				}
+			}
+		}(int64(w))
+	}
+	wg.Wait()
+
+	problems, err := store.check(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, problems)
+
+	pkgs, err := store.list(ctx, latestRevision)
+	require.NoError(t, err)
+	edges := 0
+	for _, pkg := range pkgs {
+		edges += len(pkg.DependsOn)
+	}
+	assert.Equal(t, float64(len(pkgs)), testutil.ToFloat64(m.registryPackages))
+	assert.Equal(t, float64(edges), testutil.ToFloat64(m.registryEdges))
+}
+
+func testRegistryRevisions(t *testing.T, newRegistry newRegistryFunc) {
+	ctx := context.Background()
+	store := newRegistry(t, nil, 3, nil)
+	assert.Equal(t, uint64(1), store.revision(ctx))
+
+	_, err := store.add(ctx, "AAA", nil, false)
+	require.NoError(t, err)
+	_, err = store.add(ctx, "BBB", []string{"AAA"}, false)
+	require.NoError(t, err)
+	// neither a no-op nor a failure publishes a revision
+	_, err = store.add(ctx, "BBB", []string{"AAA"}, false)
+	require.NoError(t, err)
+	require.Error(t, store.remove(ctx, "AAA"))
+	assert.Equal(t, uint64(3), store.revision(ctx))
+
+	require.NoError(t, store.remove(ctx, "BBB"))
+	assert.Equal(t, uint64(4), store.revision(ctx))
+
+	pkgs, err := store.list(ctx, 3)
+	require.NoError(t, err)
+	assert.Equal(t, "Packages and Dependencies\n- AAA\n- BBB\n    - AAA", packageList(pkgs).text())
+	pkg, err := store.get(ctx, "AAA", 3)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"BBB"}, pkg.RequiredBy)
+
+	pkg, err = store.get(ctx, "AAA", latestRevision)
+	require.NoError(t, err)
+	assert.Empty(t, pkg.RequiredBy)
+	_, err = store.get(ctx, "BBB", 4)
+	assert.Equal(t, fmt.Errorf("%w: BBB", ErrNotFound), err)
+
+	_, err = store.list(ctx, 1)
+	assert.Equal(t, fmt.Errorf("%w 1: the oldest retained revision is 2", ErrUnknownRevision), err)
+	_, err = store.get(ctx, "AAA", 5)
+	assert.Equal(t, fmt.Errorf("%w 5: the latest revision is 4", ErrUnknownRevision), err)
+}
+
+func testRegistryCanceled(t *testing.T, newRegistry newRegistryFunc) {
+	store := newRegistry(t, nil, 1, nil)
+	_, err := store.add(context.Background(), "AAA", nil, false)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = store.add(ctx, "BBB", []string{"AAA"}, false)
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, context.Canceled, store.remove(ctx, "AAA"))
+	_, err = store.revert(ctx, revertTarget{Last: 1})
+	assert.Equal(t, context.Canceled, err)
+	_, err = store.list(ctx, latestRevision)
+	assert.Equal(t, context.Canceled, err)
+	_, err = store.get(ctx, "AAA", latestRevision)
+	assert.Equal(t, context.Canceled, err)
+	_, err = store.check(ctx)
+	assert.Equal(t, context.Canceled, err)
+	assert.Empty(t, store.names(ctx))
+
+	assert.Equal(t, []string{"AAA"}, store.names(context.Background()))
+}
+
+func testRegistryNames(t *testing.T, newRegistry newRegistryFunc) {
+	assert.Empty(t, newRegistry(t, nil, 1, nil).names(context.Background()))
+
+	store := newRegistry(t, nil, 1, map[string]onePackage{
+		"CCC": {name: "CCC"},
+		"AAA": {name: "AAA"},
+		"BBB": {name: "BBB"},
+	})
+	assert.Equal(t, []string{"AAA", "BBB", "CCC"}, store.names(context.Background()))
+}
+
+func testRegistryHistory(t *testing.T, newRegistry newRegistryFunc) {
+	ctx := context.Background()
+	store := newRegistry(t, nil, 8, nil)
+	created := time.Now()
+	_, err := store.add(ctx, "AAA", nil, false)
+	require.NoError(t, err)
+	added := time.Now()
+	_, err = store.add(ctx, "BBB", []string{"AAA"}, false)
+	require.NoError(t, err)
+	_, err = store.add(ctx, "BBB", nil, true)
+	require.NoError(t, err)
+	require.NoError(t, store.remove(ctx, "BBB"))
+	removed := time.Now()
+
+	// removed packages keep their history
+	history, err := store.packageHistory(ctx, "BBB")
+	require.NoError(t, err)
+	for i, c := range history.Changes {
+		assert.False(t, c.Time.Before(added) || c.Time.After(removed), c.Time)
+		history.Changes[i].Time = time.Time{}
+	}
+	assert.Equal(t, packageHistory{Name: "BBB", Changes: []packageChange{
+		{Revision: 3, Op: packageWasAdded, DependsOn: []string{"AAA"}},
+		{Revision: 4, Op: packageWasUpdated, DependsOn: []string{}},
+		{Revision: 5, Op: packageWasRemoved, DependsOn: []string{}},
+	}}, history)
+	history, err = store.packageHistory(ctx, "AAA")
+	require.NoError(t, err)
+	require.Len(t, history.Changes, 1)
+	assert.Equal(t, uint64(2), history.Changes[0].Revision)
+	_, err = store.packageHistory(ctx, "CCC")
+	assert.Equal(t, fmt.Errorf("%w: CCC", ErrNotFound), err)
+
+	seeded, err := newRegistry(t, nil, 1, map[string]onePackage{"AAA": {name: "AAA"}}).packageHistory(ctx, "AAA")
+	require.NoError(t, err)
+	assert.Equal(t, packageHistory{Name: "AAA", Changes: []packageChange{}}, seeded)
+
+	// times resolve to the revision made last by then
+	for _, given := range []struct {
+		at   time.Time
+		want uint64
+	}{
+		{at: created, want: 1},
+		{at: added, want: 2},
+		{at: removed, want: 5},
+		{at: removed.Add(time.Hour), want: 5},
+	} {
+		rev, err := store.revisionAt(ctx, given.at)
+		require.NoError(t, err)
+		assert.Equal(t, given.want, rev, given.at)
+	}
+	_, err = store.revisionAt(ctx, created.Add(-time.Hour))
+	assert.Equal(t, "unknown_revision", errorCode(err))
+}
+
+func testRegistryRevert(t *testing.T, newRegistry newRegistryFunc) {
+	ctx := context.Background()
+	store := newRegistry(t, nil, 8, nil)
+	_, err := store.add(ctx, "AAA", nil, false)
+	require.NoError(t, err)
+	_, err = store.add(ctx, "BBB", []string{"AAA"}, false)
+	require.NoError(t, err)
+	_, err = store.add(ctx, "CCC", []string{"BBB"}, false)
+	require.NoError(t, err)
+	_, err = store.add(ctx, "BBB", nil, true)
+	require.NoError(t, err)
+	require.NoError(t, store.remove(ctx, "CCC"))
+	before, err := store.list(ctx, latestRevision)
+	require.NoError(t, err)
+
+	// the changes are undone latest first, each with a new revision
+	reverted, err := store.revert(ctx, revertTarget{Revision: 3})
+	require.NoError(t, err)
+	assert.Equal(t, revertResult{To: 3, Changes: 3, Revision: 9}, reverted)
+	want, err := store.list(ctx, 3)
+	require.NoError(t, err)
+	for rev := uint64(7); rev <= 9; rev++ {
+		pkgs, err := store.list(ctx, rev)
+		require.NoError(t, err)
+		assert.NotEqual(t, before, pkgs, "revision %d", rev)
+	}
+	pkgs, err := store.list(ctx, latestRevision)
+	require.NoError(t, err)
+	assert.Equal(t, want, pkgs)
+	history, err := store.packageHistory(ctx, "CCC")
+	require.NoError(t, err)
+	var ops []string
+	for _, c := range history.Changes {
+		ops = append(ops, c.Op)
+	}
+	assert.Equal(t, []string{packageWasAdded, packageWasRemoved, packageWasAdded, packageWasRemoved}, ops)
+
+	// a revert is reverted like any other change
+	reverted, err = store.revert(ctx, revertTarget{Last: 3})
+	require.NoError(t, err)
+	assert.Equal(t, revertResult{To: 6, Changes: 3, Revision: 12}, reverted)
+	pkgs, err = store.list(ctx, latestRevision)
+	require.NoError(t, err)
+	assert.Equal(t, before, pkgs)
+	problems, err := store.check(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, problems)
+
+	reverted, err = store.revert(ctx, revertTarget{Revision: 12})
+	require.NoError(t, err)
+	assert.Equal(t, revertResult{To: 12, Changes: 0, Revision: 12}, reverted)
+	_, err = store.revert(ctx, revertTarget{Revision: 13})
+	assert.Equal(t, fmt.Errorf("%w 13: the latest revision is 12", ErrUnknownRevision), err)
+	_, err = store.revert(ctx, revertTarget{Revision: 4})
+	assert.Equal(t, fmt.Errorf("%w 4: the oldest retained revision is 5", ErrUnknownRevision), err)
+	_, err = store.revert(ctx, revertTarget{Last: 8})
+	assert.Equal(t, fmt.Errorf("%w: cannot revert the last 8 revisions, 7 are retained", ErrUnknownRevision), err)
+	assert.Equal(t, uint64(12), store.revision(ctx))
+}
+
+func testRegistryGroups(t *testing.T, newRegistry newRegistryFunc) {
+	ctx := context.Background()
+	store := newRegistry(t, nil, 8, map[string]onePackage{
+		"AAA": {name: "AAA"},
+		"BBB": {name: "BBB"},
+		"CCC": {name: "CCC"},
+	})
+	result, err := store.createGroup(ctx, "base", []string{"BBB", "AAA"}, false)
+	require.NoError(t, err)
+	assert.Equal(t, packageAdded, result)
+	result, err = store.createGroup(ctx, "base", []string{"AAA", "BBB"}, false)
+	require.NoError(t, err)
+	assert.Equal(t, packageUnchanged, result)
+
+	// members must exist, unlike dependencies
+	_, err = store.createGroup(ctx, "none", []string{"AAA", "ZZZ"}, false)
+	assert.Equal(t, fmt.Errorf("%w: ZZZ, a member of group none", ErrNotFound), err)
+	_, err = store.get(ctx, "none", latestRevision)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	// depending on a group depends on its members, nested groups included
+	_, err = store.add(ctx, "DDD", []string{"base", "CCC"}, false)
+	require.NoError(t, err)
+	_, err = store.createGroup(ctx, "all", []string{"base", "CCC"}, false)
+	require.NoError(t, err)
+	pkgs, err := store.list(ctx, latestRevision)
+	require.NoError(t, err)
+	assert.Equal(t, []packageInfo{
+		{Name: "AAA", DependsOn: []string{}, RequiredBy: []string{"DDD", "all", "base"}},
+		{Name: "BBB", DependsOn: []string{}, RequiredBy: []string{"DDD", "all", "base"}},
+		{Name: "CCC", DependsOn: []string{}, RequiredBy: []string{"DDD", "all"}},
+		{Name: "DDD", DependsOn: []string{"AAA", "BBB", "CCC"}, RequiredBy: []string{}},
+		{Name: "all", Group: true, DependsOn: []string{"AAA", "BBB", "CCC"}, RequiredBy: []string{}},
+		{Name: "base", Group: true, DependsOn: []string{"AAA", "BBB"}, RequiredBy: []string{}},
+	}, pkgs)
+
+	// packages and groups are not replaced by one another
+	_, err = store.add(ctx, "base", nil, true)
+	assert.Equal(t, fmt.Errorf("%w: %s", ErrAlreadyExists, `group base with members ["AAA" "BBB"]`), err)
+	_, err = store.createGroup(ctx, "DDD", []string{"AAA", "BBB", "CCC"}, true)
+	assert.Equal(t, fmt.Errorf("%w: %s", ErrAlreadyExists, `package DDD with deps ["AAA" "BBB" "CCC"] and required by []`), err)
+	_, err = store.add(ctx, "AAA", []string{"base"}, true)
+	assert.Equal(t, fmt.Errorf("%w: AAA cannot depend on itself, a member of group base", ErrDependencyCycle), err)
+
+	// members cannot be removed, groups can
+	err = store.remove(ctx, "CCC")
+	assert.Equal(t, &StillRequiredError{Name: "CCC", RequiredBy: []string{"DDD", "all"}}, err)
+	_, err = store.createGroup(ctx, "all", []string{"CCC"}, false)
+	assert.ErrorIs(t, err, ErrAlreadyExists)
+	result, err = store.createGroup(ctx, "all", []string{"CCC"}, true)
+	require.NoError(t, err)
+	assert.Equal(t, packageUpdated, result)
+	require.NoError(t, store.remove(ctx, "base"))
+
+	// groups come back as groups when reading at a revision or reverting
+	before, err := store.list(ctx, 4)
+	require.NoError(t, err)
+	reverted, err := store.revert(ctx, revertTarget{Revision: 4})
+	require.NoError(t, err)
+	assert.Equal(t, revertResult{To: 4, Changes: 2, Revision: 8}, reverted)
+	pkgs, err = store.list(ctx, latestRevision)
+	require.NoError(t, err)
+	assert.Equal(t, before, pkgs)
+	base, err := store.get(ctx, "base", latestRevision)
+	require.NoError(t, err)
+	assert.True(t, base.Group)
+	problems, err := store.check(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, problems)
+}
+
+// setQuotas sets the namespace quotas of a backend built without any.
+func setQuotas(t *testing.T, store registry, quotas namespaceQuotas) {
+	t.Helper()
+	switch store := store.(type) {
+	case *inMemoryStore:
+		store.quotas = quotas
+	case *sqliteStore:
+		store.quotas = quotas
+	case *clusterStore:
+		store.config.NamespaceQuotas = quotas
+	default:
+		t.Fatalf("cannot set quotas of %T", store)
+	}
+}
+
+func testRegistryQuota(t *testing.T, newRegistry newRegistryFunc) {
+	ctx := context.Background()
+	store := newRegistry(t, nil, 8, map[string]onePackage{
+		"AAA":      {name: "AAA"},
+		"team/AAA": {name: "team/AAA"},
+	})
+	setQuotas(t, store, namespaceQuotas{defaultNamespace: 1, "team": 2})
+
+	_, err := store.add(ctx, "team/BBB", []string{"AAA", "team/AAA"}, false)
+	require.NoError(t, err)
+	_, err = store.add(ctx, "team/CCC", nil, false)
+	assert.Equal(t, fmt.Errorf("%w: namespace team holds 2 packages, at most 2 allowed", ErrQuotaExceeded), err)
+	_, err = store.add(ctx, "BBB", nil, false)
+	assert.Equal(t, fmt.Errorf("%w: namespace default holds 1 packages, at most 1 allowed", ErrQuotaExceeded), err)
+
+	// packages already there are updated, and namespaces without one are unlimited
+	result, err := store.add(ctx, "team/BBB", []string{"AAA"}, true)
+	require.NoError(t, err)
+	assert.Equal(t, packageUpdated, result)
+	for _, name := range []string{"other/AAA", "other/BBB", "other/CCC"} {
+		_, err = store.add(ctx, name, nil, false)
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, store.remove(ctx, "team/AAA"))
+	_, err = store.add(ctx, "team/CCC", nil, false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"AAA", "other/AAA", "other/BBB", "other/CCC", "team/BBB", "team/CCC"}, store.names(ctx))
+	assert.Equal(t, uint64(8), store.revision(ctx))
+}
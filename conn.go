@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// timeoutConn applies the configured deadlines to a client connection. The
+// idle timeout covers waiting for the first byte of the next command and the
+// read timeout covers receiving the rest of it; the write timeout is applied
+// before every write. A zero timeout disables the deadline. Writes are
+// serialized so responses to pipelined commands do not interleave.
+type timeoutConn struct {
+	net.Conn
+	config *config
+
+	mu      sync.Mutex
+	idle    bool
+	readErr error
+	writeMu sync.Mutex
+}
+
+func newTimeoutConn(connection net.Conn, cfg *config) *timeoutConn {
+	return &timeoutConn{
+		Conn:   connection,
+		config: cfg,
+		idle:   true,
+	}
+}
+
+func (c *timeoutConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	idle := c.idle
+	c.mu.Unlock()
+	if idle {
+		c.setReadDeadline(c.config.IdleTimeout)
+	}
+	n, err := c.Conn.Read(b)
+	c.mu.Lock()
+	c.readErr = err
+	if n > 0 && idle {
+		c.idle = false
+	}
+	c.mu.Unlock()
+	if n > 0 && idle {
+		c.setReadDeadline(c.config.ReadTimeout)
+	}
+	return n, err
+}
+
+// readFailed reports whether the last read failed for a reason other than the
+// client closing the connection, in which case any buffered input is partial.
+func (c *timeoutConn) readFailed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.readErr != nil && !errors.Is(c.readErr, io.EOF)
+}
+
+func (c *timeoutConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.config.WriteTimeout > 0 {
+		_ = c.Conn.SetWriteDeadline(time.Now().Add(c.config.WriteTimeout))
+	}
+	return c.Conn.Write(b)
+}
+
+// commandDone is called after a command has been handled, so the wait for the
+// next one is covered by the idle timeout.
+func (c *timeoutConn) commandDone() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.idle = true
+}
+
+func (c *timeoutConn) isIdle() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.idle
+}
+
+func (c *timeoutConn) setReadDeadline(timeout time.Duration) {
+	if timeout > 0 {
+		_ = c.Conn.SetReadDeadline(time.Now().Add(timeout))
+	}
+}
+
+func (c *timeoutConn) ConnectionState() tls.ConnectionState {
+	if tlsConn, ok := c.Conn.(*tls.Conn); ok {
+		return tlsConn.ConnectionState()
+	}
+	return tls.ConnectionState{}
+}
+
+const maxRequestIDLength = 64
+
+// requestID takes the optional request ID prefix, a token starting with #,
+// off the tokenized command line.
+func requestID(segments []string) (string, []string, error) {
+	if len(segments) == 0 || !strings.HasPrefix(segments[0], "#") {
+		return "", segments, nil
+	}
+	id := segments[0][1:]
+	if id == "" || len(id) > maxRequestIDLength {
+		return "", segments[1:], fmt.Errorf("request ID must be 1 to %d characters", maxRequestIDLength)
+	}
+	for _, r := range id {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("._-", r)) {
+			return "", segments[1:], fmt.Errorf("request ID %q contains invalid character %q", id, r)
+		}
+	}
+	return id, segments[1:], nil
+}
+
+// requestConn echoes the request ID at the start of every response, so
+// clients pipelining commands can match responses arriving out of order.
+type requestConn struct {
+	*timeoutConn
+	id string
+}
+
+func (c *requestConn) Write(b []byte) (int, error) {
+	if c.id == "" {
+		return c.timeoutConn.Write(b)
+	}
+	body := bytes.TrimLeft(b, "\n")
+	tagged := make([]byte, 0, len(b)+len(c.id)+2)
+	tagged = append(tagged, b[:len(b)-len(body)]...)
+	tagged = append(tagged, '#')
+	tagged = append(tagged, c.id...)
+	tagged = append(tagged, ' ')
+	tagged = append(tagged, body...)
+	if _, err := c.timeoutConn.Write(tagged); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
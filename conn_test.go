@@ -0,0 +1,226 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	gomock "github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimeoutConnDeadlines(t *testing.T) {
+	t.Parallel()
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	netConnMock := NewNetConnMock(ctrl)
+	cfg := &config{IdleTimeout: time.Minute, ReadTimeout: time.Second, WriteTimeout: 2 * time.Second}
+	connection := newTimeoutConn(netConnMock, cfg)
+
+	within := func(timeout time.Duration) gomock.Matcher {
+		return deadlineMatcher{timeout: timeout}
+	}
+	gomock.InOrder(
+		// waiting for the first command
+		netConnMock.EXPECT().SetReadDeadline(within(cfg.IdleTimeout)),
+		netConnMock.EXPECT().Read(gomock.Any()).Return(4, nil),
+		// rest of the first command
+		netConnMock.EXPECT().SetReadDeadline(within(cfg.ReadTimeout)),
+		netConnMock.EXPECT().Read(gomock.Any()).Return(4, nil),
+		// response
+		netConnMock.EXPECT().SetWriteDeadline(within(cfg.WriteTimeout)),
+		netConnMock.EXPECT().Write([]byte("PONG")).Return(4, nil),
+		// waiting for the second command
+		netConnMock.EXPECT().SetReadDeadline(within(cfg.IdleTimeout)),
+		netConnMock.EXPECT().Read(gomock.Any()).Return(0, nil),
+	)
+
+	buf := make([]byte, 4)
+	assert.True(t, connection.isIdle())
+	_, err := connection.Read(buf)
+	require.NoError(t, err)
+	assert.False(t, connection.isIdle())
+	_, err = connection.Read(buf)
+	require.NoError(t, err)
+	_, err = connection.Write([]byte("PONG"))
+	require.NoError(t, err)
+	connection.commandDone()
+	assert.True(t, connection.isIdle())
+	_, err = connection.Read(buf)
+	require.NoError(t, err)
+	assert.True(t, connection.isIdle())
+}
+
+func TestTimeoutConnDisabled(t *testing.T) {
+	t.Parallel()
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	netConnMock := NewNetConnMock(ctrl)
+	netConnMock.EXPECT().Read(gomock.Any()).Return(4, nil)
+	netConnMock.EXPECT().Write([]byte("PONG")).Return(4, nil)
+
+	connection := newTimeoutConn(netConnMock, &config{})
+	_, err := connection.Read(make([]byte, 4))
+	require.NoError(t, err)
+	_, err = connection.Write([]byte("PONG"))
+	require.NoError(t, err)
+}
+
+type deadlineMatcher struct {
+	timeout time.Duration
+}
+
+func (m deadlineMatcher) Matches(x interface{}) bool {
+	deadline, ok := x.(time.Time)
+	if !ok {
+		return false
+	}
+	remaining := time.Until(deadline)
+	return remaining > 0 && remaining <= m.timeout
+}
+
+func (m deadlineMatcher) String() string {
+	return "is a deadline within " + m.timeout.String()
+}
+
+func TestTimeoutConnReadFailed(t *testing.T) {
+	t.Parallel()
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	netConnMock := NewNetConnMock(ctrl)
+	gomock.InOrder(
+		netConnMock.EXPECT().Read(gomock.Any()).Return(4, nil),
+		netConnMock.EXPECT().Read(gomock.Any()).Return(0, io.EOF),
+		netConnMock.EXPECT().Read(gomock.Any()).Return(0, new(netTempError)),
+	)
+
+	connection := newTimeoutConn(netConnMock, &config{})
+	buf := make([]byte, 4)
+	_, _ = connection.Read(buf)
+	assert.False(t, connection.readFailed())
+	_, _ = connection.Read(buf)
+	assert.False(t, connection.readFailed())
+	_, _ = connection.Read(buf)
+	assert.True(t, connection.readFailed())
+}
+
+func TestRequestID(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name         string
+		given        []string
+		wantID       string
+		wantSegments []string
+		wantError    error
+	}{
+		{
+			name:         "no request ID",
+			given:        []string{"ListPackages"},
+			wantID:       "",
+			wantSegments: []string{"ListPackages"},
+		},
+		{
+			name:         "empty input",
+			given:        nil,
+			wantID:       "",
+			wantSegments: nil,
+		},
+		{
+			name:         "request ID",
+			given:        []string{"#req-1.a_b", "GetPackage", "AAA"},
+			wantID:       "req-1.a_b",
+			wantSegments: []string{"GetPackage", "AAA"},
+		},
+		{
+			name:         "only request ID",
+			given:        []string{"#42"},
+			wantID:       "42",
+			wantSegments: []string{},
+		},
+		{
+			name:         "empty request ID",
+			given:        []string{"#", "Ping"},
+			wantSegments: []string{"Ping"},
+			wantError:    errors.New("request ID must be 1 to 64 characters"),
+		},
+		{
+			name:         "invalid request ID",
+			given:        []string{"#a/b", "Ping"},
+			wantSegments: []string{"Ping"},
+			wantError:    errors.New(`request ID "a/b" contains invalid character '/'`),
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			id, segments, err := requestID(tc.given)
+			if tc.wantError != nil {
+				assert.EqualError(t, err, tc.wantError.Error())
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, tc.wantID, id)
+			}
+			assert.Equal(t, tc.wantSegments, segments)
+		})
+	}
+}
+
+func TestRequestConnWrite(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		givenID   string
+		givenData string
+		wantData  string
+	}{
+		{
+			name:      "no request ID",
+			givenID:   "",
+			givenData: "\nPackage added\n",
+			wantData:  "\nPackage added\n",
+		},
+		{
+			name:      "request ID after leading newline",
+			givenID:   "42",
+			givenData: "\nPackages and Dependencies\n- AAA\n",
+			wantData:  "\n#42 Packages and Dependencies\n- AAA\n",
+		},
+		{
+			name:      "no leading newline",
+			givenID:   "42",
+			givenData: "PONG\n",
+			wantData:  "#42 PONG\n",
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			netConnMock := NewNetConnMock(ctrl)
+			netConnMock.EXPECT().Write([]byte(tc.wantData)).Return(len(tc.wantData), nil)
+
+			connection := &requestConn{timeoutConn: newTimeoutConn(netConnMock, &config{}), id: tc.givenID}
+			n, err := connection.Write([]byte(tc.givenData))
+			require.NoError(t, err)
+			assert.Equal(t, len(tc.givenData), n)
+		})
+	}
+}
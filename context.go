@@ -0,0 +1,64 @@
+package main
+
+import "context"
+
+type contextKey int
+
+const (
+	identityKey contextKey = iota
+	remoteAddrKey
+	requestIDKey
+	namespaceKey
+	auditTrailKey
+)
+
+// withRequest carries the client identity, address and request ID of a
+// command, so they're available wherever its context is passed.
+func withRequest(ctx context.Context, identity, remoteAddr, id string) context.Context {
+	ctx = context.WithValue(ctx, identityKey, identity)
+	ctx = context.WithValue(ctx, remoteAddrKey, remoteAddr)
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+func identityFrom(ctx context.Context) string {
+	if identity, ok := ctx.Value(identityKey).(string); ok {
+		return identity
+	}
+	return "anonymous"
+}
+
+func remoteAddrFrom(ctx context.Context) string {
+	addr, _ := ctx.Value(remoteAddrKey).(string)
+	return addr
+}
+
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// withNamespace carries the namespace a command was prefixed with.
+func withNamespace(ctx context.Context, ns string) context.Context {
+	return context.WithValue(ctx, namespaceKey, ns)
+}
+
+func namespaceFrom(ctx context.Context) string {
+	ns, _ := ctx.Value(namespaceKey).(string)
+	return ns
+}
+
+// auditTrail tells whether a command was recorded in the audit log.
+type auditTrail struct {
+	recorded bool
+}
+
+// withAuditTrail carries a trail marked when the command is recorded.
+func withAuditTrail(ctx context.Context) (context.Context, *auditTrail) {
+	trail := &auditTrail{}
+	return context.WithValue(ctx, auditTrailKey, trail), trail
+}
+
+func auditTrailFrom(ctx context.Context) *auditTrail {
+	trail, _ := ctx.Value(auditTrailKey).(*auditTrail)
+	return trail
+}
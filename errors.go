@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Errors returned by the registry, matched with errors.Is.
+var (
+	ErrAlreadyExists = errors.New("package already exists")
+	ErrNotFound      = errors.New("package not exists")
+	ErrStillRequired = errors.New("package is still required")
+	ErrInvalidName   = errors.New("invalid package name")
+	// ErrDependencyCycle is returned when a package is given itself as a
+	// dependency, or when replacing dependencies would make it depend on itself.
+	ErrDependencyCycle = errors.New("dependency cycle")
+	// ErrUnknownRevision is returned for revisions not published yet or no
+	// longer retained.
+	ErrUnknownRevision = errors.New("unknown revision")
+	// ErrReadOnly is returned for writes to a follower.
+	ErrReadOnly = errors.New("read-only replica")
+	// ErrUnavailable is returned for writes a cluster cannot commit, without
+	// a leader or when the leader lost its quorum. They may have been
+	// committed when the leader was lost while committing them.
+	ErrUnavailable = errors.New("cluster unavailable")
+	// ErrNotClustered is returned for membership changes of a registry that
+	// is not part of a cluster.
+	ErrNotClustered = errors.New("not a cluster node")
+	// ErrQuotaExceeded is returned for packages added to a namespace holding
+	// as many packages as its quota allows.
+	ErrQuotaExceeded = errors.New("namespace quota exceeded")
+)
+
+// Errors returned by the transport.
+var (
+	ErrUnknownCommand   = errors.New("unknown action")
+	ErrPermissionDenied = errors.New("permission denied")
+	ErrTimeout          = errors.New("timeout")
+	ErrInternal         = errors.New("internal error")
+)
+
+// StillRequiredError is returned when removing a package others depend on.
+type StillRequiredError struct {
+	Name       string
+	RequiredBy []string
+}
+
+func (e *StillRequiredError) Error() string {
+	return fmt.Sprintf("package %s cannot be removed, it's required by %q", e.Name, e.RequiredBy)
+}
+
+func (e *StillRequiredError) Unwrap() error {
+	return ErrStillRequired
+}
+
+// errorCodes are sent along with error responses, they must not change once
+// clients may depend on them.
+var errorCodes = []struct {
+	err  error
+	code string
+}{
+	{ErrAlreadyExists, "already_exists"},
+	{ErrNotFound, "not_found"},
+	{ErrStillRequired, "still_required"},
+	{ErrInvalidName, "invalid_name"},
+	{ErrDependencyCycle, "dependency_cycle"},
+	{ErrUnknownRevision, "unknown_revision"},
+	{ErrReadOnly, "read_only"},
+	{ErrUnavailable, "unavailable"},
+	{ErrNotClustered, "not_clustered"},
+	{ErrQuotaExceeded, "quota_exceeded"},
+	{ErrUnknownCommand, "unknown_command"},
+	{ErrPermissionDenied, "permission_denied"},
+	{ErrTimeout, "timeout"},
+	{ErrInternal, "internal"},
+	{context.Canceled, "canceled"},
+	{context.DeadlineExceeded, "timeout"},
+}
+
+// codeBadRequest is the code of any other error, caused by a malformed
+// command or invalid arguments.
+const codeBadRequest = "bad_request"
+
+func errorCode(err error) string {
+	for _, c := range errorCodes {
+		if errors.Is(err, c.err) {
+			return c.code
+		}
+	}
+	return codeBadRequest
+}
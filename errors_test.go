@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestErrorCode(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name  string
+		given error
+		want  string
+	}{
+		{
+			name:  "wrapped not found",
+			given: fmt.Errorf("failed getting package: %w, did you mean AAA?", fmt.Errorf("%w: AAB", ErrNotFound)),
+			want:  "not_found",
+		},
+		{
+			name:  "invalid dependency",
+			given: fmt.Errorf("invalid dependency: %w", fmt.Errorf("%w %q: it is empty", ErrInvalidName, "")),
+			want:  "invalid_name",
+		},
+		{
+			name:  "still required",
+			given: fmt.Errorf("failed removing package: %w", &StillRequiredError{Name: "AAA", RequiredBy: []string{"BBB"}}),
+			want:  "still_required",
+		},
+		{
+			name:  "unknown revision",
+			given: fmt.Errorf("failed listing packages: %w", fmt.Errorf("%w 9: the latest revision is 4", ErrUnknownRevision)),
+			want:  "unknown_revision",
+		},
+		{
+			name:  "canceled",
+			given: fmt.Errorf("failed listing packages: %w", context.Canceled),
+			want:  "canceled",
+		},
+		{
+			name:  "anything else",
+			given: errors.New("input is empty"),
+			want:  codeBadRequest,
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			assert.Equal(t, tc.want, errorCode(tc.given))
+		})
+	}
+}
+
+func TestStillRequiredError(t *testing.T) {
+	t.Parallel()
+
+	err := fmt.Errorf("failed removing package: %w", &StillRequiredError{Name: "AAA", RequiredBy: []string{"BBB", "CCC"}})
+	assert.True(t, errors.Is(err, ErrStillRequired))
+
+	var stillRequired *StillRequiredError
+	require.True(t, errors.As(err, &stillRequired))
+	assert.Equal(t, []string{"BBB", "CCC"}, stillRequired.RequiredBy)
+	assert.EqualError(t, err, `failed removing package: package AAA cannot be removed, it's required by ["BBB" "CCC"]`)
+}
@@ -1,58 +1,296 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"net"
+	"time"
 
 	"go.uber.org/zap"
 )
 
+// handler implements the commands independently of any transport, which
+// formats their results and errors.
 type handler interface {
-	addPackage(connection net.Conn, args ...string) error
-	removePackage(connection net.Conn, args ...string) error
-	listPackages(connection net.Conn) error
+	addPackage(ctx context.Context, name string, deps []string, upsert bool) (addResult, error)
+	createGroup(ctx context.Context, name string, members []string, upsert bool) (addResult, error)
+	removePackage(ctx context.Context, name string) error
+	revert(ctx context.Context, target revertTarget) (revertResult, error)
+	listPackages(ctx context.Context, rev uint64) (packageList, error)
+	getPackage(ctx context.Context, name string, rev uint64) (packageInfo, error)
+	revision(ctx context.Context) revisionInfo
+	revisionAt(ctx context.Context, at time.Time) (revisionInfo, error)
+	packageHistory(ctx context.Context, name string) (packageHistory, error)
+	ping(ctx context.Context) error
+	auditLog(ctx context.Context, filter auditFilter) (auditRecords, error)
+	checkGraph(ctx context.Context) (graphProblems, error)
+	replicate(ctx context.Context, generation string, rev uint64, send func(replicationUpdate) error) error
+	replication(ctx context.Context) replicationStatus
+	joinCluster(ctx context.Context, id, addr string) error
+	leaveCluster(ctx context.Context, id string) error
 }
 
 type action struct {
 	logger   *zap.Logger
+	config   *config
 	registry registry
+	audit    *auditLog
 }
 
-func newAction(lg *zap.Logger, reg registry) action {
+func newAction(lg *zap.Logger, cfg *config, reg registry, al *auditLog) action {
 	return action{
 		logger:   lg,
+		config:   cfg,
 		registry: reg,
+		audit:    al,
 	}
 }
 
-func (a action) addPackage(connection net.Conn, args ...string) error {
-	if len(args) == 0 {
-		_, err := connection.Write([]byte("\nERROR: no package name\n"))
-		return err
+// addPackage names the package and its dependencies from the namespace of
+// the command, where dependencies on other namespaces are given as ns/name.
+func (a action) addPackage(ctx context.Context, name string, deps []string, upsert bool) (addResult, error) {
+	if limit := a.config.MaxDependencies; limit > 0 && len(deps) > limit {
+		return packageUnchanged, fmt.Errorf("too many dependencies, %d given and at most %d allowed", len(deps), limit)
 	}
-	name, deps := args[0], args[1:]
-	if err := a.registry.add(name, deps); err != nil {
-		_, err = connection.Write([]byte(fmt.Sprintf("\nERROR: failed adding package: %s\n", err)))
-		return err
+	result, err := a.insert(ctx, AddPackage, name, deps, upsert, a.registry.add)
+	if err != nil {
+		return result, fmt.Errorf("failed adding package: %w", err)
 	}
-	_, err := connection.Write([]byte("\nPackage added\n"))
-	return err
+	return result, nil
 }
 
-func (a action) removePackage(connection net.Conn, args ...string) error {
-	if len(args) == 0 {
-		_, err := connection.Write([]byte("\nERROR: no package name\n"))
-		return err
+// createGroup names the group and its members like addPackage does.
+func (a action) createGroup(ctx context.Context, name string, members []string, upsert bool) (addResult, error) {
+	if limit := a.config.MaxDependencies; limit > 0 && len(members) > limit {
+		return packageUnchanged, fmt.Errorf("too many members, %d given and at most %d allowed", len(members), limit)
 	}
-	if err := a.registry.remove(args[0]); err != nil {
-		_, err = connection.Write([]byte(fmt.Sprintf("\nERROR: failed removing package: %s\n", err)))
-		return err
+	result, err := a.insert(ctx, CreateGroup, name, members, upsert, a.registry.createGroup)
+	if err != nil {
+		return result, fmt.Errorf("failed creating group: %w", err)
 	}
-	_, err := connection.Write([]byte("\nPackage removed\n"))
-	return err
+	return result, nil
 }
 
-func (a action) listPackages(connection net.Conn) error {
-	_, err := connection.Write([]byte("\n" + a.registry.list() + "\n"))
-	return err
+// insert qualifies the names of a package or group and adds it with add,
+// auditing it as cmd unless nothing changed. Confined clients cannot depend
+// on other namespaces, which would keep their packages from being removed.
+func (a action) insert(ctx context.Context, cmd, name string, deps []string, upsert bool,
+	add func(context.Context, string, []string, bool) (addResult, error)) (addResult, error) {
+	ns, name, err := a.resolve(ctx, name)
+	if err != nil {
+		return packageUnchanged, err
+	}
+	confined, isConfined := a.config.ClientNamespaces[identityFrom(ctx)]
+	var qualifiedDeps []string
+	for _, dep := range deps {
+		qualified := qualify(ns, dep)
+		if isConfined && namespaceOf(qualified) != confined {
+			return packageUnchanged, fmt.Errorf("%w, cannot depend on %s", a.confinedTo(ctx, confined), dep)
+		}
+		qualifiedDeps = append(qualifiedDeps, qualified)
+	}
+	result, err := add(ctx, name, qualifiedDeps, upsert)
+	if err != nil || result != packageUnchanged {
+		a.audit.record(ctx, cmd, append([]string{name}, qualifiedDeps...), err)
+	}
+	return result, err
+}
+
+func (a action) removePackage(ctx context.Context, name string) error {
+	ns, qualified, err := a.resolve(ctx, name)
+	if err != nil {
+		return fmt.Errorf("failed removing package: %w", err)
+	}
+	err = a.registry.remove(ctx, qualified)
+	a.audit.record(ctx, RemovePackage, []string{qualified}, err)
+	if err != nil {
+		return fmt.Errorf("failed removing package: %w%s", err, a.didYouMean(ctx, ns, name))
+	}
+	return nil
+}
+
+// revert spans every namespace, which clients confined to one cannot.
+func (a action) revert(ctx context.Context, target revertTarget) (revertResult, error) {
+	if ns, confined := a.config.ClientNamespaces[identityFrom(ctx)]; confined {
+		return revertResult{}, fmt.Errorf("failed reverting: %w, reverts span every namespace", a.confinedTo(ctx, ns))
+	}
+	reverted, err := a.registry.revert(ctx, target)
+	if err != nil || reverted.Changes > 0 {
+		a.audit.record(ctx, Revert, []string{target.String()}, err)
+	}
+	if err != nil {
+		return revertResult{}, fmt.Errorf("failed reverting: %w", err)
+	}
+	return reverted, nil
+}
+
+// listPackages lists the packages of the namespace of the command only.
+func (a action) listPackages(ctx context.Context, rev uint64) (packageList, error) {
+	ns, err := a.namespace(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed listing packages: %w", err)
+	}
+	pkgs, err := a.registry.list(ctx, rev)
+	if err != nil {
+		return nil, fmt.Errorf("failed listing packages: %w", err)
+	}
+	inNamespace := packageList{}
+	for _, pkg := range pkgs {
+		if namespaceOf(pkg.Name) == ns {
+			inNamespace = append(inNamespace, pkg.relative(ns))
+		}
+	}
+	return inNamespace, nil
+}
+
+func (a action) getPackage(ctx context.Context, name string, rev uint64) (packageInfo, error) {
+	ns, qualified, err := a.resolve(ctx, name)
+	if err != nil {
+		return packageInfo{}, fmt.Errorf("failed getting package: %w", err)
+	}
+	pkg, err := a.registry.get(ctx, qualified, rev)
+	if err != nil {
+		return packageInfo{}, fmt.Errorf("failed getting package: %w%s", err, a.didYouMean(ctx, ns, name))
+	}
+	return pkg.relative(ns), nil
+}
+
+func (a action) revision(ctx context.Context) revisionInfo {
+	return revisionInfo{Revision: a.registry.revision(ctx)}
+}
+
+func (a action) revisionAt(ctx context.Context, at time.Time) (revisionInfo, error) {
+	rev, err := a.registry.revisionAt(ctx, at)
+	if err != nil {
+		return revisionInfo{}, fmt.Errorf("failed finding revision: %w", err)
+	}
+	return revisionInfo{Revision: rev}, nil
+}
+
+func (a action) packageHistory(ctx context.Context, name string) (packageHistory, error) {
+	ns, qualified, err := a.resolve(ctx, name)
+	if err != nil {
+		return packageHistory{}, fmt.Errorf("failed getting package history: %w", err)
+	}
+	history, err := a.registry.packageHistory(ctx, qualified)
+	if err != nil {
+		return packageHistory{}, fmt.Errorf("failed getting package history: %w%s", err, a.didYouMean(ctx, ns, name))
+	}
+	return history.relative(ns), nil
+}
+
+func (a action) ping(ctx context.Context) error {
+	return nil
+}
+
+// auditLog filters by the package named from the namespace of the command,
+// as records hold registry names.
+func (a action) auditLog(ctx context.Context, filter auditFilter) (auditRecords, error) {
+	if filter.pkgName != "" {
+		_, qualified, err := a.resolve(ctx, filter.pkgName)
+		if err != nil {
+			return nil, fmt.Errorf("failed querying audit log: %w", err)
+		}
+		filter.pkgName = qualified
+	}
+	return a.audit.query(filter), nil
+}
+
+func (a action) checkGraph(ctx context.Context) (graphProblems, error) {
+	problems, err := a.registry.check(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed checking graph: %w", err)
+	}
+	if len(problems) > 0 {
+		a.logger.Warn("dependency graph is inconsistent", zap.Strings("problems", problems))
+	}
+	return problems, nil
+}
+
+// replicate sends a follower what it is missing, then every change as it is
+// published, with heartbeats in between, until ctx is done or sending fails.
+func (a action) replicate(ctx context.Context, generation string, rev uint64, send func(replicationUpdate) error) error {
+	heartbeat := time.NewTicker(a.config.ReplicaHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		update, published := a.registry.follow(generation, rev)
+		update.Time = time.Now()
+		update.Heartbeat = a.config.ReplicaHeartbeat
+		if err := send(update); err != nil {
+			return err
+		}
+		generation, rev = update.Generation, update.Revision
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-published:
+		case <-heartbeat.C:
+		}
+	}
+}
+
+func (a action) replication(ctx context.Context) replicationStatus {
+	return a.registry.replication()
+}
+
+func (a action) joinCluster(ctx context.Context, id, addr string) error {
+	err := a.registry.join(ctx, id, addr)
+	a.audit.record(ctx, JoinCluster, []string{id, addr}, err)
+	if err != nil {
+		return fmt.Errorf("failed adding cluster member: %w", err)
+	}
+	return nil
+}
+
+func (a action) leaveCluster(ctx context.Context, id string) error {
+	err := a.registry.leave(ctx, id)
+	a.audit.record(ctx, LeaveCluster, []string{id}, err)
+	if err != nil {
+		return fmt.Errorf("failed removing cluster member: %w", err)
+	}
+	return nil
+}
+
+// namespace returns the namespace a command targets: the one it is prefixed
+// with, else the one its client is confined to, else the default one.
+func (a action) namespace(ctx context.Context) (string, error) {
+	given := namespaceFrom(ctx)
+	confined, isConfined := a.config.ClientNamespaces[identityFrom(ctx)]
+	switch {
+	case isConfined && given != "" && given != confined:
+		return "", a.confinedTo(ctx, confined)
+	case given != "":
+		return given, nil
+	case isConfined:
+		return confined, nil
+	}
+	return defaultNamespace, nil
+}
+
+// resolve returns the namespace of a command and the registry name of the
+// package it targets, which must be in the namespace of a confined client.
+func (a action) resolve(ctx context.Context, name string) (string, string, error) {
+	ns, err := a.namespace(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	qualified := qualify(ns, name)
+	if confined, isConfined := a.config.ClientNamespaces[identityFrom(ctx)]; isConfined && namespaceOf(qualified) != confined {
+		return "", "", a.confinedTo(ctx, confined)
+	}
+	return ns, qualified, nil
+}
+
+func (a action) confinedTo(ctx context.Context, ns string) error {
+	return fmt.Errorf("%w: client %s is confined to namespace %s", ErrPermissionDenied, identityFrom(ctx), ns)
+}
+
+// didYouMean suggests the packages of the namespace closest to name.
+func (a action) didYouMean(ctx context.Context, ns, name string) string {
+	var candidates []string
+	for _, candidate := range a.registry.names(ctx) {
+		if namespaceOf(candidate) == ns {
+			candidates = append(candidates, relative(ns, candidate))
+		}
+	}
+	return didYouMean(name, candidates)
 }
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"testing"
+	"time"
 
 	gomock "github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
 )
@@ -14,31 +18,36 @@ func TestActionAddPackage(t *testing.T) {
 
 	tests := []struct {
 		name      string
-		mock      func(*RegistryMock, *NetConnMock)
-		givenArgs []string
+		mock      func(*RegistryMock)
+		givenName string
+		givenDeps []string
+		want      addResult
+		wantError error
 	}{
 		{
-			name: "no package name",
-			mock: func(reg *RegistryMock, conn *NetConnMock) {
-				conn.EXPECT().Write([]byte("\nERROR: no package name\n")).Return(0, nil)
-			},
-			givenArgs: []string{},
+			name:      "too many dependencies",
+			mock:      func(reg *RegistryMock) {},
+			givenName: "DDD",
+			givenDeps: []string{"AAA", "BBB", "CCC"},
+			wantError: errors.New("too many dependencies, 3 given and at most 2 allowed"),
 		},
 		{
 			name: "failed adding package",
-			mock: func(reg *RegistryMock, conn *NetConnMock) {
-				reg.EXPECT().add("BBB", []string{"AAA"}).Return(errors.New("expected unit test error"))
-				conn.EXPECT().Write([]byte("\nERROR: failed adding package: expected unit test error\n")).Return(0, nil)
+			mock: func(reg *RegistryMock) {
+				reg.EXPECT().add(gomock.Any(), "BBB", []string{"AAA"}, false).Return(packageUnchanged, errors.New("expected unit test error"))
 			},
-			givenArgs: []string{"BBB", "AAA"},
+			givenName: "BBB",
+			givenDeps: []string{"AAA"},
+			wantError: errors.New("failed adding package: expected unit test error"),
 		},
 		{
 			name: "happy path",
-			mock: func(reg *RegistryMock, conn *NetConnMock) {
-				reg.EXPECT().add("BBB", []string{"AAA"}).Return(nil)
-				conn.EXPECT().Write([]byte("\nPackage added\n")).Return(0, nil)
+			mock: func(reg *RegistryMock) {
+				reg.EXPECT().add(gomock.Any(), "BBB", []string{"AAA"}, false).Return(packageAdded, nil)
 			},
-			givenArgs: []string{"BBB", "AAA"},
+			givenName: "BBB",
+			givenDeps: []string{"AAA"},
+			want:      packageAdded,
 		},
 	}
 
@@ -51,48 +60,123 @@ func TestActionAddPackage(t *testing.T) {
 			defer ctrl.Finish()
 
 			registryMock := NewRegistryMock(ctrl)
-			netConnMock := NewNetConnMock(ctrl)
-			tc.mock(registryMock, netConnMock)
+			tc.mock(registryMock)
 
 			logger := zap.NewNop()
-			action := newAction(logger, registryMock)
+			action := newAction(logger, &config{MaxDependencies: 2}, registryMock, nil)
 
-			err := action.addPackage(netConnMock, tc.givenArgs...)
-			require.NoError(t, err)
+			result, err := action.addPackage(context.Background(), tc.givenName, tc.givenDeps, false)
+			if tc.wantError != nil {
+				assert.EqualError(t, err, tc.wantError.Error())
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tc.want, result)
+			}
 		})
 	}
 }
 
-func TestActionRemovePackage(t *testing.T) {
+func TestActionCreateGroup(t *testing.T) {
 	t.Parallel()
 
 	tests := []struct {
-		name      string
-		mock      func(*RegistryMock, *NetConnMock)
-		givenArgs []string
+		name         string
+		mock         func(*RegistryMock)
+		givenNs      string
+		givenName    string
+		givenMembers []string
+		want         addResult
+		wantArgs     []string
+		wantError    error
 	}{
 		{
-			name: "no package name",
-			mock: func(reg *RegistryMock, conn *NetConnMock) {
-				conn.EXPECT().Write([]byte("\nERROR: no package name\n")).Return(0, nil)
+			name:         "too many members",
+			mock:         func(reg *RegistryMock) {},
+			givenName:    "base",
+			givenMembers: []string{"AAA", "BBB", "CCC"},
+			wantError:    errors.New("too many members, 3 given and at most 2 allowed"),
+		},
+		{
+			name: "failed creating group",
+			mock: func(reg *RegistryMock) {
+				reg.EXPECT().createGroup(gomock.Any(), "base", []string{"AAA"}, false).
+					Return(packageUnchanged, fmt.Errorf("%w: %s", ErrAlreadyExists, "package base with deps [] and required by []"))
 			},
-			givenArgs: []string{},
+			givenName:    "base",
+			givenMembers: []string{"AAA"},
+			wantArgs:     []string{"base", "AAA"},
+			wantError:    errors.New("failed creating group: package already exists: package base with deps [] and required by []"),
 		},
+		{
+			name: "happy path in a namespace",
+			mock: func(reg *RegistryMock) {
+				reg.EXPECT().createGroup(gomock.Any(), "team/base", []string{"team/AAA", "BBB"}, false).Return(packageAdded, nil)
+			},
+			givenNs:      "team",
+			givenName:    "base",
+			givenMembers: []string{"AAA", "default/BBB"},
+			want:         packageAdded,
+			wantArgs:     []string{"team/base", "team/AAA", "BBB"},
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			registryMock := NewRegistryMock(ctrl)
+			tc.mock(registryMock)
+
+			action := newAction(zap.NewNop(), &config{MaxDependencies: 2}, registryMock, &auditLog{sink: zap.NewNop()})
+			ctx := context.Background()
+			if tc.givenNs != "" {
+				ctx = withNamespace(ctx, tc.givenNs)
+			}
+			result, err := action.createGroup(ctx, tc.givenName, tc.givenMembers, false)
+			if tc.wantError != nil {
+				assert.EqualError(t, err, tc.wantError.Error())
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tc.want, result)
+			}
+			records, err := action.auditLog(context.Background(), auditFilter{})
+			require.NoError(t, err)
+			if tc.wantArgs == nil {
+				assert.Empty(t, records)
+				return
+			}
+			require.Len(t, records, 1)
+			assert.Equal(t, CreateGroup, records[0].Command)
+			assert.Equal(t, tc.wantArgs, records[0].Args)
+		})
+	}
+}
+
+func TestActionRemovePackage(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		mock      func(*RegistryMock)
+		wantError error
+	}{
 		{
 			name: "failed removing package",
-			mock: func(reg *RegistryMock, conn *NetConnMock) {
-				reg.EXPECT().remove("AAA").Return(errors.New("expected unit test error"))
-				conn.EXPECT().Write([]byte("\nERROR: failed removing package: expected unit test error\n")).Return(0, nil)
+			mock: func(reg *RegistryMock) {
+				reg.EXPECT().remove(gomock.Any(), "AAA").Return(errors.New("expected unit test error"))
+				reg.EXPECT().names(gomock.Any()).Return([]string{"AAA", "BBB"})
 			},
-			givenArgs: []string{"AAA"},
+			wantError: errors.New("failed removing package: expected unit test error"),
 		},
 		{
 			name: "happy path",
-			mock: func(reg *RegistryMock, conn *NetConnMock) {
-				reg.EXPECT().remove("AAA").Return(nil)
-				conn.EXPECT().Write([]byte("\nPackage removed\n")).Return(0, nil)
+			mock: func(reg *RegistryMock) {
+				reg.EXPECT().remove(gomock.Any(), "AAA").Return(nil)
 			},
-			givenArgs: []string{"AAA"},
 		},
 	}
 
@@ -105,14 +189,17 @@ func TestActionRemovePackage(t *testing.T) {
 			defer ctrl.Finish()
 
 			registryMock := NewRegistryMock(ctrl)
-			netConnMock := NewNetConnMock(ctrl)
-			tc.mock(registryMock, netConnMock)
+			tc.mock(registryMock)
 
 			logger := zap.NewNop()
-			action := newAction(logger, registryMock)
+			action := newAction(logger, &config{}, registryMock, nil)
 
-			err := action.removePackage(netConnMock, tc.givenArgs...)
-			require.NoError(t, err)
+			err := action.removePackage(context.Background(), "AAA")
+			if tc.wantError != nil {
+				assert.EqualError(t, err, tc.wantError.Error())
+			} else {
+				assert.NoError(t, err)
+			}
 		})
 	}
 }
@@ -121,15 +208,24 @@ func TestActionListPackages(t *testing.T) {
 	t.Parallel()
 
 	tests := []struct {
-		name string
-		mock func(*RegistryMock, *NetConnMock)
+		name      string
+		mock      func(*RegistryMock)
+		want      packageList
+		wantError error
 	}{
 		{
 			name: "happy path",
-			mock: func(reg *RegistryMock, conn *NetConnMock) {
-				reg.EXPECT().list().Return("test test test")
-				conn.EXPECT().Write([]byte("\ntest test test\n")).Return(0, nil)
+			mock: func(reg *RegistryMock) {
+				reg.EXPECT().list(gomock.Any(), latestRevision).Return([]packageInfo{{Name: "AAA"}}, nil)
+			},
+			want: packageList{{Name: "AAA"}},
+		},
+		{
+			name: "failed listing packages",
+			mock: func(reg *RegistryMock) {
+				reg.EXPECT().list(gomock.Any(), latestRevision).Return(nil, context.Canceled)
 			},
+			wantError: errors.New("failed listing packages: context canceled"),
 		},
 	}
 
@@ -142,14 +238,383 @@ func TestActionListPackages(t *testing.T) {
 			defer ctrl.Finish()
 
 			registryMock := NewRegistryMock(ctrl)
-			netConnMock := NewNetConnMock(ctrl)
-			tc.mock(registryMock, netConnMock)
+			tc.mock(registryMock)
 
 			logger := zap.NewNop()
-			action := newAction(logger, registryMock)
+			action := newAction(logger, &config{}, registryMock, nil)
 
-			err := action.listPackages(netConnMock)
-			require.NoError(t, err)
+			pkgs, err := action.listPackages(context.Background(), latestRevision)
+			if tc.wantError != nil {
+				assert.EqualError(t, err, tc.wantError.Error())
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tc.want, pkgs)
 		})
 	}
 }
+
+func TestActionGetPackage(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		mock      func(*RegistryMock)
+		givenName string
+		want      packageInfo
+		wantError error
+		wantCode  string
+	}{
+		{
+			name: "misspelled package name",
+			mock: func(reg *RegistryMock) {
+				reg.EXPECT().get(gomock.Any(), "AAB", latestRevision).Return(packageInfo{}, fmt.Errorf("%w: AAB", ErrNotFound))
+				reg.EXPECT().names(gomock.Any()).Return([]string{"AAA", "BBB", "CCC"})
+			},
+			givenName: "AAB",
+			wantError: errors.New("failed getting package: package not exists: AAB, did you mean AAA?"),
+			wantCode:  "not_found",
+		},
+		{
+			name: "failed getting package",
+			mock: func(reg *RegistryMock) {
+				reg.EXPECT().get(gomock.Any(), "AAA", latestRevision).Return(packageInfo{}, errors.New("expected unit test error"))
+				reg.EXPECT().names(gomock.Any()).Return([]string{"AAA", "BBB"})
+			},
+			givenName: "AAA",
+			wantError: errors.New("failed getting package: expected unit test error"),
+		},
+		{
+			name: "happy path",
+			mock: func(reg *RegistryMock) {
+				reg.EXPECT().get(gomock.Any(), "AAA", latestRevision).Return(packageInfo{Name: "AAA", RequiredBy: []string{"BBB"}}, nil)
+			},
+			givenName: "AAA",
+			want:      packageInfo{Name: "AAA", RequiredBy: []string{"BBB"}},
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			registryMock := NewRegistryMock(ctrl)
+			tc.mock(registryMock)
+
+			action := newAction(zap.NewNop(), &config{}, registryMock, nil)
+			pkg, err := action.getPackage(context.Background(), tc.givenName, latestRevision)
+			if tc.wantError != nil {
+				assert.EqualError(t, err, tc.wantError.Error())
+				if tc.wantCode != "" {
+					assert.Equal(t, tc.wantCode, errorCode(err))
+				}
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tc.want, pkg)
+		})
+	}
+}
+
+func TestActionPing(t *testing.T) {
+	t.Parallel()
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	action := newAction(zap.NewNop(), &config{}, NewRegistryMock(ctrl), nil)
+	require.NoError(t, action.ping(context.Background()))
+}
+
+func TestActionRevision(t *testing.T) {
+	t.Parallel()
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	registryMock := NewRegistryMock(ctrl)
+	registryMock.EXPECT().revision(gomock.Any()).Return(uint64(7))
+
+	action := newAction(zap.NewNop(), &config{}, registryMock, nil)
+	assert.Equal(t, revisionInfo{Revision: 7}, action.revision(context.Background()))
+}
+
+func TestActionHistory(t *testing.T) {
+	t.Parallel()
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	at := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	history := packageHistory{Name: "AAA", Changes: []packageChange{
+		{Revision: 2, Time: at, Op: packageWasAdded, DependsOn: []string{}},
+		{Revision: 3, Time: at, Op: packageWasRemoved, DependsOn: []string{}},
+	}}
+	registryMock := NewRegistryMock(ctrl)
+	registryMock.EXPECT().packageHistory(gomock.Any(), "AAA").Return(history, nil)
+	registryMock.EXPECT().packageHistory(gomock.Any(), "AAB").Return(packageHistory{}, fmt.Errorf("%w: AAB", ErrNotFound))
+	registryMock.EXPECT().names(gomock.Any()).Return([]string{"AAA"})
+	registryMock.EXPECT().revisionAt(gomock.Any(), at).Return(uint64(3), nil)
+	registryMock.EXPECT().revisionAt(gomock.Any(), at.Add(-time.Hour)).Return(latestRevision, fmt.Errorf("%w at 2026-10-18T11:00:00Z", ErrUnknownRevision))
+
+	action := newAction(zap.NewNop(), &config{}, registryMock, nil)
+	got, err := action.packageHistory(context.Background(), "AAA")
+	require.NoError(t, err)
+	assert.Equal(t, history, got)
+	_, err = action.packageHistory(context.Background(), "AAB")
+	assert.EqualError(t, err, "failed getting package history: package not exists: AAB, did you mean AAA?")
+
+	info, err := action.revisionAt(context.Background(), at)
+	require.NoError(t, err)
+	assert.Equal(t, revisionInfo{Revision: 3}, info)
+	_, err = action.revisionAt(context.Background(), at.Add(-time.Hour))
+	assert.EqualError(t, err, "failed finding revision: unknown revision at 2026-10-18T11:00:00Z")
+	assert.Equal(t, "unknown_revision", errorCode(err))
+}
+
+func TestActionRevert(t *testing.T) {
+	t.Parallel()
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	registryMock := NewRegistryMock(ctrl)
+	registryMock.EXPECT().revert(gomock.Any(), revertTarget{Last: 2}).Return(revertResult{To: 4, Changes: 2, Revision: 8}, nil)
+	registryMock.EXPECT().revert(gomock.Any(), revertTarget{Revision: 8}).Return(revertResult{To: 8, Revision: 8}, nil)
+	registryMock.EXPECT().revert(gomock.Any(), revertTarget{Revision: 2}).
+		Return(revertResult{}, fmt.Errorf("cannot revert revision 3: %w", &StillRequiredError{Name: "AAA", RequiredBy: []string{"BBB"}}))
+
+	action := newAction(zap.NewNop(), &config{}, registryMock, &auditLog{sink: zap.NewNop()})
+	reverted, err := action.revert(context.Background(), revertTarget{Last: 2})
+	require.NoError(t, err)
+	assert.Equal(t, revertResult{To: 4, Changes: 2, Revision: 8}, reverted)
+	_, err = action.revert(context.Background(), revertTarget{Revision: 8})
+	require.NoError(t, err)
+	_, err = action.revert(context.Background(), revertTarget{Revision: 2})
+	assert.EqualError(t, err, `failed reverting: cannot revert revision 3: package AAA cannot be removed, it's required by ["BBB"]`)
+	assert.Equal(t, "still_required", errorCode(err))
+
+	// reverting nothing is not audited
+	records, err := action.auditLog(context.Background(), auditFilter{})
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	assert.Equal(t, []string{"last=2"}, records[0].Args)
+	assert.Equal(t, []string{"to=2"}, records[1].Args)
+	assert.Equal(t, Revert, records[1].Command)
+}
+
+func TestActionNamespaces(t *testing.T) {
+	t.Parallel()
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	registryMock := NewRegistryMock(ctrl)
+	registryMock.EXPECT().add(gomock.Any(), "team/BBB", []string{"team/AAA"}, false).Return(packageAdded, nil)
+	registryMock.EXPECT().add(gomock.Any(), "team/DDD", []string{"team/AAA", "CCC"}, false).Return(packageAdded, nil)
+	registryMock.EXPECT().list(gomock.Any(), latestRevision).Return([]packageInfo{
+		{Name: "CCC", DependsOn: []string{}, RequiredBy: []string{"team/DDD"}},
+		{Name: "team/AAA", DependsOn: []string{}, RequiredBy: []string{"team/BBB", "team/DDD"}},
+		{Name: "team/BBB", DependsOn: []string{"team/AAA"}, RequiredBy: []string{}},
+		{Name: "team/DDD", DependsOn: []string{"CCC", "team/AAA"}, RequiredBy: []string{}},
+	}, nil)
+	registryMock.EXPECT().get(gomock.Any(), "team/AAA", latestRevision).
+		Return(packageInfo{Name: "team/AAA", DependsOn: []string{}, RequiredBy: []string{"team/BBB"}}, nil).Times(2)
+	registryMock.EXPECT().remove(gomock.Any(), "team/AAB").Return(ErrNotFound)
+	registryMock.EXPECT().names(gomock.Any()).Return([]string{"CCC", "team/AAA", "team/BBB"})
+
+	cfg := &config{ClientNamespaces: clientNamespaces{"alice": "team"}}
+	action := newAction(zap.NewNop(), cfg, registryMock, &auditLog{sink: zap.NewNop()})
+	alice := withRequest(context.Background(), "alice", "127.0.0.1:1234", "1")
+	bob := withRequest(context.Background(), "bob", "127.0.0.1:1235", "2")
+
+	// confined clients name packages from their namespace
+	result, err := action.addPackage(alice, "BBB", []string{"AAA"}, false)
+	require.NoError(t, err)
+	assert.Equal(t, packageAdded, result)
+	// while other clients can depend on other namespaces
+	result, err = action.addPackage(withNamespace(bob, "team"), "DDD", []string{"AAA", "default/CCC"}, false)
+	require.NoError(t, err)
+	assert.Equal(t, packageAdded, result)
+	pkgs, err := action.listPackages(alice, latestRevision)
+	require.NoError(t, err)
+	assert.Equal(t, packageList{
+		{Name: "AAA", DependsOn: []string{}, RequiredBy: []string{"BBB", "DDD"}},
+		{Name: "BBB", DependsOn: []string{"AAA"}, RequiredBy: []string{}},
+		{Name: "DDD", DependsOn: []string{"AAA", "default/CCC"}, RequiredBy: []string{}},
+	}, pkgs)
+	pkg, err := action.getPackage(withNamespace(bob, "team"), "AAA", latestRevision)
+	require.NoError(t, err)
+	assert.Equal(t, packageInfo{Name: "AAA", DependsOn: []string{}, RequiredBy: []string{"BBB"}}, pkg)
+	pkg, err = action.getPackage(bob, "team/AAA", latestRevision)
+	require.NoError(t, err)
+	assert.Equal(t, packageInfo{Name: "team/AAA", DependsOn: []string{}, RequiredBy: []string{"team/BBB"}}, pkg)
+	err = action.removePackage(withNamespace(bob, "team"), "AAB")
+	assert.EqualError(t, err, "failed removing package: package not exists, did you mean AAA?")
+
+	// and cannot reach out of it
+	_, err = action.listPackages(withNamespace(alice, "other"), latestRevision)
+	assert.EqualError(t, err, "failed listing packages: permission denied: client alice is confined to namespace team")
+	_, err = action.addPackage(alice, "EEE", []string{"AAA", "other/AAA"}, false)
+	assert.EqualError(t, err, "failed adding package: permission denied: client alice is confined to namespace team, cannot depend on other/AAA")
+	assert.Equal(t, "permission_denied", errorCode(err))
+	_, err = action.createGroup(alice, "GGG", []string{"default/CCC"}, false)
+	assert.EqualError(t, err, "failed creating group: permission denied: client alice is confined to namespace team, cannot depend on default/CCC")
+	err = action.removePackage(alice, "other/AAA")
+	assert.EqualError(t, err, "failed removing package: permission denied: client alice is confined to namespace team")
+	assert.Equal(t, "permission_denied", errorCode(err))
+	_, err = action.revert(alice, revertTarget{Last: 1})
+	assert.EqualError(t, err, "failed reverting: permission denied: client alice is confined to namespace team, reverts span every namespace")
+
+	records, err := action.auditLog(context.Background(), auditFilter{})
+	require.NoError(t, err)
+	require.Len(t, records, 3)
+	assert.Equal(t, []string{"team/BBB", "team/AAA"}, records[0].Args)
+	assert.Equal(t, []string{"team/DDD", "team/AAA", "CCC"}, records[1].Args)
+}
+
+func TestActionClusterMembership(t *testing.T) {
+	t.Parallel()
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	registryMock := NewRegistryMock(ctrl)
+	registryMock.EXPECT().join(gomock.Any(), "n2", "127.0.0.1:9201").Return(nil)
+	registryMock.EXPECT().leave(gomock.Any(), "n3").Return(fmt.Errorf("%w: no leader elected", ErrUnavailable))
+
+	action := newAction(zap.NewNop(), &config{}, registryMock, &auditLog{sink: zap.NewNop()})
+	require.NoError(t, action.joinCluster(context.Background(), "n2", "127.0.0.1:9201"))
+	err := action.leaveCluster(context.Background(), "n3")
+	assert.EqualError(t, err, "failed removing cluster member: cluster unavailable: no leader elected")
+	assert.Equal(t, "unavailable", errorCode(err))
+
+	records, err := action.auditLog(context.Background(), auditFilter{})
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	assert.Equal(t, []string{"n2", "127.0.0.1:9201"}, records[0].Args)
+	assert.Equal(t, LeaveCluster, records[1].Command)
+}
+
+func TestActionReplicate(t *testing.T) {
+	t.Parallel()
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	published, pending := make(chan struct{}), make(chan struct{})
+	close(published)
+	registryMock := NewRegistryMock(ctrl)
+	gomock.InOrder(
+		registryMock.EXPECT().follow("", uint64(0)).Return(replicationUpdate{Generation: "gen", Revision: 1, Full: true}, (<-chan struct{})(published)),
+		registryMock.EXPECT().follow("gen", uint64(1)).Return(replicationUpdate{Generation: "gen", Revision: 2, Changes: []change{{Revision: 2, Op: opAdd, Name: "AAA"}}}, (<-chan struct{})(pending)),
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var sent []replicationUpdate
+	action := newAction(zap.NewNop(), &config{ReplicaHeartbeat: time.Hour}, registryMock, nil)
+	err := action.replicate(ctx, "", 0, func(update replicationUpdate) error {
+		assert.False(t, update.Time.IsZero())
+		update.Time = time.Time{}
+		sent = append(sent, update)
+		if len(sent) == 2 {
+			cancel()
+		}
+		return nil
+	})
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, []replicationUpdate{
+		{Generation: "gen", Revision: 1, Full: true, Heartbeat: time.Hour},
+		{Generation: "gen", Revision: 2, Changes: []change{{Revision: 2, Op: opAdd, Name: "AAA"}}, Heartbeat: time.Hour},
+	}, sent)
+}
+
+func TestActionCheckGraph(t *testing.T) {
+	t.Parallel()
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	registryMock := NewRegistryMock(ctrl)
+	registryMock.EXPECT().check(gomock.Any()).Return([]string{"AAA depends on itself"}, nil)
+	registryMock.EXPECT().check(gomock.Any()).Return(nil, context.Canceled)
+
+	action := newAction(zap.NewNop(), &config{}, registryMock, nil)
+	problems, err := action.checkGraph(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, graphProblems{"AAA depends on itself"}, problems)
+
+	_, err = action.checkGraph(context.Background())
+	assert.EqualError(t, err, "failed checking graph: context canceled")
+}
+
+func TestActionAuditLog(t *testing.T) {
+	t.Parallel()
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	registryMock := NewRegistryMock(ctrl)
+	registryMock.EXPECT().add(gomock.Any(), "AAA", nil, false).Return(packageAdded, nil)
+	registryMock.EXPECT().add(gomock.Any(), "BBB", []string{"AAA"}, false).Return(packageAdded, nil)
+	registryMock.EXPECT().add(gomock.Any(), "BBB", []string{"AAA"}, false).Return(packageUnchanged, nil)
+
+	action := newAction(zap.NewNop(), &config{}, registryMock, &auditLog{sink: zap.NewNop()})
+	ctx := withRequest(context.Background(), "pacman_client", "127.0.0.1:1234", "")
+	for _, name := range []string{"AAA", "BBB", "BBB"} {
+		var deps []string
+		if name == "BBB" {
+			deps = []string{"AAA"}
+		}
+		_, err := action.addPackage(ctx, name, deps, false)
+		require.NoError(t, err)
+	}
+
+	records, err := action.auditLog(context.Background(), auditFilter{pkgName: "BBB"})
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, "pacman_client", records[0].Identity)
+	assert.Equal(t, "127.0.0.1:1234", records[0].RemoteAddr)
+	assert.Equal(t, []string{"BBB", "AAA"}, records[0].Args)
+}
+
+func TestActionAuditLogNamespaces(t *testing.T) {
+	t.Parallel()
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	registryMock := NewRegistryMock(ctrl)
+	registryMock.EXPECT().add(gomock.Any(), "team/AAA", nil, false).Return(packageAdded, nil)
+	registryMock.EXPECT().add(gomock.Any(), "AAA", nil, false).Return(packageAdded, nil)
+
+	cfg := &config{ClientNamespaces: clientNamespaces{"alice": "team"}}
+	action := newAction(zap.NewNop(), cfg, registryMock, &auditLog{sink: zap.NewNop()})
+	alice := withRequest(context.Background(), "alice", "127.0.0.1:1234", "")
+	bob := withRequest(context.Background(), "bob", "127.0.0.1:1235", "")
+	_, err := action.addPackage(alice, "AAA", nil, false)
+	require.NoError(t, err)
+	_, err = action.addPackage(bob, "AAA", nil, false)
+	require.NoError(t, err)
+
+	// confined clients filter by the names of their namespace
+	records, err := action.auditLog(alice, auditFilter{pkgName: "AAA"})
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, []string{"team/AAA"}, records[0].Args)
+	records, err = action.auditLog(withNamespace(bob, "team"), auditFilter{pkgName: "AAA"})
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, "alice", records[0].Identity)
+	records, err = action.auditLog(bob, auditFilter{pkgName: "AAA"})
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, "bob", records[0].Identity)
+
+	_, err = action.auditLog(alice, auditFilter{pkgName: "default/AAA"})
+	assert.EqualError(t, err, "failed querying audit log: permission denied: client alice is confined to namespace team")
+}
@@ -1,7 +1,13 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
+	"os"
+	"time"
 
 	"go.uber.org/zap"
 )
@@ -13,14 +19,66 @@ func main() {
 	}
 	defer logger.Sync()
 
-	config, err := newConfig()
+	config, err := newConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		logger.Fatal("cannot read configs", zap.Error(err))
+	}
+	if config.PrintConfig {
+		fmt.Print(config.redacted())
+		return
+	}
+
+	metrics := newMetrics()
+	audit := newAuditLog(config)
+	defer audit.close()
+
+	memory := newInMemoryStore(metrics, config.SnapshotRetain, config.HistoryRetain, config.NamespaceQuotas)
+	var store registry = memory
+	if config.SQLiteFile != "" {
+		sqlite, err := newSQLiteStore(logger, config, metrics)
+		if err != nil {
+			logger.Fatal("cannot open registry database", zap.String("sqlite_file", config.SQLiteFile), zap.Error(err))
+		}
+		defer sqlite.close()
+		store = sqlite
+	}
+	if config.PrimaryAddr != "" {
+		replica := newReplica(logger, config, memory, metrics)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go replica.run(ctx)
+		store = replica
+	}
+	if config.RaftID != "" {
+		cluster := newClusterStore(logger, config, memory)
+		raftListener, err := cluster.listen()
+		if err != nil {
+			logger.Fatal("cannot listen to raft address", zap.String("raft_addr", config.RaftAddr), zap.Error(err))
+		}
+		if err := cluster.start(raftListener); err != nil {
+			logger.Fatal("cannot start cluster node", zap.String("raft_id", config.RaftID), zap.Error(err))
+		}
+		defer cluster.stop()
+		store = cluster
+	}
+	action := newAction(logger, config, store, audit)
+	pacman := newPacman(logger, config, store, action, audit, metrics)
+
+	admin := newAdmin(logger, config, metrics,
+		readinessCheck{name: "listener", check: pacman.checkListening},
+		readinessCheck{name: "registry", check: store.ready},
+		readinessCheck{name: "tls", check: func() error { return config.checkTLS(time.Now()) }},
+	)
+	adminListener, err := admin.listen()
 	if err != nil {
-		logger.Fatal("cannot read env configs", zap.Error(err))
+		logger.Fatal("cannot listen to admin HTTP address", zap.String("admin_listen", config.AdminListen), zap.Error(err))
 	}
+	go admin.serve(adminListener)
+	defer admin.close()
 
-	store := newInMemoryStore()
-	action := newAction(logger, store)
-	pacman := newPacman(logger, config, store, action)
 	listener, err := pacman.listen()
 	if err != nil {
 		logger.Fatal("cannot listen to TCP address", zap.String("listen", config.Listen), zap.Error(err))
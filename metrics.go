@@ -0,0 +1,174 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	outcomeSuccess = "success"
+	outcomeError   = "error"
+)
+
+// Command label values of lines that aren't a command, the commands they
+// may name are left out to keep the label values bounded.
+const (
+	commandUnknown = "unknown"
+	commandInvalid = "invalid"
+)
+
+// metrics is safe to use as a nil pointer, in which case nothing is recorded.
+type metrics struct {
+	registry            *prometheus.Registry
+	connectionsAccepted prometheus.Counter
+	connectionsClosed   prometheus.Counter
+	commands            *prometheus.CounterVec
+	commandDuration     *prometheus.HistogramVec
+	registryPackages    prometheus.Gauge
+	registryEdges       prometheus.Gauge
+	lockWait            *prometheus.HistogramVec
+	replicationUp       prometheus.Gauge
+	replicationLag      prometheus.Gauge
+	replicationLagTime  prometheus.Gauge
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		connectionsAccepted: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "pacman",
+			Name:      "connections_accepted_total",
+			Help:      "Number of accepted TCP connections.",
+		}),
+		connectionsClosed: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "pacman",
+			Name:      "connections_closed_total",
+			Help:      "Number of closed TCP connections.",
+		}),
+		commands: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "pacman",
+			Name:      "commands_total",
+			Help:      "Number of handled commands by command and outcome.",
+		}, []string{"command", "outcome"}),
+		commandDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "pacman",
+			Name:      "command_duration_seconds",
+			Help:      "Time spent handling a command, including writing the response.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"command"}),
+		registryPackages: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "pacman",
+			Subsystem: "registry",
+			Name:      "packages",
+			Help:      "Number of packages in the registry.",
+		}),
+		registryEdges: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "pacman",
+			Subsystem: "registry",
+			Name:      "edges",
+			Help:      "Number of dependency edges in the registry.",
+		}),
+		lockWait: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "pacman",
+			Subsystem: "registry",
+			Name:      "lock_wait_seconds",
+			Help:      "Time spent waiting to acquire the registry lock.",
+			Buckets:   []float64{.00001, .00005, .0001, .0005, .001, .005, .01, .05, .1, .5, 1},
+		}, []string{"mode"}),
+		replicationUp: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "pacman",
+			Subsystem: "replication",
+			Name:      "connected",
+			Help:      "Whether a follower is streaming from the primary.",
+		}),
+		replicationLag: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "pacman",
+			Subsystem: "replication",
+			Name:      "lag_revisions",
+			Help:      "Number of revisions a follower is behind the primary.",
+		}),
+		replicationLagTime: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "pacman",
+			Subsystem: "replication",
+			Name:      "lag_seconds",
+			Help:      "Time between the primary sending the last replication update and a follower applying it.",
+		}),
+	}
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.connectionsAccepted,
+		m.connectionsClosed,
+		m.commands,
+		m.commandDuration,
+		m.registryPackages,
+		m.registryEdges,
+		m.lockWait,
+		m.replicationUp,
+		m.replicationLag,
+		m.replicationLagTime,
+	)
+	return m
+}
+
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+func (m *metrics) connectionAccepted() {
+	if m == nil {
+		return
+	}
+	m.connectionsAccepted.Inc()
+}
+
+func (m *metrics) connectionClosed() {
+	if m == nil {
+		return
+	}
+	m.connectionsClosed.Inc()
+}
+
+func (m *metrics) observeCommand(command string, start time.Time, failed bool) {
+	if m == nil {
+		return
+	}
+	outcome := outcomeSuccess
+	if failed {
+		outcome = outcomeError
+	}
+	m.commands.WithLabelValues(command, outcome).Inc()
+	m.commandDuration.WithLabelValues(command).Observe(time.Since(start).Seconds())
+}
+
+func (m *metrics) registryChanged(packages, edges int) {
+	if m == nil {
+		return
+	}
+	m.registryPackages.Add(float64(packages))
+	m.registryEdges.Add(float64(edges))
+}
+
+func (m *metrics) observeLockWait(mode string, start time.Time) {
+	if m == nil {
+		return
+	}
+	m.lockWait.WithLabelValues(mode).Observe(time.Since(start).Seconds())
+}
+
+func (m *metrics) replicationChanged(connected bool, lagRevisions, lagSeconds float64) {
+	if m == nil {
+		return
+	}
+	up := 0.0
+	if connected {
+		up = 1
+	}
+	m.replicationUp.Set(up)
+	m.replicationLag.Set(lagRevisions)
+	m.replicationLagTime.Set(lagSeconds)
+}
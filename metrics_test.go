@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsNil(t *testing.T) {
+	t.Parallel()
+
+	var m *metrics
+	assert.NotPanics(t, func() {
+		m.connectionAccepted()
+		m.connectionClosed()
+		m.observeCommand(AddPackage, time.Now(), false)
+		m.registryChanged(1, 1)
+		m.observeLockWait("write", time.Now())
+	})
+}
+
+func TestMetricsObserveCommand(t *testing.T) {
+	t.Parallel()
+
+	m := newMetrics()
+	m.observeCommand(AddPackage, time.Now(), false)
+	m.observeCommand(AddPackage, time.Now(), true)
+	m.observeCommand(AddPackage, time.Now(), true)
+	m.observeCommand(ListPackages, time.Now(), false)
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.commands.WithLabelValues(AddPackage, outcomeSuccess)))
+	assert.Equal(t, float64(2), testutil.ToFloat64(m.commands.WithLabelValues(AddPackage, outcomeError)))
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.commands.WithLabelValues(ListPackages, outcomeSuccess)))
+	assert.Equal(t, 2, testutil.CollectAndCount(m.commandDuration))
+}
+
+func TestMetricsRegistrySize(t *testing.T) {
+	t.Parallel()
+
+	m := newMetrics()
+	store := newInMemoryStore(m, 1, 1, nil)
+	for _, pkg := range []struct {
+		name string
+		deps []string
+	}{
+		{"AAA", nil},
+		{"BBB", []string{"AAA"}},
+		{"CCC", []string{"AAA", "BBB"}},
+	} {
+		_, err := store.add(context.Background(), pkg.name, pkg.deps, false)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, store.remove(context.Background(), "CCC"))
+
+	assert.Equal(t, float64(2), testutil.ToFloat64(m.registryPackages))
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.registryEdges))
+	assert.Equal(t, 1, testutil.CollectAndCount(m.lockWait))
+}
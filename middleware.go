@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// middleware wraps every command run by the router, outermost first.
+type middleware func(next commandFunc) commandFunc
+
+// recovery turns a panic while running a command into an error response,
+// instead of taking the whole process down.
+func recovery(lg *zap.Logger) middleware {
+	return func(next commandFunc) commandFunc {
+		return func(req *request) (err error) {
+			defer func() {
+				if recovered := recover(); recovered != nil {
+					lg.Error("recovered from panic running command",
+						zap.String("command", req.command),
+						zap.Any("panic", recovered),
+						zap.Stack("stack"))
+					err = req.reply(nil, ErrInternal)
+				}
+			}()
+			return next(req)
+		}
+	}
+}
+
+func timing(m *metrics) middleware {
+	return func(next commandFunc) commandFunc {
+		return func(req *request) error {
+			start := time.Now()
+			err := next(req)
+			m.observeCommand(req.command, start, err != nil || req.failed())
+			return err
+		}
+	}
+}
+
+func logging(lg *zap.Logger) middleware {
+	return func(next commandFunc) commandFunc {
+		return func(req *request) error {
+			start := time.Now()
+			err := next(req)
+			outcome := outcomeSuccess
+			if err != nil || req.failed() {
+				outcome = outcomeError
+			}
+			lg.Debug("handled command",
+				zap.String("command", req.command),
+				zap.String("identity", req.identity),
+				zap.String("request_id", requestIDFrom(req.ctx)),
+				zap.Stringer("remote_addr", req.remoteAddr),
+				zap.String("outcome", outcome),
+				zap.Duration("duration", time.Since(start)),
+				zap.Error(err))
+			return err
+		}
+	}
+}
+
+// auditing records audited commands refused before reaching the registry,
+// e.g. for lacking permission or confinement, with the arguments as given.
+// Actions record the commands reaching it themselves, with qualified names.
+func auditing(al *auditLog) middleware {
+	return func(next commandFunc) commandFunc {
+		return func(req *request) error {
+			if !req.audited {
+				return next(req)
+			}
+			ctx, trail := withAuditTrail(req.ctx)
+			req.ctx = ctx
+			err := next(req)
+			if req.failed() && !trail.recorded {
+				var args []string
+				for _, arg := range req.args {
+					if !strings.HasPrefix(arg, "--") {
+						args = append(args, arg)
+					}
+				}
+				al.record(req.ctx, req.command, args, req.failure)
+			}
+			return err
+		}
+	}
+}
+
+func authorization(permissionOf func(identity string) permission) middleware {
+	return func(next commandFunc) commandFunc {
+		return func(req *request) error {
+			if granted := permissionOf(req.identity); granted < req.permission {
+				return req.reply(nil, fmt.Errorf("%w, %s requires %s permission", ErrPermissionDenied, req.command, req.permission))
+			}
+			return next(req)
+		}
+	}
+}
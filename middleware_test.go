@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	gomock "github.com/golang/mock/gomock"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestRouterMiddlewares(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name        string
+		run         commandFunc
+		mock        func(*NetConnMock)
+		wantOutcome string
+		wantError   error
+	}{
+		{
+			name: "success",
+			run: func(req *request) error {
+				return req.reply(message("OK"), nil)
+			},
+			mock: func(conn *NetConnMock) {
+				conn.EXPECT().Write([]byte("\nOK\n")).Return(4, nil)
+			},
+			wantOutcome: outcomeSuccess,
+		},
+		{
+			name: "error response",
+			run: func(req *request) error {
+				return req.reply(nil, errors.New("no such thing"))
+			},
+			mock: func(conn *NetConnMock) {
+				conn.EXPECT().Write([]byte("\nERROR bad_request: no such thing\n")).Return(0, nil)
+			},
+			wantOutcome: outcomeError,
+		},
+		{
+			name: "write failure",
+			run: func(req *request) error {
+				return req.reply(message("OK"), nil)
+			},
+			mock: func(conn *NetConnMock) {
+				conn.EXPECT().Write([]byte("\nOK\n")).Return(0, errors.New("broken pipe"))
+			},
+			wantOutcome: outcomeError,
+			wantError:   errors.New("broken pipe"),
+		},
+		{
+			name: "panic is recovered",
+			run: func(req *request) error {
+				var registry map[string]onePackage
+				registry["AAA"] = onePackage{}
+				return nil
+			},
+			mock: func(conn *NetConnMock) {
+				conn.EXPECT().Write([]byte("\nERROR internal: internal error\n")).Return(0, nil)
+			},
+			wantOutcome: outcomeError,
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			netConnMock := NewNetConnMock(ctrl)
+			tc.mock(netConnMock)
+
+			core, logs := observer.New(zapcore.DebugLevel)
+			logger := zap.New(core)
+			m := newMetrics()
+
+			r := newRouter()
+			r.use(logging(logger), timing(m), recovery(logger))
+			r.register(command{name: "DoThing", usage: "DoThing", run: tc.run})
+
+			err := r.dispatch(&request{
+				ctx:        context.Background(),
+				connection: netConnMock,
+				remoteAddr: new(net.TCPAddr),
+				session:    &session{},
+				identity:   "client",
+				command:    "DoThing",
+			})
+			assert.Equal(t, tc.wantError, err)
+
+			assert.Equal(t, float64(1), testutil.ToFloat64(m.commands.WithLabelValues("DoThing", tc.wantOutcome)))
+
+			handled := logs.FilterMessage("handled command").All()
+			require.Len(t, handled, 1)
+			fields := handled[0].ContextMap()
+			assert.Equal(t, "DoThing", fields["command"])
+			assert.Equal(t, "client", fields["identity"])
+			assert.Equal(t, tc.wantOutcome, fields["outcome"])
+		})
+	}
+}
+
+func TestAuthorization(t *testing.T) {
+	t.Parallel()
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	netConnMock := NewNetConnMock(ctrl)
+	netConnMock.EXPECT().Write([]byte("\nERROR permission_denied: permission denied, AddPackage requires write permission\n")).Return(0, nil)
+
+	var ran int
+	authorize := authorization(func(identity string) permission {
+		if identity == "writer" {
+			return permissionWrite
+		}
+		return permissionRead
+	})
+	run := authorize(func(req *request) error {
+		ran++
+		return nil
+	})
+
+	require.NoError(t, run(&request{connection: netConnMock, identity: "reader", command: AddPackage, permission: permissionWrite}))
+	assert.Equal(t, 0, ran)
+	require.NoError(t, run(&request{connection: netConnMock, identity: "writer", command: AddPackage, permission: permissionWrite}))
+	assert.Equal(t, 1, ran)
+}
+
+func TestAuditing(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name        string
+		audited     bool
+		permission  permission
+		run         commandFunc
+		wantRecords []auditRecord
+	}{
+		{
+			name:       "refused before reaching the registry",
+			audited:    true,
+			permission: permissionWrite,
+			run: func(req *request) error {
+				return req.reply(nil, errors.New("too many dependencies"))
+			},
+			wantRecords: []auditRecord{
+				{Command: AddPackage, Args: []string{"BBB", "AAA"}, Outcome: outcomeError, Error: "too many dependencies"},
+			},
+		},
+		{
+			name:       "permission denied",
+			audited:    true,
+			permission: permissionAdmin,
+			run: func(req *request) error {
+				return req.reply(message("Package added"), nil)
+			},
+			wantRecords: []auditRecord{
+				{Command: AddPackage, Args: []string{"BBB", "AAA"}, Outcome: outcomeError, Error: "permission denied, AddPackage requires admin permission"},
+			},
+		},
+		{
+			name:       "recorded by the action",
+			audited:    true,
+			permission: permissionWrite,
+			run: func(req *request) error {
+				if trail := auditTrailFrom(req.ctx); trail != nil {
+					trail.recorded = true
+				}
+				return req.reply(nil, errors.New("dependency not found"))
+			},
+		},
+		{
+			name:       "succeeded",
+			audited:    true,
+			permission: permissionWrite,
+			run: func(req *request) error {
+				return req.reply(message("Package added"), nil)
+			},
+		},
+		{
+			name:       "not audited",
+			permission: permissionWrite,
+			run: func(req *request) error {
+				return req.reply(nil, errors.New("no such thing"))
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			netConnMock := NewNetConnMock(ctrl)
+			netConnMock.EXPECT().Write(gomock.Any()).Return(0, nil)
+
+			audit := &auditLog{sink: zap.NewNop()}
+			r := newRouter()
+			r.use(auditing(audit), authorization(func(string) permission { return permissionWrite }))
+			r.register(command{name: AddPackage, usage: AddPackage, maxArgs: unlimited, permission: tc.permission, audited: tc.audited, run: tc.run})
+
+			err := r.dispatch(&request{
+				ctx:        withRequest(context.Background(), "client", "127.0.0.1:1234", ""),
+				connection: netConnMock,
+				session:    &session{},
+				identity:   "client",
+				command:    AddPackage,
+				args:       []string{"--upsert", "BBB", "AAA"},
+			})
+			require.NoError(t, err)
+
+			records := audit.query(auditFilter{})
+			for i := range records {
+				assert.Equal(t, "client", records[i].Identity)
+				assert.Equal(t, "127.0.0.1:1234", records[i].RemoteAddr)
+				records[i].Time, records[i].Identity, records[i].RemoteAddr = time.Time{}, "", ""
+			}
+			assert.Equal(t, tc.wantRecords, records)
+		})
+	}
+}
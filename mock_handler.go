@@ -5,8 +5,9 @@
 package main
 
 import (
-	net "net"
+	context "context"
 	reflect "reflect"
+	time "time"
 
 	gomock "github.com/golang/mock/gomock"
 )
@@ -35,53 +36,234 @@ func (m *HandlerMock) EXPECT() *HandlerMockMockRecorder {
 }
 
 // addPackage mocks base method.
-func (m *HandlerMock) addPackage(connection net.Conn, args ...string) error {
+func (m *HandlerMock) addPackage(ctx context.Context, name string, deps []string, upsert bool) (addResult, error) {
 	m.ctrl.T.Helper()
-	varargs := []interface{}{connection}
-	for _, a := range args {
-		varargs = append(varargs, a)
-	}
-	ret := m.ctrl.Call(m, "addPackage", varargs...)
+	ret := m.ctrl.Call(m, "addPackage", ctx, name, deps, upsert)
+	ret0, _ := ret[0].(addResult)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// addPackage indicates an expected call of addPackage.
+func (mr *HandlerMockMockRecorder) addPackage(ctx, name, deps, upsert interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "addPackage", reflect.TypeOf((*HandlerMock)(nil).addPackage), ctx, name, deps, upsert)
+}
+
+// auditLog mocks base method.
+func (m *HandlerMock) auditLog(ctx context.Context, filter auditFilter) (auditRecords, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "auditLog", ctx, filter)
+	ret0, _ := ret[0].(auditRecords)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// auditLog indicates an expected call of auditLog.
+func (mr *HandlerMockMockRecorder) auditLog(ctx, filter interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "auditLog", reflect.TypeOf((*HandlerMock)(nil).auditLog), ctx, filter)
+}
+
+// checkGraph mocks base method.
+func (m *HandlerMock) checkGraph(ctx context.Context) (graphProblems, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "checkGraph", ctx)
+	ret0, _ := ret[0].(graphProblems)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// checkGraph indicates an expected call of checkGraph.
+func (mr *HandlerMockMockRecorder) checkGraph(ctx interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "checkGraph", reflect.TypeOf((*HandlerMock)(nil).checkGraph), ctx)
+}
+
+// createGroup mocks base method.
+func (m *HandlerMock) createGroup(ctx context.Context, name string, members []string, upsert bool) (addResult, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "createGroup", ctx, name, members, upsert)
+	ret0, _ := ret[0].(addResult)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// createGroup indicates an expected call of createGroup.
+func (mr *HandlerMockMockRecorder) createGroup(ctx, name, members, upsert interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "createGroup", reflect.TypeOf((*HandlerMock)(nil).createGroup), ctx, name, members, upsert)
+}
+
+// getPackage mocks base method.
+func (m *HandlerMock) getPackage(ctx context.Context, name string, rev uint64) (packageInfo, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "getPackage", ctx, name, rev)
+	ret0, _ := ret[0].(packageInfo)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// getPackage indicates an expected call of getPackage.
+func (mr *HandlerMockMockRecorder) getPackage(ctx, name, rev interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "getPackage", reflect.TypeOf((*HandlerMock)(nil).getPackage), ctx, name, rev)
+}
+
+// joinCluster mocks base method.
+func (m *HandlerMock) joinCluster(ctx context.Context, id, addr string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "joinCluster", ctx, id, addr)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
-// addPackage indicates an expected call of addPackage.
-func (mr *HandlerMockMockRecorder) addPackage(connection interface{}, args ...interface{}) *gomock.Call {
+// joinCluster indicates an expected call of joinCluster.
+func (mr *HandlerMockMockRecorder) joinCluster(ctx, id, addr interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	varargs := append([]interface{}{connection}, args...)
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "addPackage", reflect.TypeOf((*HandlerMock)(nil).addPackage), varargs...)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "joinCluster", reflect.TypeOf((*HandlerMock)(nil).joinCluster), ctx, id, addr)
 }
 
-// listPackages mocks base method.
-func (m *HandlerMock) listPackages(connection net.Conn) error {
+// leaveCluster mocks base method.
+func (m *HandlerMock) leaveCluster(ctx context.Context, id string) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "listPackages", connection)
+	ret := m.ctrl.Call(m, "leaveCluster", ctx, id)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
+// leaveCluster indicates an expected call of leaveCluster.
+func (mr *HandlerMockMockRecorder) leaveCluster(ctx, id interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "leaveCluster", reflect.TypeOf((*HandlerMock)(nil).leaveCluster), ctx, id)
+}
+
+// listPackages mocks base method.
+func (m *HandlerMock) listPackages(ctx context.Context, rev uint64) (packageList, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "listPackages", ctx, rev)
+	ret0, _ := ret[0].(packageList)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
 // listPackages indicates an expected call of listPackages.
-func (mr *HandlerMockMockRecorder) listPackages(connection interface{}) *gomock.Call {
+func (mr *HandlerMockMockRecorder) listPackages(ctx, rev interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "listPackages", reflect.TypeOf((*HandlerMock)(nil).listPackages), ctx, rev)
+}
+
+// packageHistory mocks base method.
+func (m *HandlerMock) packageHistory(ctx context.Context, name string) (packageHistory, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "packageHistory", ctx, name)
+	ret0, _ := ret[0].(packageHistory)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// packageHistory indicates an expected call of packageHistory.
+func (mr *HandlerMockMockRecorder) packageHistory(ctx, name interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "listPackages", reflect.TypeOf((*HandlerMock)(nil).listPackages), connection)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "packageHistory", reflect.TypeOf((*HandlerMock)(nil).packageHistory), ctx, name)
+}
+
+// ping mocks base method.
+func (m *HandlerMock) ping(ctx context.Context) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ping", ctx)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ping indicates an expected call of ping.
+func (mr *HandlerMockMockRecorder) ping(ctx interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ping", reflect.TypeOf((*HandlerMock)(nil).ping), ctx)
 }
 
 // removePackage mocks base method.
-func (m *HandlerMock) removePackage(connection net.Conn, args ...string) error {
+func (m *HandlerMock) removePackage(ctx context.Context, name string) error {
 	m.ctrl.T.Helper()
-	varargs := []interface{}{connection}
-	for _, a := range args {
-		varargs = append(varargs, a)
-	}
-	ret := m.ctrl.Call(m, "removePackage", varargs...)
+	ret := m.ctrl.Call(m, "removePackage", ctx, name)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
 // removePackage indicates an expected call of removePackage.
-func (mr *HandlerMockMockRecorder) removePackage(connection interface{}, args ...interface{}) *gomock.Call {
+func (mr *HandlerMockMockRecorder) removePackage(ctx, name interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "removePackage", reflect.TypeOf((*HandlerMock)(nil).removePackage), ctx, name)
+}
+
+// replicate mocks base method.
+func (m *HandlerMock) replicate(ctx context.Context, generation string, rev uint64, send func(replicationUpdate) error) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "replicate", ctx, generation, rev, send)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// replicate indicates an expected call of replicate.
+func (mr *HandlerMockMockRecorder) replicate(ctx, generation, rev, send interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "replicate", reflect.TypeOf((*HandlerMock)(nil).replicate), ctx, generation, rev, send)
+}
+
+// replication mocks base method.
+func (m *HandlerMock) replication(ctx context.Context) replicationStatus {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "replication", ctx)
+	ret0, _ := ret[0].(replicationStatus)
+	return ret0
+}
+
+// replication indicates an expected call of replication.
+func (mr *HandlerMockMockRecorder) replication(ctx interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "replication", reflect.TypeOf((*HandlerMock)(nil).replication), ctx)
+}
+
+// revert mocks base method.
+func (m *HandlerMock) revert(ctx context.Context, target revertTarget) (revertResult, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "revert", ctx, target)
+	ret0, _ := ret[0].(revertResult)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// revert indicates an expected call of revert.
+func (mr *HandlerMockMockRecorder) revert(ctx, target interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "revert", reflect.TypeOf((*HandlerMock)(nil).revert), ctx, target)
+}
+
+// revision mocks base method.
+func (m *HandlerMock) revision(ctx context.Context) revisionInfo {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "revision", ctx)
+	ret0, _ := ret[0].(revisionInfo)
+	return ret0
+}
+
+// revision indicates an expected call of revision.
+func (mr *HandlerMockMockRecorder) revision(ctx interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "revision", reflect.TypeOf((*HandlerMock)(nil).revision), ctx)
+}
+
+// revisionAt mocks base method.
+func (m *HandlerMock) revisionAt(ctx context.Context, at time.Time) (revisionInfo, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "revisionAt", ctx, at)
+	ret0, _ := ret[0].(revisionInfo)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// revisionAt indicates an expected call of revisionAt.
+func (mr *HandlerMockMockRecorder) revisionAt(ctx, at interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	varargs := append([]interface{}{connection}, args...)
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "removePackage", reflect.TypeOf((*HandlerMock)(nil).removePackage), varargs...)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "revisionAt", reflect.TypeOf((*HandlerMock)(nil).revisionAt), ctx, at)
 }
@@ -5,7 +5,9 @@
 package main
 
 import (
+	context "context"
 	reflect "reflect"
+	time "time"
 
 	gomock "github.com/golang/mock/gomock"
 )
@@ -34,43 +36,234 @@ func (m *RegistryMock) EXPECT() *RegistryMockMockRecorder {
 }
 
 // add mocks base method.
-func (m *RegistryMock) add(name string, deps []string) error {
+func (m *RegistryMock) add(ctx context.Context, name string, deps []string, upsert bool) (addResult, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "add", name, deps)
+	ret := m.ctrl.Call(m, "add", ctx, name, deps, upsert)
+	ret0, _ := ret[0].(addResult)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// add indicates an expected call of add.
+func (mr *RegistryMockMockRecorder) add(ctx, name, deps, upsert interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "add", reflect.TypeOf((*RegistryMock)(nil).add), ctx, name, deps, upsert)
+}
+
+// check mocks base method.
+func (m *RegistryMock) check(ctx context.Context) ([]string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "check", ctx)
+	ret0, _ := ret[0].([]string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// check indicates an expected call of check.
+func (mr *RegistryMockMockRecorder) check(ctx interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "check", reflect.TypeOf((*RegistryMock)(nil).check), ctx)
+}
+
+// createGroup mocks base method.
+func (m *RegistryMock) createGroup(ctx context.Context, name string, members []string, upsert bool) (addResult, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "createGroup", ctx, name, members, upsert)
+	ret0, _ := ret[0].(addResult)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// createGroup indicates an expected call of createGroup.
+func (mr *RegistryMockMockRecorder) createGroup(ctx, name, members, upsert interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "createGroup", reflect.TypeOf((*RegistryMock)(nil).createGroup), ctx, name, members, upsert)
+}
+
+// follow mocks base method.
+func (m *RegistryMock) follow(generation string, rev uint64) (replicationUpdate, <-chan struct{}) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "follow", generation, rev)
+	ret0, _ := ret[0].(replicationUpdate)
+	ret1, _ := ret[1].(<-chan struct{})
+	return ret0, ret1
+}
+
+// follow indicates an expected call of follow.
+func (mr *RegistryMockMockRecorder) follow(generation, rev interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "follow", reflect.TypeOf((*RegistryMock)(nil).follow), generation, rev)
+}
+
+// get mocks base method.
+func (m *RegistryMock) get(ctx context.Context, name string, rev uint64) (packageInfo, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "get", ctx, name, rev)
+	ret0, _ := ret[0].(packageInfo)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// get indicates an expected call of get.
+func (mr *RegistryMockMockRecorder) get(ctx, name, rev interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "get", reflect.TypeOf((*RegistryMock)(nil).get), ctx, name, rev)
+}
+
+// join mocks base method.
+func (m *RegistryMock) join(ctx context.Context, id, addr string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "join", ctx, id, addr)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
-// add indicates an expected call of add.
-func (mr *RegistryMockMockRecorder) add(name, deps interface{}) *gomock.Call {
+// join indicates an expected call of join.
+func (mr *RegistryMockMockRecorder) join(ctx, id, addr interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "add", reflect.TypeOf((*RegistryMock)(nil).add), name, deps)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "join", reflect.TypeOf((*RegistryMock)(nil).join), ctx, id, addr)
 }
 
-// list mocks base method.
-func (m *RegistryMock) list() string {
+// leave mocks base method.
+func (m *RegistryMock) leave(ctx context.Context, id string) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "list")
-	ret0, _ := ret[0].(string)
+	ret := m.ctrl.Call(m, "leave", ctx, id)
+	ret0, _ := ret[0].(error)
 	return ret0
 }
 
+// leave indicates an expected call of leave.
+func (mr *RegistryMockMockRecorder) leave(ctx, id interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "leave", reflect.TypeOf((*RegistryMock)(nil).leave), ctx, id)
+}
+
+// list mocks base method.
+func (m *RegistryMock) list(ctx context.Context, rev uint64) ([]packageInfo, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "list", ctx, rev)
+	ret0, _ := ret[0].([]packageInfo)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
 // list indicates an expected call of list.
-func (mr *RegistryMockMockRecorder) list() *gomock.Call {
+func (mr *RegistryMockMockRecorder) list(ctx, rev interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "list", reflect.TypeOf((*RegistryMock)(nil).list), ctx, rev)
+}
+
+// names mocks base method.
+func (m *RegistryMock) names(ctx context.Context) []string {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "names", ctx)
+	ret0, _ := ret[0].([]string)
+	return ret0
+}
+
+// names indicates an expected call of names.
+func (mr *RegistryMockMockRecorder) names(ctx interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "names", reflect.TypeOf((*RegistryMock)(nil).names), ctx)
+}
+
+// packageHistory mocks base method.
+func (m *RegistryMock) packageHistory(ctx context.Context, name string) (packageHistory, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "packageHistory", ctx, name)
+	ret0, _ := ret[0].(packageHistory)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// packageHistory indicates an expected call of packageHistory.
+func (mr *RegistryMockMockRecorder) packageHistory(ctx, name interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "packageHistory", reflect.TypeOf((*RegistryMock)(nil).packageHistory), ctx, name)
+}
+
+// ready mocks base method.
+func (m *RegistryMock) ready() error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ready")
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ready indicates an expected call of ready.
+func (mr *RegistryMockMockRecorder) ready() *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "list", reflect.TypeOf((*RegistryMock)(nil).list))
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ready", reflect.TypeOf((*RegistryMock)(nil).ready))
 }
 
 // remove mocks base method.
-func (m *RegistryMock) remove(name string) error {
+func (m *RegistryMock) remove(ctx context.Context, name string) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "remove", name)
+	ret := m.ctrl.Call(m, "remove", ctx, name)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
 // remove indicates an expected call of remove.
-func (mr *RegistryMockMockRecorder) remove(name interface{}) *gomock.Call {
+func (mr *RegistryMockMockRecorder) remove(ctx, name interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "remove", reflect.TypeOf((*RegistryMock)(nil).remove), ctx, name)
+}
+
+// replication mocks base method.
+func (m *RegistryMock) replication() replicationStatus {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "replication")
+	ret0, _ := ret[0].(replicationStatus)
+	return ret0
+}
+
+// replication indicates an expected call of replication.
+func (mr *RegistryMockMockRecorder) replication() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "replication", reflect.TypeOf((*RegistryMock)(nil).replication))
+}
+
+// revert mocks base method.
+func (m *RegistryMock) revert(ctx context.Context, target revertTarget) (revertResult, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "revert", ctx, target)
+	ret0, _ := ret[0].(revertResult)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// revert indicates an expected call of revert.
+func (mr *RegistryMockMockRecorder) revert(ctx, target interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "revert", reflect.TypeOf((*RegistryMock)(nil).revert), ctx, target)
+}
+
+// revision mocks base method.
+func (m *RegistryMock) revision(ctx context.Context) uint64 {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "revision", ctx)
+	ret0, _ := ret[0].(uint64)
+	return ret0
+}
+
+// revision indicates an expected call of revision.
+func (mr *RegistryMockMockRecorder) revision(ctx interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "revision", reflect.TypeOf((*RegistryMock)(nil).revision), ctx)
+}
+
+// revisionAt mocks base method.
+func (m *RegistryMock) revisionAt(ctx context.Context, at time.Time) (uint64, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "revisionAt", ctx, at)
+	ret0, _ := ret[0].(uint64)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// revisionAt indicates an expected call of revisionAt.
+func (mr *RegistryMockMockRecorder) revisionAt(ctx, at interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "remove", reflect.TypeOf((*RegistryMock)(nil).remove), name)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "revisionAt", reflect.TypeOf((*RegistryMock)(nil).revisionAt), ctx, at)
 }
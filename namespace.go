@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// defaultNamespace holds the packages named without a namespace, which keep
+// their bare names in the registry. Packages of other namespaces are kept
+// as ns/name.
+const defaultNamespace = "default"
+
+const maxNamespaceLength = 64
+
+// validateNamespace accepts names made of letters, digits and ._- that start
+// and end with a letter or digit.
+func validateNamespace(ns string) error {
+	if ns == "" {
+		return fmt.Errorf("invalid namespace %q: it is empty", ns)
+	}
+	if n := utf8.RuneCountInString(ns); n > maxNamespaceLength {
+		return fmt.Errorf("invalid namespace %q: it is %d characters long, at most %d allowed", ns, n, maxNamespaceLength)
+	}
+	for i, r := range ns {
+		alphanumeric := r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9'
+		if (i == 0 || i == len(ns)-1) && !alphanumeric {
+			return fmt.Errorf("invalid namespace %q: it must start and end with a letter or digit", ns)
+		}
+		if !alphanumeric && !strings.ContainsRune("._-", r) {
+			return fmt.Errorf("invalid namespace %q: it contains invalid character %q", ns, r)
+		}
+	}
+	return nil
+}
+
+// splitName returns the namespace and the name of a package as kept in the
+// registry.
+func splitName(name string) (string, string) {
+	if ns, bare, qualified := cut(name, "/"); qualified {
+		return ns, bare
+	}
+	return defaultNamespace, name
+}
+
+func namespaceOf(name string) string {
+	ns, _ := splitName(name)
+	return ns
+}
+
+// qualify returns the registry name of a package named from ns, where names
+// of other namespaces are given as ns/name.
+func qualify(ns, name string) string {
+	if pkgNs, bare, qualified := cut(name, "/"); qualified {
+		ns, name = pkgNs, bare
+	}
+	if ns == defaultNamespace {
+		return name
+	}
+	return ns + "/" + name
+}
+
+// relative returns the name of a package as seen from ns, the inverse of
+// qualify.
+func relative(ns, name string) string {
+	pkgNs, bare := splitName(name)
+	if pkgNs == ns {
+		return bare
+	}
+	return pkgNs + "/" + bare
+}
+
+// relativeNames returns the names as seen from ns, sorted again as names of
+// other namespaces sort apart from the others.
+func relativeNames(ns string, names []string) []string {
+	if names == nil {
+		return nil
+	}
+	rel := make([]string, 0, len(names))
+	for _, name := range names {
+		rel = append(rel, relative(ns, name))
+	}
+	sort.Strings(rel)
+	return rel
+}
+
+func (pkg packageInfo) relative(ns string) packageInfo {
+	return packageInfo{
+		Name:       relative(ns, pkg.Name),
+		Group:      pkg.Group,
+		DependsOn:  relativeNames(ns, pkg.DependsOn),
+		RequiredBy: relativeNames(ns, pkg.RequiredBy),
+	}
+}
+
+func (history packageHistory) relative(ns string) packageHistory {
+	rel := packageHistory{Name: relative(ns, history.Name), Changes: make([]packageChange, 0, len(history.Changes))}
+	for _, c := range history.Changes {
+		c.DependsOn = relativeNames(ns, c.DependsOn)
+		rel.Changes = append(rel.Changes, c)
+	}
+	return rel
+}
+
+// namespacePrefix takes the optional namespace prefix, a token starting with
+// @, off the tokenized command line.
+func namespacePrefix(segments []string) (string, []string, error) {
+	if len(segments) == 0 || !strings.HasPrefix(segments[0], "@") {
+		return "", segments, nil
+	}
+	ns := segments[0][1:]
+	if err := validateNamespace(ns); err != nil {
+		return "", segments[1:], err
+	}
+	return ns, segments[1:], nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateNamespace(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		given     string
+		wantError error
+	}{
+		{
+			name:  "letters, digits and punctuation",
+			given: "team-1.dev_a",
+		},
+		{
+			name:      "empty",
+			given:     "",
+			wantError: errors.New(`invalid namespace "": it is empty`),
+		},
+		{
+			name:      "too long",
+			given:     strings.Repeat("a", maxNamespaceLength+1),
+			wantError: errors.New(`invalid namespace "` + strings.Repeat("a", maxNamespaceLength+1) + `": it is 65 characters long, at most 64 allowed`),
+		},
+		{
+			name:      "trailing punctuation",
+			given:     "team.",
+			wantError: errors.New(`invalid namespace "team.": it must start and end with a letter or digit`),
+		},
+		{
+			name:      "invalid character",
+			given:     "te/am",
+			wantError: errors.New(`invalid namespace "te/am": it contains invalid character '/'`),
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			err := validateNamespace(tc.given)
+			if tc.wantError != nil {
+				assert.EqualError(t, err, tc.wantError.Error())
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestQualify(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		givenNs   string
+		givenName string
+		want      string
+	}{
+		{
+			name:      "default namespace keeps bare names",
+			givenNs:   defaultNamespace,
+			givenName: "AAA",
+			want:      "AAA",
+		},
+		{
+			name:      "other namespace",
+			givenNs:   "team",
+			givenName: "AAA",
+			want:      "team/AAA",
+		},
+		{
+			name:      "explicit namespace",
+			givenNs:   "team",
+			givenName: "other/AAA",
+			want:      "other/AAA",
+		},
+		{
+			name:      "explicit default namespace",
+			givenNs:   "team",
+			givenName: "default/AAA",
+			want:      "AAA",
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			qualified := qualify(tc.givenNs, tc.givenName)
+			assert.Equal(t, tc.want, qualified)
+			assert.Equal(t, qualified, qualify(tc.givenNs, relative(tc.givenNs, qualified)))
+		})
+	}
+}
+
+func TestNamespacePrefix(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name         string
+		given        []string
+		wantNs       string
+		wantSegments []string
+		wantError    string
+	}{
+		{
+			name:         "no prefix",
+			given:        []string{"ListPackages"},
+			wantSegments: []string{"ListPackages"},
+		},
+		{
+			name:         "prefixed",
+			given:        []string{"@team", "GetPackage", "AAA"},
+			wantNs:       "team",
+			wantSegments: []string{"GetPackage", "AAA"},
+		},
+		{
+			name:         "invalid namespace",
+			given:        []string{"@", "ListPackages"},
+			wantSegments: []string{"ListPackages"},
+			wantError:    `invalid namespace "": it is empty`,
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			ns, segments, err := namespacePrefix(tc.given)
+			if tc.wantError != "" {
+				assert.EqualError(t, err, tc.wantError)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tc.wantNs, ns)
+			assert.Equal(t, tc.wantSegments, segments)
+		})
+	}
+}
@@ -2,34 +2,61 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
-	"io"
+	"errors"
+	"fmt"
 	"net"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
+	"go.uber.org/atomic"
 	"go.uber.org/zap"
 )
 
 type pacman struct {
-	logger   *zap.Logger
-	config   *config
-	registry registry
-	handler  handler
-	shutdown chan os.Signal
+	logger    *zap.Logger
+	config    *config
+	registry  registry
+	handler   handler
+	router    *router
+	metrics   *metrics
+	shutdown  chan os.Signal
+	listening *atomic.Bool
+	// ctx is the parent of every connection's context, cancelled by stop
+	// when shutdown starts
+	ctx  context.Context
+	stop context.CancelFunc
 }
 
-func newPacman(lg *zap.Logger, cfg *config, reg registry, hdl handler) pacman {
-	return pacman{
-		logger:   lg,
-		config:   cfg,
-		registry: reg,
-		handler:  hdl,
-		shutdown: make(chan os.Signal, 1),
+func newPacman(lg *zap.Logger, cfg *config, reg registry, hdl handler, al *auditLog, m *metrics) pacman {
+	ctx, stop := context.WithCancel(context.Background())
+	p := pacman{
+		logger:    lg,
+		config:    cfg,
+		registry:  reg,
+		handler:   hdl,
+		router:    newRouter(),
+		metrics:   m,
+		shutdown:  make(chan os.Signal, 1),
+		listening: atomic.NewBool(false),
+		ctx:       ctx,
+		stop:      stop,
 	}
+	p.router.use(
+		logging(lg),
+		timing(m),
+		auditing(al),
+		authorization(cfg.permissionOf),
+		recovery(lg),
+	)
+	p.registerCommands()
+	return p
 }
 
 func (p pacman) listen() (net.Listener, error) {
@@ -47,8 +74,11 @@ func (p pacman) listen() (net.Listener, error) {
 func (p pacman) serve(listener net.Listener) {
 	listenField := zap.String("listen", p.config.Listen)
 	p.logger.Info("TCP service started", listenField)
+	p.listening.Store(true)
 
 	defer func() {
+		p.listening.Store(false)
+		p.stop()
 		_ = listener.Close()
 		p.logger.Info("stopped listening TCP address", listenField)
 	}()
@@ -90,63 +120,519 @@ func (p pacman) serve(listener net.Listener) {
 	<-p.shutdown
 }
 
-const (
-	AddPackage    = "AddPackage"
-	RemovePackage = "RemovePackage"
-	ListPackages  = "ListPackages"
+func (p pacman) checkListening() error {
+	if !p.listening.Load() {
+		return errors.New("not accepting TCP connections")
+	}
+	return nil
+}
 
-	MaxLineLenBytes  = 1024
-	ReadWriteTimeout = time.Minute
+const (
+	AddPackage     = "AddPackage"
+	CreateGroup    = "CreateGroup"
+	RemovePackage  = "RemovePackage"
+	Revert         = "Revert"
+	ListPackages   = "ListPackages"
+	GetPackage     = "GetPackage"
+	PackageHistory = "PackageHistory"
+	Ping           = "Ping"
+	AuditLog       = "AuditLog"
+	CheckGraph     = "CheckGraph"
+	Revision       = "Revision"
+	Replicate      = "Replicate"
+	Replication    = "Replication"
+	JoinCluster    = "JoinCluster"
+	LeaveCluster   = "LeaveCluster"
+	Help           = "Help"
+	Interactive    = "Interactive"
+	Quit           = "Quit"
+	Format         = "Format"
 )
 
-func (p pacman) handle(connection net.Conn) {
-	addrField := zap.Stringer("remote_addr", connection.RemoteAddr())
+func (p pacman) registerCommands() {
+	p.router.register(command{
+		name:        AddPackage,
+		usage:       "AddPackage [--upsert] name [dep ...]",
+		description: "add a package depending on existing packages",
+		minArgs:     1,
+		maxArgs:     unlimited,
+		permission:  permissionWrite,
+		audited:     true,
+		run: func(req *request) error {
+			upsert, args, err := parseUpsert(req.args)
+			if err != nil {
+				return req.reply(nil, err)
+			}
+			if len(args) == 0 {
+				return req.reply(nil, errors.New("no package name"))
+			}
+			result, err := p.handler.addPackage(req.ctx, args[0], args[1:], upsert)
+			return req.reply(addedMessages[result], err)
+		},
+	})
+	p.router.register(command{
+		name:        CreateGroup,
+		usage:       "CreateGroup [--upsert] name member ...",
+		description: "create a group of packages, which packages depending on it depend on instead",
+		minArgs:     2,
+		maxArgs:     unlimited,
+		permission:  permissionWrite,
+		audited:     true,
+		run: func(req *request) error {
+			upsert, args, err := parseUpsert(req.args)
+			if err != nil {
+				return req.reply(nil, err)
+			}
+			if len(args) < 2 {
+				return req.reply(nil, errors.New("expecting a group name and its members"))
+			}
+			result, err := p.handler.createGroup(req.ctx, args[0], args[1:], upsert)
+			return req.reply(groupMessages[result], err)
+		},
+	})
+	p.router.register(command{
+		name:        RemovePackage,
+		usage:       "RemovePackage name",
+		description: "remove a package no other package depends on",
+		minArgs:     1,
+		maxArgs:     1,
+		permission:  permissionWrite,
+		audited:     true,
+		run: func(req *request) error {
+			err := p.handler.removePackage(req.ctx, req.args[0])
+			return req.reply(message("Package removed"), err)
+		},
+	})
+	p.router.register(command{
+		name:        Revert,
+		usage:       "Revert last=count|to=revision",
+		description: "undo the latest changes, or every change after a revision, all or none",
+		minArgs:     1,
+		maxArgs:     1,
+		permission:  permissionWrite,
+		audited:     true,
+		run: func(req *request) error {
+			target, err := parseRevertTarget(req.args[0])
+			if err != nil {
+				return req.reply(nil, err)
+			}
+			reverted, err := p.handler.revert(req.ctx, target)
+			return req.reply(reverted, err)
+		},
+	})
+	p.router.register(command{
+		name:        ListPackages,
+		usage:       "ListPackages [at=revision|time]",
+		description: "list packages and their dependency trees",
+		maxArgs:     1,
+		permission:  permissionRead,
+		readOnly:    true,
+		run: func(req *request) error {
+			rev, err := p.readRevision(req, req.args)
+			if err != nil {
+				return req.reply(nil, err)
+			}
+			pkgs, err := p.handler.listPackages(req.ctx, rev)
+			return req.reply(pkgs, err)
+		},
+	})
+	p.router.register(command{
+		name:        GetPackage,
+		usage:       "GetPackage name [at=revision|time]",
+		description: "show a package, its dependencies and what requires it",
+		minArgs:     1,
+		maxArgs:     2,
+		permission:  permissionRead,
+		readOnly:    true,
+		run: func(req *request) error {
+			rev, err := p.readRevision(req, req.args[1:])
+			if err != nil {
+				return req.reply(nil, err)
+			}
+			pkg, err := p.handler.getPackage(req.ctx, req.args[0], rev)
+			return req.reply(pkg, err)
+		},
+	})
+	p.router.register(command{
+		name:        PackageHistory,
+		usage:       "PackageHistory name",
+		description: "show the retained changes of a package, even once removed",
+		minArgs:     1,
+		maxArgs:     1,
+		permission:  permissionRead,
+		readOnly:    true,
+		run: func(req *request) error {
+			history, err := p.handler.packageHistory(req.ctx, req.args[0])
+			return req.reply(history, err)
+		},
+	})
+	p.router.register(command{
+		name:        Revision,
+		usage:       "Revision [at=time]",
+		description: "show the latest registry revision or the one at a time, to read at with at=revision",
+		maxArgs:     1,
+		permission:  permissionRead,
+		readOnly:    true,
+		run: func(req *request) error {
+			rev, at, err := parseReadAt(req.args)
+			if err == nil && rev != latestRevision {
+				err = fmt.Errorf("invalid argument %q, expecting at=time", req.args[0])
+			}
+			if err != nil {
+				return req.reply(nil, err)
+			}
+			if !at.IsZero() {
+				info, err := p.handler.revisionAt(req.ctx, at)
+				return req.reply(info, err)
+			}
+			return req.reply(p.handler.revision(req.ctx), nil)
+		},
+	})
+	p.router.register(command{
+		name:        AuditLog,
+		usage:       "AuditLog [since=time] [until=time] [package=name]",
+		description: "query the audit log of registry mutations",
+		maxArgs:     3,
+		permission:  permissionAdmin,
+		readOnly:    true,
+		run: func(req *request) error {
+			filter, err := parseAuditFilter(req.args)
+			if err != nil {
+				return req.reply(nil, err)
+			}
+			records, err := p.handler.auditLog(req.ctx, filter)
+			return req.reply(records, err)
+		},
+	})
+	p.router.register(command{
+		name:        CheckGraph,
+		usage:       "CheckGraph",
+		description: "check every dependency has a matching back-reference",
+		permission:  permissionAdmin,
+		readOnly:    true,
+		run: func(req *request) error {
+			problems, err := p.handler.checkGraph(req.ctx)
+			return req.reply(problems, err)
+		},
+	})
+	p.router.register(command{
+		name:        Replicate,
+		usage:       "Replicate [generation revision]",
+		description: "stream the registry to a follower",
+		maxArgs:     2,
+		permission:  permissionAdmin,
+		run: func(req *request) error {
+			generation, rev, err := parseReplicate(req.args)
+			if err != nil {
+				return req.reply(nil, err)
+			}
+			err = p.handler.replicate(req.ctx, generation, rev, func(update replicationUpdate) error {
+				return writeResponse(req.connection, formatJSON, update, nil)
+			})
+			if req.ctx.Err() == nil {
+				// the follower is gone
+				return err
+			}
+			return req.reply(nil, err)
+		},
+	})
+	p.router.register(command{
+		name:        Replication,
+		usage:       "Replication",
+		description: "show whether this is the primary, how far behind it a follower is, or the cluster state",
+		permission:  permissionRead,
+		readOnly:    true,
+		run: func(req *request) error {
+			return req.reply(p.handler.replication(req.ctx), nil)
+		},
+	})
+	p.router.register(command{
+		name:        JoinCluster,
+		usage:       "JoinCluster id address",
+		description: "add a node to the cluster by its Raft address",
+		minArgs:     2,
+		maxArgs:     2,
+		permission:  permissionAdmin,
+		audited:     true,
+		run: func(req *request) error {
+			err := p.handler.joinCluster(req.ctx, req.args[0], req.args[1])
+			return req.reply(message("Cluster member added"), err)
+		},
+	})
+	p.router.register(command{
+		name:        LeaveCluster,
+		usage:       "LeaveCluster id",
+		description: "remove a node from the cluster",
+		minArgs:     1,
+		maxArgs:     1,
+		permission:  permissionAdmin,
+		audited:     true,
+		run: func(req *request) error {
+			err := p.handler.leaveCluster(req.ctx, req.args[0])
+			return req.reply(message("Cluster member removed"), err)
+		},
+	})
+	p.router.register(command{
+		name:        Ping,
+		usage:       "Ping",
+		description: "check the server is responding",
+		permission:  permissionRead,
+		readOnly:    true,
+		run: func(req *request) error {
+			return req.reply(message("PONG"), p.handler.ping(req.ctx))
+		},
+	})
+	p.router.register(command{
+		name:        Help,
+		usage:       "Help",
+		description: "list commands and their syntax",
+		permission:  permissionRead,
+		readOnly:    true,
+		run:         p.help,
+	})
+	p.router.register(command{
+		name:        Interactive,
+		usage:       "Interactive [on|off]",
+		description: "turn the interactive prompt on or off",
+		maxArgs:     1,
+		permission:  permissionRead,
+		run:         interactive,
+	})
+	p.router.register(command{
+		name:        Quit,
+		usage:       "Quit",
+		description: "close the connection",
+		permission:  permissionRead,
+		run:         quit,
+	})
+	p.router.register(command{
+		name:        Format,
+		usage:       "Format [text|json]",
+		description: "show or change the output format of responses",
+		maxArgs:     1,
+		permission:  permissionRead,
+		run:         format,
+	})
+}
+
+func (p pacman) handle(netConn net.Conn) {
+	remoteAddr := netConn.RemoteAddr()
+	addrField := zap.Stringer("remote_addr", remoteAddr)
 	p.logger.Info("accepted TCP connection", addrField)
+	p.metrics.connectionAccepted()
 
 	defer func() {
-		_ = connection.Close()
+		_ = netConn.Close()
 		p.logger.Info("closed TCP connection", addrField)
+		p.metrics.connectionClosed()
 	}()
 
+	ctx, cancel := context.WithCancel(p.ctx)
+	defer cancel()
+
 	done := make(chan bool)
-	_ = connection.SetReadDeadline(time.Now().Add(ReadWriteTimeout))
+	connection := newTimeoutConn(netConn, p.config)
 
 	go func() {
-		limited := &io.LimitedReader{
-			R: connection,
-			N: MaxLineLenBytes,
-		}
-		scanner := bufio.NewScanner(limited)
+		var (
+			pipelined   sync.WaitGroup
+			slots       = make(chan struct{}, maxInt(p.config.MaxPipelined, 1))
+			writeFailed = atomic.NewBool(false)
+			state       = &session{}
+		)
+		scanner := bufio.NewScanner(connection)
+		scanner.Buffer(make([]byte, 0, minInt(p.config.MaxLineLength, bufio.MaxScanTokenSize)), p.config.MaxLineLength)
 		for scanner.Scan() {
+			if connection.readFailed() {
+				// the line was cut short, e.g. by a read timeout
+				break
+			}
 			var err error
-			input := scanner.Text()
-			segments := strings.Split(input, " ")
-			if len(segments) == 0 {
-				_, err = connection.Write([]byte("\nERROR: input is empty\n"))
+			segments, tokenizeErr := tokenize(scanner.Text())
+			id, segments, idErr := requestID(segments)
+			ns, segments, nsErr := namespacePrefix(segments)
+			responder := &requestConn{timeoutConn: connection, id: id}
+			lineErr := firstError(tokenizeErr, idErr, nsErr)
+			if lineErr == nil && len(segments) == 0 {
+				lineErr = errors.New("input is empty")
+			}
+			if lineErr != nil {
+				// lines that aren't a command never reach the router
+				p.metrics.observeCommand(commandInvalid, time.Now(), true)
+				err = writeResponse(responder, state.format, nil, lineErr)
+			} else if req := p.newRequest(ctx, responder, remoteAddr, id, ns, state, segments); id != "" && p.isReadOnly(req.command) {
+				slots <- struct{}{}
+				pipelined.Add(1)
+				go func() {
+					defer func() {
+						<-slots
+						pipelined.Done()
+					}()
+					if err := p.router.dispatch(req); err != nil {
+						p.logger.Error("cannot write TCP response", zap.Error(err))
+						writeFailed.Store(true)
+					}
+				}()
 			} else {
-				action, args := segments[0], segments[1:]
-				switch action {
-				case AddPackage:
-					err = p.handler.addPackage(connection, args...)
-				case RemovePackage:
-					err = p.handler.removePackage(connection, args...)
-				case ListPackages:
-					err = p.handler.listPackages(connection)
-				default:
-					_, err = connection.Write([]byte("\nERROR: unknown action\n"))
-				}
+				pipelined.Wait()
+				err = p.router.dispatch(req)
 			}
 			if err != nil {
 				p.logger.Error("cannot write TCP response", zap.Error(err))
+				writeFailed.Store(true)
 				break
 			}
-			// reset remaining bytes left in the LimitReader
-			limited.N = MaxLineLenBytes
-			// reset read deadline
-			_ = connection.SetReadDeadline(time.Now().Add(ReadWriteTimeout))
+			if writeFailed.Load() || state.quit {
+				break
+			}
+			if state.interactive {
+				pipelined.Wait()
+				if _, err := connection.Write([]byte(prompt)); err != nil {
+					p.logger.Error("cannot write TCP response", zap.Error(err))
+					break
+				}
+			}
+			connection.commandDone()
+		}
+		if connection.readFailed() || writeFailed.Load() {
+			// the client is gone, stop pipelined commands still running
+			cancel()
+		}
+		pipelined.Wait()
+		if err := scanner.Err(); err != nil {
+			p.closeWithError(connection, state.format, err, addrField)
 		}
 		done <- true
 	}()
 
 	<-done
 }
+
+func (p pacman) newRequest(ctx context.Context, connection net.Conn, remoteAddr net.Addr, id, ns string, state *session, segments []string) *request {
+	identity := clientIdentity(connection)
+	return &request{
+		ctx:        withNamespace(withRequest(ctx, identity, remoteAddr.String(), id), ns),
+		connection: connection,
+		remoteAddr: remoteAddr,
+		session:    state,
+		identity:   identity,
+		command:    segments[0],
+		args:       segments[1:],
+	}
+}
+
+func (p pacman) isReadOnly(name string) bool {
+	cmd, found := p.router.lookup(name)
+	return found && cmd.readOnly
+}
+
+func (p pacman) help(req *request) error {
+	return req.reply(message(p.router.help()), nil)
+}
+
+func (p pacman) closeWithError(connection *timeoutConn, format outputFormat, err error, addrField zap.Field) {
+	var reason error
+	if errors.Is(err, bufio.ErrTooLong) {
+		reason = fmt.Errorf("line exceeds %d bytes", p.config.MaxLineLength)
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		if connection.isIdle() {
+			reason = fmt.Errorf("idle %w of %s exceeded", ErrTimeout, p.config.IdleTimeout)
+		} else {
+			reason = fmt.Errorf("read %w of %s exceeded", ErrTimeout, p.config.ReadTimeout)
+		}
+	} else {
+		p.logger.Error("cannot read TCP request", addrField, zap.Error(err))
+		return
+	}
+	p.logger.Info("closing TCP connection", addrField, zap.Error(reason))
+	_ = writeResponse(connection, format, nil, reason)
+}
+
+// parseReadAt reads the optional at=revision or at=time argument of read
+// commands, latestRevision and no time when it's not given.
+func parseReadAt(args []string) (uint64, time.Time, error) {
+	if len(args) == 0 {
+		return latestRevision, time.Time{}, nil
+	}
+	key, value, ok := cut(args[0], "=")
+	if !ok || key != "at" {
+		return latestRevision, time.Time{}, fmt.Errorf("invalid argument %q, expecting at=revision or at=time", args[0])
+	}
+	if at, err := time.Parse(time.RFC3339, value); err == nil {
+		return latestRevision, at, nil
+	}
+	rev, err := strconv.ParseUint(value, 10, 64)
+	if err != nil || rev == latestRevision {
+		return latestRevision, time.Time{}, fmt.Errorf("invalid revision %q, expecting a positive number or an RFC 3339 time", value)
+	}
+	return rev, time.Time{}, nil
+}
+
+// parseUpsert takes the --upsert flag off the arguments of a command adding
+// a package or group.
+func parseUpsert(args []string) (bool, []string, error) {
+	upsert := false
+	for len(args) > 0 && strings.HasPrefix(args[0], "--") {
+		if args[0] != "--upsert" {
+			return false, nil, fmt.Errorf("unknown flag %s", args[0])
+		}
+		upsert, args = true, args[1:]
+	}
+	return upsert, args, nil
+}
+
+func parseRevertTarget(arg string) (revertTarget, error) {
+	key, value, ok := cut(arg, "=")
+	if !ok || (key != "last" && key != "to") {
+		return revertTarget{}, fmt.Errorf("invalid argument %q, expecting last=count or to=revision", arg)
+	}
+	n, err := strconv.ParseUint(value, 10, 64)
+	if err != nil || n == 0 {
+		return revertTarget{}, fmt.Errorf("invalid %s %q, expecting a positive number", key, value)
+	}
+	if key == "last" {
+		return revertTarget{Last: n}, nil
+	}
+	return revertTarget{Revision: n}, nil
+}
+
+// readRevision resolves the optional at= argument of read commands to a
+// revision.
+func (p pacman) readRevision(req *request, args []string) (uint64, error) {
+	rev, at, err := parseReadAt(args)
+	if err != nil || at.IsZero() {
+		return rev, err
+	}
+	info, err := p.handler.revisionAt(req.ctx, at)
+	return info.Revision, err
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func minUint64(a, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func firstError(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,16 +1,24 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"os"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	gomock "github.com/golang/mock/gomock"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
 	"go.uber.org/zap"
 )
 
@@ -105,9 +113,8 @@ func TestPacmanServe(t *testing.T) {
 			name: "handle listner accept errors",
 			mock: func(sig chan os.Signal, conn *NetConnMock, lis *NetListenerMock) {
 				conn.EXPECT().RemoteAddr().Return(new(net.TCPAddr)).AnyTimes()
-				conn.EXPECT().SetReadDeadline(gomock.Any()).AnyTimes()
 				conn.EXPECT().Read(gomock.Any()).Return(0, io.EOF).AnyTimes()
-				conn.EXPECT().Write([]byte("\nERROR: unknown action\n")).Return(0, nil).AnyTimes()
+				conn.EXPECT().Write([]byte("\nERROR unknown_command: unknown action\n")).Return(0, nil).AnyTimes()
 				conn.EXPECT().Close().Return(nil).AnyTimes()
 				lis.EXPECT().Accept().Return(conn, nil).AnyTimes()
 				lis.EXPECT().Close().Return(nil)
@@ -129,12 +136,18 @@ func TestPacmanServe(t *testing.T) {
 			netListenerMock := NewNetListenerMock(ctrl)
 			tc.mock(shutdown, netConnMock, netListenerMock)
 
+			ctx, stop := context.WithCancel(context.Background())
 			p := pacman{
-				logger:   zap.NewNop(),
-				config:   &config{},
-				shutdown: shutdown,
+				logger:    zap.NewNop(),
+				config:    &config{MaxLineLength: 1024},
+				shutdown:  shutdown,
+				listening: atomic.NewBool(false),
+				ctx:       ctx,
+				stop:      stop,
 			}
 			p.serve(netListenerMock)
+			assert.EqualError(t, p.checkListening(), "not accepting TCP connections")
+			assert.Equal(t, context.Canceled, ctx.Err())
 		})
 	}
 }
@@ -143,62 +156,479 @@ func TestPacmanHandle(t *testing.T) {
 	t.Parallel()
 
 	tests := []struct {
-		name string
-		mock func(*NetConnMock, *HandlerMock)
+		name        string
+		givenConfig *config
+		mock        func(*NetConnMock, *HandlerMock)
 	}{
 		{
 			name: "add package",
 			mock: func(conn *NetConnMock, hdl *HandlerMock) {
 				conn.EXPECT().RemoteAddr().Return(new(net.TCPAddr))
-				conn.EXPECT().SetReadDeadline(gomock.Any()).Times(2)
 				conn.EXPECT().Read(gomock.Any()).DoAndReturn(func(p []byte) (n int, err error) {
 					data := []byte("AddPackage CCC AAA BBB")
 					n = copy(p, data[:])
 					return n, io.EOF
 				})
 				conn.EXPECT().Close().Return(nil)
-				hdl.EXPECT().addPackage(conn, []string{"CCC", "AAA", "BBB"}).Return(nil)
+				hdl.EXPECT().addPackage(gomock.Any(), "CCC", []string{"AAA", "BBB"}, false).Return(packageAdded, nil)
+				conn.EXPECT().Write([]byte("\nPackage added\n")).Return(0, nil)
+			},
+		},
+		{
+			name: "add package with upsert",
+			mock: func(conn *NetConnMock, hdl *HandlerMock) {
+				conn.EXPECT().RemoteAddr().Return(new(net.TCPAddr))
+				conn.EXPECT().Read(gomock.Any()).DoAndReturn(func(p []byte) (n int, err error) {
+					data := []byte("AddPackage --upsert CCC AAA")
+					n = copy(p, data[:])
+					return n, io.EOF
+				})
+				conn.EXPECT().Close().Return(nil)
+				hdl.EXPECT().addPackage(gomock.Any(), "CCC", []string{"AAA"}, true).Return(packageUpdated, nil)
+				conn.EXPECT().Write([]byte("\nPackage dependencies replaced\n")).Return(0, nil)
+			},
+		},
+		{
+			name: "add package unchanged",
+			mock: func(conn *NetConnMock, hdl *HandlerMock) {
+				conn.EXPECT().RemoteAddr().Return(new(net.TCPAddr))
+				conn.EXPECT().Read(gomock.Any()).DoAndReturn(func(p []byte) (n int, err error) {
+					data := []byte("AddPackage CCC AAA")
+					n = copy(p, data[:])
+					return n, io.EOF
+				})
+				conn.EXPECT().Close().Return(nil)
+				hdl.EXPECT().addPackage(gomock.Any(), "CCC", []string{"AAA"}, false).Return(packageUnchanged, nil)
+				conn.EXPECT().Write([]byte("\nPackage already exists with the same dependencies\n")).Return(0, nil)
+			},
+		},
+		{
+			name: "read at a revision",
+			mock: func(conn *NetConnMock, hdl *HandlerMock) {
+				conn.EXPECT().RemoteAddr().Return(new(net.TCPAddr))
+				conn.EXPECT().Read(gomock.Any()).DoAndReturn(func(p []byte) (n int, err error) {
+					data := []byte("Revision\nGetPackage CCC at=7\nListPackages at=seven\n")
+					n = copy(p, data[:])
+					return n, io.EOF
+				})
+				gomock.InOrder(
+					hdl.EXPECT().revision(gomock.Any()).Return(revisionInfo{Revision: 7}),
+					conn.EXPECT().Write([]byte("\nRevision 7\n")).Return(0, nil),
+					hdl.EXPECT().getPackage(gomock.Any(), "CCC", uint64(7)).Return(packageInfo{Name: "CCC"}, nil),
+					conn.EXPECT().Write([]byte("\nPackage CCC\n- Depends on: none\n- Required by: none\n")).Return(0, nil),
+					conn.EXPECT().Write([]byte("\nERROR bad_request: invalid revision \"seven\", expecting a positive number or an RFC 3339 time\n")).Return(0, nil),
+				)
+				conn.EXPECT().Close().Return(nil)
+			},
+		},
+		{
+			name: "read at a time",
+			mock: func(conn *NetConnMock, hdl *HandlerMock) {
+				conn.EXPECT().RemoteAddr().Return(new(net.TCPAddr))
+				conn.EXPECT().Read(gomock.Any()).DoAndReturn(func(p []byte) (n int, err error) {
+					data := []byte("Revision at=2026-10-18T12:00:00Z\nListPackages at=2026-10-18T12:00:00+02:00\nRevision at=7\nPackageHistory AAA\n")
+					n = copy(p, data[:])
+					return n, io.EOF
+				})
+				at := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+				local, _ := time.Parse(time.RFC3339, "2026-10-18T12:00:00+02:00")
+				gomock.InOrder(
+					hdl.EXPECT().revisionAt(gomock.Any(), at).Return(revisionInfo{Revision: 7}, nil),
+					conn.EXPECT().Write([]byte("\nRevision 7\n")).Return(0, nil),
+					hdl.EXPECT().revisionAt(gomock.Any(), local).Return(revisionInfo{Revision: 5}, nil),
+					hdl.EXPECT().listPackages(gomock.Any(), uint64(5)).Return(packageList{}, nil),
+					conn.EXPECT().Write([]byte("\nPackages and Dependencies\n- No packages found\n")).Return(0, nil),
+					conn.EXPECT().Write([]byte("\nERROR bad_request: invalid argument \"at=7\", expecting at=time\n")).Return(0, nil),
+					hdl.EXPECT().packageHistory(gomock.Any(), "AAA").Return(packageHistory{Name: "AAA", Changes: []packageChange{
+						{Revision: 2, Time: at, Op: packageWasAdded, DependsOn: []string{}},
+					}}, nil),
+					conn.EXPECT().Write([]byte("\nPackage AAA History\n- Revision 2 at 2026-10-18T12:00:00Z: added, depends on: none\n")).Return(0, nil),
+				)
+				conn.EXPECT().Close().Return(nil)
+			},
+		},
+		{
+			name: "replication",
+			mock: func(conn *NetConnMock, hdl *HandlerMock) {
+				conn.EXPECT().RemoteAddr().Return(new(net.TCPAddr))
+				conn.EXPECT().Read(gomock.Any()).DoAndReturn(func(p []byte) (n int, err error) {
+					data := []byte("Replication\nReplicate gen\n")
+					n = copy(p, data[:])
+					return n, io.EOF
+				})
+				gomock.InOrder(
+					hdl.EXPECT().replication(gomock.Any()).Return(replicationStatus{Role: rolePrimary, Revision: 3}),
+					conn.EXPECT().Write([]byte("\nReplication\n- Role: primary\n- Revision: 3\n")).Return(0, nil),
+					conn.EXPECT().Write([]byte("\nERROR bad_request: expecting both a generation and a revision\n")).Return(0, nil),
+				)
+				conn.EXPECT().Close().Return(nil)
+			},
+		},
+		{
+			name: "cluster membership",
+			mock: func(conn *NetConnMock, hdl *HandlerMock) {
+				conn.EXPECT().RemoteAddr().Return(new(net.TCPAddr))
+				conn.EXPECT().Read(gomock.Any()).DoAndReturn(func(p []byte) (n int, err error) {
+					data := []byte("JoinCluster n2 10.0.0.2:9200\nLeaveCluster n3\nJoinCluster n4\n")
+					n = copy(p, data[:])
+					return n, io.EOF
+				})
+				gomock.InOrder(
+					hdl.EXPECT().joinCluster(gomock.Any(), "n2", "10.0.0.2:9200").Return(nil),
+					conn.EXPECT().Write([]byte("\nCluster member added\n")).Return(0, nil),
+					hdl.EXPECT().leaveCluster(gomock.Any(), "n3").Return(fmt.Errorf("failed removing cluster member: %w, start it with a raft node ID", ErrNotClustered)),
+					conn.EXPECT().Write([]byte("\nERROR not_clustered: failed removing cluster member: not a cluster node, start it with a raft node ID\n")).Return(0, nil),
+					conn.EXPECT().Write(gomock.Any()).DoAndReturn(func(p []byte) (int, error) {
+						assert.Contains(t, string(p), "usage: JoinCluster id address")
+						return 0, nil
+					}),
+				)
+				conn.EXPECT().Close().Return(nil)
+			},
+		},
+		{
+			name: "check graph",
+			mock: func(conn *NetConnMock, hdl *HandlerMock) {
+				conn.EXPECT().RemoteAddr().Return(new(net.TCPAddr))
+				conn.EXPECT().Read(gomock.Any()).DoAndReturn(func(p []byte) (n int, err error) {
+					data := []byte("CheckGraph")
+					n = copy(p, data[:])
+					return n, io.EOF
+				})
+				conn.EXPECT().Close().Return(nil)
+				hdl.EXPECT().checkGraph(gomock.Any()).Return(graphProblems(nil), nil)
+				conn.EXPECT().Write([]byte("\nGraph Check\n- No problems found\n")).Return(0, nil)
+			},
+		},
+		{
+			name: "add package with unknown flag",
+			mock: func(conn *NetConnMock, hdl *HandlerMock) {
+				conn.EXPECT().RemoteAddr().Return(new(net.TCPAddr))
+				conn.EXPECT().Read(gomock.Any()).DoAndReturn(func(p []byte) (n int, err error) {
+					data := []byte("AddPackage --force CCC")
+					n = copy(p, data[:])
+					return n, io.EOF
+				})
+				conn.EXPECT().Close().Return(nil)
+				conn.EXPECT().Write([]byte("\nERROR bad_request: unknown flag --force\n")).Return(0, nil)
+			},
+		},
+		{
+			name: "add package with quoted name and extra whitespace",
+			mock: func(conn *NetConnMock, hdl *HandlerMock) {
+				conn.EXPECT().RemoteAddr().Return(new(net.TCPAddr))
+				conn.EXPECT().Read(gomock.Any()).DoAndReturn(func(p []byte) (n int, err error) {
+					data := []byte("AddPackage  \"my package\"\tAAA\r\n")
+					n = copy(p, data[:])
+					return n, io.EOF
+				})
+				conn.EXPECT().Close().Return(nil)
+				hdl.EXPECT().addPackage(gomock.Any(), "my package", []string{"AAA"}, false).Return(packageAdded, nil)
+				conn.EXPECT().Write([]byte("\nPackage added\n")).Return(0, nil)
+			},
+		},
+		{
+			name: "unterminated quote",
+			mock: func(conn *NetConnMock, hdl *HandlerMock) {
+				conn.EXPECT().RemoteAddr().Return(new(net.TCPAddr))
+				conn.EXPECT().Read(gomock.Any()).DoAndReturn(func(p []byte) (n int, err error) {
+					data := []byte("AddPackage \"my package")
+					n = copy(p, data[:])
+					return n, io.EOF
+				})
+				conn.EXPECT().Write([]byte("\nERROR bad_request: unterminated quoted argument\n")).Return(0, nil)
+				conn.EXPECT().Close().Return(nil)
+			},
+		},
+		{
+			name: "empty input",
+			mock: func(conn *NetConnMock, hdl *HandlerMock) {
+				conn.EXPECT().RemoteAddr().Return(new(net.TCPAddr))
+				conn.EXPECT().Read(gomock.Any()).DoAndReturn(func(p []byte) (n int, err error) {
+					data := []byte(" \t \r\n")
+					n = copy(p, data[:])
+					return n, io.EOF
+				})
+				conn.EXPECT().Write([]byte("\nERROR bad_request: input is empty\n")).Return(0, nil)
+				conn.EXPECT().Close().Return(nil)
 			},
 		},
 		{
 			name: "remove package",
 			mock: func(conn *NetConnMock, hdl *HandlerMock) {
 				conn.EXPECT().RemoteAddr().Return(new(net.TCPAddr))
-				conn.EXPECT().SetReadDeadline(gomock.Any()).Times(2)
 				conn.EXPECT().Read(gomock.Any()).DoAndReturn(func(p []byte) (n int, err error) {
 					data := []byte("RemovePackage CCC")
 					n = copy(p, data[:])
 					return n, io.EOF
 				})
 				conn.EXPECT().Close().Return(nil)
-				hdl.EXPECT().removePackage(conn, []string{"CCC"}).Return(nil)
+				hdl.EXPECT().removePackage(gomock.Any(), "CCC").Return(nil)
+				conn.EXPECT().Write([]byte("\nPackage removed\n")).Return(0, nil)
+			},
+		},
+		{
+			name: "revert",
+			mock: func(conn *NetConnMock, hdl *HandlerMock) {
+				conn.EXPECT().RemoteAddr().Return(new(net.TCPAddr))
+				conn.EXPECT().Read(gomock.Any()).DoAndReturn(func(p []byte) (n int, err error) {
+					data := []byte("Revert last=2\nRevert to=4\nRevert to=0\nRevert 4\n")
+					n = copy(p, data[:])
+					return n, io.EOF
+				})
+				gomock.InOrder(
+					hdl.EXPECT().revert(gomock.Any(), revertTarget{Last: 2}).Return(revertResult{To: 6, Changes: 2, Revision: 10}, nil),
+					conn.EXPECT().Write([]byte("\nReverted to revision 6 with 2 changes, now at revision 10\n")).Return(0, nil),
+					hdl.EXPECT().revert(gomock.Any(), revertTarget{Revision: 4}).Return(revertResult{}, fmt.Errorf("failed reverting: %w 4: the oldest retained revision is 5", ErrUnknownRevision)),
+					conn.EXPECT().Write([]byte("\nERROR unknown_revision: failed reverting: unknown revision 4: the oldest retained revision is 5\n")).Return(0, nil),
+					conn.EXPECT().Write([]byte("\nERROR bad_request: invalid to \"0\", expecting a positive number\n")).Return(0, nil),
+					conn.EXPECT().Write([]byte("\nERROR bad_request: invalid argument \"4\", expecting last=count or to=revision\n")).Return(0, nil),
+				)
+				conn.EXPECT().Close().Return(nil)
+			},
+		},
+		{
+			name: "create group",
+			mock: func(conn *NetConnMock, hdl *HandlerMock) {
+				conn.EXPECT().RemoteAddr().Return(new(net.TCPAddr))
+				conn.EXPECT().Read(gomock.Any()).DoAndReturn(func(p []byte) (n int, err error) {
+					data := []byte("CreateGroup base AAA BBB\nCreateGroup --upsert base AAA\nCreateGroup --upsert base\nCreateGroup base\n")
+					n = copy(p, data[:])
+					return n, io.EOF
+				})
+				gomock.InOrder(
+					hdl.EXPECT().createGroup(gomock.Any(), "base", []string{"AAA", "BBB"}, false).Return(packageAdded, nil),
+					conn.EXPECT().Write([]byte("\nGroup created\n")).Return(0, nil),
+					hdl.EXPECT().createGroup(gomock.Any(), "base", []string{"AAA"}, true).Return(packageUpdated, nil),
+					conn.EXPECT().Write([]byte("\nGroup members replaced\n")).Return(0, nil),
+					conn.EXPECT().Write([]byte("\nERROR bad_request: expecting a group name and its members\n")).Return(0, nil),
+					conn.EXPECT().Write([]byte("\nERROR bad_request: CreateGroup expects at least 2 arguments, usage: CreateGroup [--upsert] name member ...\n")).Return(0, nil),
+				)
+				conn.EXPECT().Close().Return(nil)
+			},
+		},
+		{
+			name: "namespace prefix",
+			mock: func(conn *NetConnMock, hdl *HandlerMock) {
+				conn.EXPECT().RemoteAddr().Return(new(net.TCPAddr))
+				conn.EXPECT().Read(gomock.Any()).DoAndReturn(func(p []byte) (n int, err error) {
+					data := []byte("@team GetPackage AAA\nGetPackage AAA\n@te/am ListPackages\n")
+					n = copy(p, data[:])
+					return n, io.EOF
+				})
+				gomock.InOrder(
+					hdl.EXPECT().getPackage(namespaceMatcher{ns: "team"}, "AAA", latestRevision).Return(packageInfo{Name: "AAA"}, nil),
+					conn.EXPECT().Write([]byte("\nPackage AAA\n- Depends on: none\n- Required by: none\n")).Return(0, nil),
+					hdl.EXPECT().getPackage(namespaceMatcher{}, "AAA", latestRevision).Return(packageInfo{Name: "AAA"}, nil),
+					conn.EXPECT().Write([]byte("\nPackage AAA\n- Depends on: none\n- Required by: none\n")).Return(0, nil),
+					conn.EXPECT().Write([]byte("\nERROR bad_request: invalid namespace \"te/am\": it contains invalid character '/'\n")).Return(0, nil),
+				)
+				conn.EXPECT().Close().Return(nil)
 			},
 		},
 		{
 			name: "list package",
 			mock: func(conn *NetConnMock, hdl *HandlerMock) {
 				conn.EXPECT().RemoteAddr().Return(new(net.TCPAddr))
-				conn.EXPECT().SetReadDeadline(gomock.Any()).Times(2)
 				conn.EXPECT().Read(gomock.Any()).DoAndReturn(func(p []byte) (n int, err error) {
 					data := []byte("ListPackages")
 					n = copy(p, data[:])
 					return n, io.EOF
 				})
 				conn.EXPECT().Close().Return(nil)
-				hdl.EXPECT().listPackages(conn).Return(nil)
+				hdl.EXPECT().listPackages(gomock.Any(), latestRevision).Return(packageList{{Name: "AAA"}}, nil)
+				conn.EXPECT().Write([]byte("\nPackages and Dependencies\n- AAA\n")).Return(0, nil)
+			},
+		},
+		{
+			name: "ping",
+			mock: func(conn *NetConnMock, hdl *HandlerMock) {
+				conn.EXPECT().RemoteAddr().Return(new(net.TCPAddr))
+				conn.EXPECT().Read(gomock.Any()).DoAndReturn(func(p []byte) (n int, err error) {
+					data := []byte("Ping")
+					n = copy(p, data[:])
+					return n, io.EOF
+				})
+				conn.EXPECT().Close().Return(nil)
+				hdl.EXPECT().ping(gomock.Any()).Return(nil)
+				conn.EXPECT().Write([]byte("\nPONG\n")).Return(0, nil)
+			},
+		},
+		{
+			name: "get package",
+			mock: func(conn *NetConnMock, hdl *HandlerMock) {
+				conn.EXPECT().RemoteAddr().Return(new(net.TCPAddr))
+				conn.EXPECT().Read(gomock.Any()).DoAndReturn(func(p []byte) (n int, err error) {
+					data := []byte("GetPackage CCC")
+					n = copy(p, data[:])
+					return n, io.EOF
+				})
+				conn.EXPECT().Close().Return(nil)
+				hdl.EXPECT().getPackage(gomock.Any(), "CCC", latestRevision).Return(packageInfo{Name: "CCC"}, nil)
+				conn.EXPECT().Write([]byte("\nPackage CCC\n- Depends on: none\n- Required by: none\n")).Return(0, nil)
+			},
+		},
+		{
+			name: "json output format",
+			mock: func(conn *NetConnMock, hdl *HandlerMock) {
+				conn.EXPECT().RemoteAddr().Return(new(net.TCPAddr))
+				conn.EXPECT().Read(gomock.Any()).DoAndReturn(func(p []byte) (n int, err error) {
+					data := []byte("Format json\nGetPackage CCC\nRemovePackage DDD\nGetPackage\n")
+					n = copy(p, data[:])
+					return n, io.EOF
+				})
+				gomock.InOrder(
+					conn.EXPECT().Write([]byte("\n{\"result\":\"Output format is json\"}\n")).Return(0, nil),
+					hdl.EXPECT().getPackage(gomock.Any(), "CCC", latestRevision).Return(packageInfo{Name: "CCC", DependsOn: []string{"AAA"}, RequiredBy: []string{}}, nil),
+					conn.EXPECT().Write([]byte("\n{\"result\":{\"name\":\"CCC\",\"depends_on\":[\"AAA\"],\"required_by\":[]}}\n")).Return(0, nil),
+					hdl.EXPECT().removePackage(gomock.Any(), "DDD").Return(fmt.Errorf("failed removing package: %w", fmt.Errorf("%w: DDD", ErrNotFound))),
+					conn.EXPECT().Write([]byte("\n{\"error\":\"failed removing package: package not exists: DDD\",\"code\":\"not_found\"}\n")).Return(0, nil),
+					conn.EXPECT().Write([]byte("\n{\"error\":\"GetPackage expects at least 1 argument, usage: GetPackage name [at=revision|time]\",\"code\":\"bad_request\"}\n")).Return(0, nil),
+				)
+				conn.EXPECT().Close().Return(nil)
+			},
+		},
+		{
+			name: "invalid request ID",
+			mock: func(conn *NetConnMock, hdl *HandlerMock) {
+				conn.EXPECT().RemoteAddr().Return(new(net.TCPAddr))
+				conn.EXPECT().Read(gomock.Any()).DoAndReturn(func(p []byte) (n int, err error) {
+					data := []byte("# Ping")
+					n = copy(p, data[:])
+					return n, io.EOF
+				})
+				conn.EXPECT().Write([]byte("\nERROR bad_request: request ID must be 1 to 64 characters\n")).Return(0, nil)
+				conn.EXPECT().Close().Return(nil)
+			},
+		},
+		{
+			name: "unknown action with request ID",
+			mock: func(conn *NetConnMock, hdl *HandlerMock) {
+				conn.EXPECT().RemoteAddr().Return(new(net.TCPAddr))
+				conn.EXPECT().Read(gomock.Any()).DoAndReturn(func(p []byte) (n int, err error) {
+					data := []byte("#7 UnkownAction")
+					n = copy(p, data[:])
+					return n, io.EOF
+				})
+				conn.EXPECT().Write([]byte("\n#7 ERROR unknown_command: unknown action\n")).Return(0, nil)
+				conn.EXPECT().Close().Return(nil)
+			},
+		},
+		{
+			name: "case insensitive action",
+			mock: func(conn *NetConnMock, hdl *HandlerMock) {
+				conn.EXPECT().RemoteAddr().Return(new(net.TCPAddr))
+				conn.EXPECT().Read(gomock.Any()).DoAndReturn(func(p []byte) (n int, err error) {
+					data := []byte("removepackage CCC")
+					n = copy(p, data[:])
+					return n, io.EOF
+				})
+				conn.EXPECT().Close().Return(nil)
+				hdl.EXPECT().removePackage(gomock.Any(), "CCC").Return(nil)
+				conn.EXPECT().Write([]byte("\nPackage removed\n")).Return(0, nil)
+			},
+		},
+		{
+			name:        "permission denied",
+			givenConfig: &config{MaxLineLength: 1024, DefaultPermission: "read"},
+			mock: func(conn *NetConnMock, hdl *HandlerMock) {
+				conn.EXPECT().RemoteAddr().Return(new(net.TCPAddr))
+				conn.EXPECT().Read(gomock.Any()).DoAndReturn(func(p []byte) (n int, err error) {
+					data := []byte("RemovePackage CCC")
+					n = copy(p, data[:])
+					return n, io.EOF
+				})
+				conn.EXPECT().Write([]byte("\nERROR permission_denied: permission denied, RemovePackage requires write permission\n")).Return(0, nil)
+				conn.EXPECT().Close().Return(nil)
+			},
+		},
+		{
+			name: "invalid number of arguments",
+			mock: func(conn *NetConnMock, hdl *HandlerMock) {
+				conn.EXPECT().RemoteAddr().Return(new(net.TCPAddr))
+				conn.EXPECT().Read(gomock.Any()).DoAndReturn(func(p []byte) (n int, err error) {
+					data := []byte("RemovePackage")
+					n = copy(p, data[:])
+					return n, io.EOF
+				})
+				conn.EXPECT().Write([]byte("\nERROR bad_request: RemovePackage expects 1 argument, usage: RemovePackage name\n")).Return(0, nil)
+				conn.EXPECT().Close().Return(nil)
+			},
+		},
+		{
+			name: "misspelled action",
+			mock: func(conn *NetConnMock, hdl *HandlerMock) {
+				conn.EXPECT().RemoteAddr().Return(new(net.TCPAddr))
+				conn.EXPECT().Read(gomock.Any()).DoAndReturn(func(p []byte) (n int, err error) {
+					data := []byte("RemovePakage CCC")
+					n = copy(p, data[:])
+					return n, io.EOF
+				})
+				conn.EXPECT().Write([]byte("\nERROR unknown_command: unknown action, did you mean RemovePackage?\n")).Return(0, nil)
+				conn.EXPECT().Close().Return(nil)
+			},
+		},
+		{
+			name: "help",
+			mock: func(conn *NetConnMock, hdl *HandlerMock) {
+				conn.EXPECT().RemoteAddr().Return(new(net.TCPAddr))
+				conn.EXPECT().Read(gomock.Any()).DoAndReturn(func(p []byte) (n int, err error) {
+					data := []byte("help")
+					n = copy(p, data[:])
+					return n, io.EOF
+				})
+				help := newPacman(zap.NewNop(), &config{}, nil, nil, nil, nil).router.help()
+				conn.EXPECT().Write([]byte("\n"+help+"\n")).Return(0, nil)
+				conn.EXPECT().Close().Return(nil)
+			},
+		},
+		{
+			name: "quit stops reading further commands",
+			mock: func(conn *NetConnMock, hdl *HandlerMock) {
+				conn.EXPECT().RemoteAddr().Return(new(net.TCPAddr))
+				conn.EXPECT().Read(gomock.Any()).DoAndReturn(func(p []byte) (n int, err error) {
+					data := []byte("Quit\nRemovePackage CCC\n")
+					n = copy(p, data[:])
+					return n, nil
+				})
+				conn.EXPECT().Write([]byte("\nBye\n")).Return(0, nil)
+				conn.EXPECT().Close().Return(nil)
+			},
+		},
+		{
+			name: "interactive mode prompts after every command",
+			mock: func(conn *NetConnMock, hdl *HandlerMock) {
+				conn.EXPECT().RemoteAddr().Return(new(net.TCPAddr))
+				conn.EXPECT().Read(gomock.Any()).DoAndReturn(func(p []byte) (n int, err error) {
+					data := []byte("Interactive\nPing\nInteractive maybe\nInteractive off\nPing\n")
+					n = copy(p, data[:])
+					return n, io.EOF
+				})
+				gomock.InOrder(
+					conn.EXPECT().Write([]byte("\nInteractive mode on, type Help for commands and Quit to exit\n")).Return(0, nil),
+					conn.EXPECT().Write([]byte(prompt)).Return(0, nil),
+					hdl.EXPECT().ping(gomock.Any()).Return(nil),
+					conn.EXPECT().Write([]byte("\nPONG\n")).Return(0, nil),
+					conn.EXPECT().Write([]byte(prompt)).Return(0, nil),
+					conn.EXPECT().Write([]byte("\nERROR bad_request: expecting on or off\n")).Return(0, nil),
+					conn.EXPECT().Write([]byte(prompt)).Return(0, nil),
+					conn.EXPECT().Write([]byte("\nInteractive mode off\n")).Return(0, nil),
+					hdl.EXPECT().ping(gomock.Any()).Return(nil),
+					conn.EXPECT().Write([]byte("\nPONG\n")).Return(0, nil),
+				)
+				conn.EXPECT().Close().Return(nil)
 			},
 		},
 		{
 			name: "unknown action",
 			mock: func(conn *NetConnMock, hdl *HandlerMock) {
 				conn.EXPECT().RemoteAddr().Return(new(net.TCPAddr))
-				conn.EXPECT().SetReadDeadline(gomock.Any()).Times(2)
 				conn.EXPECT().Read(gomock.Any()).DoAndReturn(func(p []byte) (n int, err error) {
 					data := []byte("UnkownAction")
 					n = copy(p, data[:])
 					return n, io.EOF
 				})
-				conn.EXPECT().Write([]byte("\nERROR: unknown action\n")).Return(0, nil)
+				conn.EXPECT().Write([]byte("\nERROR unknown_command: unknown action\n")).Return(0, nil)
 				conn.EXPECT().Close().Return(nil)
 			},
 		},
@@ -206,13 +636,55 @@ func TestPacmanHandle(t *testing.T) {
 			name: "unknown action and error writing to connection",
 			mock: func(conn *NetConnMock, hdl *HandlerMock) {
 				conn.EXPECT().RemoteAddr().Return(new(net.TCPAddr))
-				conn.EXPECT().SetReadDeadline(gomock.Any())
 				conn.EXPECT().Read(gomock.Any()).DoAndReturn(func(p []byte) (n int, err error) {
 					data := []byte("UnkownAction")
 					n = copy(p, data[:])
 					return n, io.EOF
 				})
-				conn.EXPECT().Write([]byte("\nERROR: unknown action\n")).Return(0, errors.New("expected unit test error"))
+				conn.EXPECT().Write([]byte("\nERROR unknown_command: unknown action\n")).Return(0, errors.New("expected unit test error"))
+				conn.EXPECT().Close().Return(nil)
+			},
+		},
+		{
+			name:        "line too long",
+			givenConfig: &config{MaxLineLength: 8},
+			mock: func(conn *NetConnMock, hdl *HandlerMock) {
+				conn.EXPECT().RemoteAddr().Return(new(net.TCPAddr))
+				conn.EXPECT().Read(gomock.Any()).DoAndReturn(func(p []byte) (n int, err error) {
+					data := []byte("AddPackage CCC")
+					n = copy(p, data[:])
+					return n, nil
+				})
+				conn.EXPECT().Write([]byte("\nERROR bad_request: line exceeds 8 bytes\n")).Return(0, nil)
+				conn.EXPECT().Close().Return(nil)
+			},
+		},
+		{
+			name:        "idle timeout",
+			givenConfig: &config{MaxLineLength: 1024, IdleTimeout: time.Minute, ReadTimeout: time.Second},
+			mock: func(conn *NetConnMock, hdl *HandlerMock) {
+				conn.EXPECT().RemoteAddr().Return(new(net.TCPAddr))
+				conn.EXPECT().SetReadDeadline(gomock.Any())
+				conn.EXPECT().Read(gomock.Any()).Return(0, new(netTempError))
+				conn.EXPECT().Write([]byte("\nERROR timeout: idle timeout of 1m0s exceeded\n")).Return(0, nil)
+				conn.EXPECT().Close().Return(nil)
+			},
+		},
+		{
+			name:        "read timeout",
+			givenConfig: &config{MaxLineLength: 1024, IdleTimeout: time.Minute, ReadTimeout: time.Second},
+			mock: func(conn *NetConnMock, hdl *HandlerMock) {
+				conn.EXPECT().RemoteAddr().Return(new(net.TCPAddr))
+				conn.EXPECT().SetReadDeadline(gomock.Any()).Times(2)
+				gomock.InOrder(
+					conn.EXPECT().Read(gomock.Any()).DoAndReturn(func(p []byte) (n int, err error) {
+						data := []byte("AddPack")
+						n = copy(p, data[:])
+						return n, nil
+					}),
+					conn.EXPECT().Read(gomock.Any()).Return(0, new(netTempError)),
+				)
+				conn.EXPECT().Write([]byte("\nERROR timeout: read timeout of 1s exceeded\n")).Return(0, nil)
 				conn.EXPECT().Close().Return(nil)
 			},
 		},
@@ -230,12 +702,139 @@ func TestPacmanHandle(t *testing.T) {
 			handlerMock := NewHandlerMock(ctrl)
 			tc.mock(netConnMock, handlerMock)
 
-			p := pacman{
-				logger:  zap.NewNop(),
-				config:  &config{},
-				handler: handlerMock,
+			cfg := tc.givenConfig
+			if cfg == nil {
+				cfg = &config{MaxLineLength: 1024, DefaultPermission: "admin"}
 			}
+			p := newPacman(zap.NewNop(), cfg, nil, handlerMock, nil, nil)
 			p.handle(netConnMock)
 		})
 	}
 }
+
+func TestPacmanHandleContext(t *testing.T) {
+	t.Parallel()
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	netConnMock := NewNetConnMock(ctrl)
+	netConnMock.EXPECT().RemoteAddr().Return(new(net.TCPAddr))
+	netConnMock.EXPECT().Read(gomock.Any()).DoAndReturn(func(p []byte) (n int, err error) {
+		return copy(p, "#42 Ping\n"), io.EOF
+	})
+	netConnMock.EXPECT().Close().Return(nil)
+
+	var ctx context.Context
+	handlerMock := NewHandlerMock(ctrl)
+	handlerMock.EXPECT().ping(gomock.Any()).DoAndReturn(func(c context.Context) error {
+		ctx = c
+		return nil
+	})
+	netConnMock.EXPECT().Write([]byte("\n#42 PONG\n")).Return(0, nil)
+
+	p := newPacman(zap.NewNop(), &config{MaxLineLength: 1024, DefaultPermission: "read"}, nil, handlerMock, nil, nil)
+	p.handle(netConnMock)
+
+	require.NotNil(t, ctx)
+	assert.Equal(t, "anonymous", identityFrom(ctx))
+	assert.Equal(t, ":0", remoteAddrFrom(ctx))
+	assert.Equal(t, "42", requestIDFrom(ctx))
+	assert.Equal(t, context.Canceled, ctx.Err(), "context is cancelled once the connection is closed")
+}
+
+func TestPacmanHandlePipelined(t *testing.T) {
+	t.Parallel()
+
+	cfg := &config{MaxLineLength: 1024, MaxPipelined: 4, DefaultPermission: "write"}
+	store := newInMemoryStore(nil, 1, 1, nil)
+	p := newPacman(zap.NewNop(), cfg, store, newAction(zap.NewNop(), cfg, store, nil), nil, nil)
+
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		p.handle(server)
+		close(done)
+	}()
+
+	_, err := client.Write([]byte("#1 AddPackage AAA\n" +
+		"#2 GetPackage AAA\n" +
+		"#3 ListPackages\n" +
+		"#4 Ping\n" +
+		"AddPackage BBB AAA\n" +
+		"#5 GetPackage BBB\n"))
+	require.NoError(t, err)
+
+	responses := make(map[string]string)
+	reader := bufio.NewReader(client)
+	var untagged []string
+	for len(responses) < 5 || len(untagged) < 1 {
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		line = strings.TrimRight(line, "\n")
+		if strings.HasPrefix(line, "#") {
+			id, rest, _ := cut(line, " ")
+			responses[id] = rest
+		} else if line == "Package added" {
+			untagged = append(untagged, line)
+		}
+	}
+	require.NoError(t, client.Close())
+	<-done
+
+	assert.Equal(t, map[string]string{
+		"#1": "Package added",
+		"#2": "Package AAA",
+		"#3": "Packages and Dependencies",
+		"#4": "PONG",
+		"#5": "Package BBB",
+	}, responses)
+	assert.Equal(t, []string{"Package added"}, untagged)
+}
+
+func TestPacmanHandleMetrics(t *testing.T) {
+	t.Parallel()
+
+	cfg := &config{MaxLineLength: 1024, DefaultPermission: "read"}
+	m := newMetrics()
+	p := newPacman(zap.NewNop(), cfg, nil, nil, nil, m)
+
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		p.handle(server)
+		close(done)
+	}()
+
+	_, err := client.Write([]byte("AddPackage \"AAA\n" +
+		"#bad! Ping\n" +
+		"@ GetPackage AAA\n" +
+		"Pnig\n" +
+		"RemovePackage\n" +
+		"Quit\n"))
+	require.NoError(t, err)
+	_, err = ioutil.ReadAll(client)
+	require.NoError(t, err)
+	<-done
+
+	// every error response is counted, including lines that aren't a command
+	assert.Equal(t, float64(3), testutil.ToFloat64(m.commands.WithLabelValues(commandInvalid, outcomeError)))
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.commands.WithLabelValues(commandUnknown, outcomeError)))
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.commands.WithLabelValues(RemovePackage, outcomeError)))
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.commands.WithLabelValues(Quit, outcomeSuccess)))
+}
+
+// namespaceMatcher matches the context of a command prefixed with ns, or of
+// one without a prefix when empty.
+type namespaceMatcher struct {
+	ns string
+}
+
+func (m namespaceMatcher) Matches(x interface{}) bool {
+	ctx, ok := x.(context.Context)
+	return ok && namespaceFrom(ctx) == m.ns
+}
+
+func (m namespaceMatcher) String() string {
+	return "is a context of namespace " + strconv.Quote(m.ns)
+}
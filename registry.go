@@ -1,130 +1,850 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 type registry interface {
-	add(name string, deps []string) error
-	remove(name string) error
-	list() string
+	add(ctx context.Context, name string, deps []string, upsert bool) (addResult, error)
+	createGroup(ctx context.Context, name string, members []string, upsert bool) (addResult, error)
+	remove(ctx context.Context, name string) error
+	list(ctx context.Context, rev uint64) ([]packageInfo, error)
+	get(ctx context.Context, name string, rev uint64) (packageInfo, error)
+	names(ctx context.Context) []string
+	revision(ctx context.Context) uint64
+	check(ctx context.Context) ([]string, error)
+	revisionAt(ctx context.Context, at time.Time) (uint64, error)
+	packageHistory(ctx context.Context, name string) (packageHistory, error)
+	revert(ctx context.Context, target revertTarget) (revertResult, error)
+	follow(generation string, rev uint64) (replicationUpdate, <-chan struct{})
+	join(ctx context.Context, id, addr string) error
+	leave(ctx context.Context, id string) error
+	replication() replicationStatus
+	ready() error
 }
 
+// onePackage keeps its dependencies and dependents sorted. The slices are
+// never modified in place, every change replaces them with new ones, so
+// snapshots can share them. A group is a package depending on its members,
+// which packages depending on the group depend on instead, so nothing ever
+// depends on a group.
 type onePackage struct {
 	name       string
+	group      bool
 	dependsOn  []string
 	requiredBy []string
 }
 
 func (pkg onePackage) String() string {
+	if pkg.group {
+		return fmt.Sprintf("group %s with members %q", pkg.name, pkg.dependsOn)
+	}
 	return fmt.Sprintf("package %s with deps %q and required by %q", pkg.name, pkg.dependsOn, pkg.requiredBy)
 }
 
+// packageInfo is a copy of a package handed out of the registry, with its
+// dependencies and dependents sorted. Nothing in it is shared with the
+// registry, callers may modify it.
+type packageInfo struct {
+	Name       string   `json:"name"`
+	Group      bool     `json:"group,omitempty"`
+	DependsOn  []string `json:"depends_on"`
+	RequiredBy []string `json:"required_by"`
+}
+
+func (pkg onePackage) info() packageInfo {
+	return packageInfo{
+		Name:       pkg.name,
+		Group:      pkg.group,
+		DependsOn:  append([]string{}, pkg.dependsOn...),
+		RequiredBy: append([]string{}, pkg.requiredBy...),
+	}
+}
+
+// packageHistory is every retained change of a package, oldest first.
+type packageHistory struct {
+	Name    string          `json:"name"`
+	Changes []packageChange `json:"changes"`
+}
+
+// packageChange tells what a revision did to a package, and the dependencies
+// it was left with.
+type packageChange struct {
+	Revision  uint64    `json:"revision"`
+	Time      time.Time `json:"time"`
+	Op        string    `json:"op"`
+	DependsOn []string  `json:"depends_on"`
+}
+
+const (
+	packageWasAdded   = "added"
+	packageWasUpdated = "updated"
+	packageWasRemoved = "removed"
+)
+
+// mutation is a change kept in the history, along with whether its package
+// existed before and the dependencies it had, to undo it.
+type mutation struct {
+	change
+	existed  bool
+	previous []string
+}
+
+func (m mutation) packageChange() packageChange {
+	pc := packageChange{Revision: m.Revision, Time: m.Time, Op: packageWasAdded, DependsOn: append([]string{}, m.Deps...)}
+	switch {
+	case m.Op == opRemove:
+		pc.Op, pc.DependsOn = packageWasRemoved, []string{}
+	case m.existed:
+		pc.Op = packageWasUpdated
+	}
+	return pc
+}
+
+// snapshot is the registry at one revision. Once published it is never
+// modified, mutations clone it and publish the clone as the next revision
+// along with the change that made it. Revisions are only comparable within a
+// generation, which starts anew with every empty or restored registry.
+type snapshot struct {
+	generation string
+	revision   uint64
+	change     *change
+	packages   map[string]onePackage
+}
+
+func (snap *snapshot) clone() *snapshot {
+	packages := make(map[string]onePackage, len(snap.packages))
+	for name, pkg := range snap.packages {
+		packages[name] = pkg
+	}
+	return &snapshot{generation: snap.generation, revision: snap.revision + 1, packages: packages}
+}
+
+// infos returns every package sorted by name.
+func (snap *snapshot) infos() []packageInfo {
+	pkgs := make([]packageInfo, 0, len(snap.packages))
+	for _, pkg := range snap.packages {
+		pkgs = append(pkgs, pkg.info())
+	}
+	sort.Slice(pkgs, func(i, j int) bool {
+		return pkgs[i].Name < pkgs[j].Name
+	})
+	return pkgs
+}
+
+// undo reverts the mutations, the latest last.
+func (snap *snapshot) undo(mutations []mutation) {
+	for i := len(mutations) - 1; i >= 0; i-- {
+		if m := mutations[i]; m.existed {
+			snap.put(m.Name, m.previous, m.Group)
+		} else {
+			snap.delete(m.Name)
+		}
+	}
+}
+
+// history holds the retained snapshots, oldest first and latest last, and
+// the mutations that made the retained revisions, which go further back than
+// the snapshots. since is when the revision before the first mutation was
+// made. published is closed once the next snapshot is published.
+type history struct {
+	snapshots []*snapshot
+	mutations []mutation
+	since     time.Time
+	published chan struct{}
+}
+
+func newHistory(snapshots []*snapshot) *history {
+	return &history{snapshots: snapshots, since: time.Now().UTC(), published: make(chan struct{})}
+}
+
+// oldest returns the oldest revision the mutations can be undone to.
+func (h *history) oldest() uint64 {
+	return h.snapshots[len(h.snapshots)-1].revision - uint64(len(h.mutations))
+}
+
+// latestRevision asks for the latest snapshot, revisions start at 1.
+const latestRevision uint64 = 0
+
+// inMemoryStore publishes its snapshots through an atomic value, so readers
+// never wait for writers or block them. Writers are serialized by the mutex.
 type inMemoryStore struct {
-	sync.RWMutex
-	packages map[string]onePackage
+	sync.Mutex
+	history       atomic.Value // *history
+	retain        int
+	historyRetain int
+	quotas        namespaceQuotas
+	metrics       *metrics
 }
 
-func newInMemoryStore() *inMemoryStore {
-	return &inMemoryStore{
-		packages: make(map[string]onePackage),
+// newInMemoryStore keeps the given number of recent snapshots, at least the
+// latest one, and the mutations of historyRetain recent revisions, both
+// readable by revision. Namespaces hold at most their quota of packages.
+func newInMemoryStore(m *metrics, retain, historyRetain int, quotas namespaceQuotas) *inMemoryStore {
+	store := &inMemoryStore{
+		retain:        maxInt(retain, 1),
+		historyRetain: maxInt(historyRetain, 1),
+		quotas:        quotas,
+		metrics:       m,
 	}
+	store.history.Store(newHistory([]*snapshot{{
+		generation: newGeneration(),
+		revision:   1,
+		packages:   make(map[string]onePackage),
+	}}))
+	return store
+}
+
+func (store *inMemoryStore) ready() error {
+	return nil
 }
 
-func (store *inMemoryStore) add(name string, deps []string) error {
+func (store *inMemoryStore) lock() {
+	start := time.Now()
 	store.Lock()
+	store.metrics.observeLockWait("write", start)
+}
+
+func (store *inMemoryStore) snapshots() []*snapshot {
+	return store.history.Load().(*history).snapshots
+}
+
+func (store *inMemoryStore) latest() *snapshot {
+	snapshots := store.snapshots()
+	return snapshots[len(snapshots)-1]
+}
+
+// at returns the snapshot of the given revision, or the latest one. Revisions
+// older than the retained snapshots are rebuilt by undoing the mutations
+// since, from the oldest snapshot.
+func (store *inMemoryStore) at(rev uint64) (*snapshot, error) {
+	h := store.history.Load().(*history)
+	oldest, latest := h.snapshots[0], h.snapshots[len(h.snapshots)-1]
+	switch {
+	case rev == latestRevision:
+		return latest, nil
+	case rev > latest.revision:
+		return nil, fmt.Errorf("%w %d: the latest revision is %d", ErrUnknownRevision, rev, latest.revision)
+	case rev >= oldest.revision:
+		return h.snapshots[rev-oldest.revision], nil
+	case rev < h.oldest():
+		return nil, fmt.Errorf("%w %d: the oldest retained revision is %d", ErrUnknownRevision, rev, minUint64(oldest.revision, h.oldest()))
+	}
+	snap := oldest.clone()
+	snap.undo(h.mutations[rev-h.oldest() : oldest.revision-h.oldest()])
+	snap.revision, snap.change = rev, nil
+	return snap, nil
+}
+
+// publish makes snap the latest snapshot, made by the mutation, must be
+// called with the lock held.
+func (store *inMemoryStore) publish(snap *snapshot, m mutation) {
+	current := store.history.Load().(*history)
+	snapshots := current.snapshots
+	if len(snapshots) >= store.retain {
+		snapshots = snapshots[len(snapshots)-store.retain+1:]
+	}
+	retained := make([]*snapshot, 0, len(snapshots)+1)
+	retained = append(retained, snapshots...)
+	next := newHistory(append(retained, snap))
+	// mutations are only appended, readers never see past their own length
+	next.mutations, next.since = append(current.mutations, m), current.since
+	if trimmed := len(next.mutations) - store.historyRetain + 1; trimmed > 0 {
+		next.since = next.mutations[trimmed-1].Time
+		next.mutations = next.mutations[trimmed:]
+	}
+	store.history.Store(next)
+	close(current.published)
+}
+
+// revisionAt returns the revision the registry was at, at the given time.
+func (store *inMemoryStore) revisionAt(ctx context.Context, at time.Time) (uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return latestRevision, err
+	}
+	h := store.history.Load().(*history)
+	return revisionAt(at, h.mutations, h.oldest(), h.since)
+}
+
+// revisionAt finds the revision made last by the given time among the
+// mutations, or the oldest one they can be undone to when made since.
+func revisionAt(at time.Time, mutations []mutation, oldest uint64, since time.Time) (uint64, error) {
+	i := sort.Search(len(mutations), func(i int) bool {
+		return mutations[i].Time.After(at)
+	})
+	switch {
+	case i > 0:
+		return mutations[i-1].Revision, nil
+	case at.Before(since):
+		return latestRevision, fmt.Errorf("%w at %s: the oldest retained revision %d was made at %s",
+			ErrUnknownRevision, at.Format(time.RFC3339), oldest, since.Format(time.RFC3339))
+	}
+	return oldest, nil
+}
+
+func (store *inMemoryStore) packageHistory(ctx context.Context, name string) (packageHistory, error) {
+	if err := ctx.Err(); err != nil {
+		return packageHistory{}, err
+	}
+	h := store.history.Load().(*history)
+	found := packageHistory{Name: name, Changes: []packageChange{}}
+	for _, m := range h.mutations {
+		if m.Name == name {
+			found.Changes = append(found.Changes, m.packageChange())
+		}
+	}
+	if _, exists := h.snapshots[len(h.snapshots)-1].packages[name]; !exists && len(found.Changes) == 0 {
+		return packageHistory{}, fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	return found, nil
+}
+
+func (store *inMemoryStore) revision(ctx context.Context) uint64 {
+	return store.latest().revision
+}
+
+const MaxPackageNameLength = 128
+
+// validatePackageName accepts names made of letters, digits, spaces and
+// ._+-@: that start and end with a letter or digit, prefixed with their
+// namespace as ns/name outside of the default one.
+func validatePackageName(name string) error {
+	bare := name
+	if ns, rest, qualified := cut(name, "/"); qualified {
+		if err := validateNamespace(ns); err != nil {
+			return fmt.Errorf("%w %q: %s", ErrInvalidName, name, err)
+		}
+		bare = rest
+	}
+	if bare == "" {
+		return fmt.Errorf("%w %q: it is empty", ErrInvalidName, name)
+	}
+	if n := utf8.RuneCountInString(bare); n > MaxPackageNameLength {
+		return fmt.Errorf("%w %q: it is %d characters long, at most %d allowed", ErrInvalidName, name, n, MaxPackageNameLength)
+	}
+	runes := []rune(bare)
+	for i, r := range runes {
+		alphanumeric := unicode.IsLetter(r) || unicode.IsDigit(r)
+		if (i == 0 || i == len(runes)-1) && !alphanumeric {
+			return fmt.Errorf("%w %q: it must start and end with a letter or digit", ErrInvalidName, name)
+		}
+		if !alphanumeric && r != ' ' && !strings.ContainsRune("._+-@:", r) {
+			return fmt.Errorf("%w %q: it contains invalid character %q", ErrInvalidName, name, r)
+		}
+	}
+	return nil
+}
+
+// normalizeDeps validates the dependencies of a package and drops the
+// duplicates, keeping the order they were given in.
+func normalizeDeps(name string, deps []string) ([]string, error) {
+	var normalized []string
+	seen := make(map[string]bool, len(deps))
+	for _, dep := range deps {
+		if err := validatePackageName(dep); err != nil {
+			return nil, fmt.Errorf("invalid dependency: %w", err)
+		}
+		if dep == name {
+			return nil, fmt.Errorf("%w: %s cannot depend on itself", ErrDependencyCycle, name)
+		}
+		if !seen[dep] {
+			seen[dep] = true
+			normalized = append(normalized, dep)
+		}
+	}
+	return normalized, nil
+}
+
+// addResult tells what add did to the registry.
+type addResult int
+
+const (
+	packageAdded addResult = iota
+	packageUnchanged
+	packageUpdated
+)
+
+// add is a no-op when the package already exists with the same
+// dependencies. With upsert, the dependencies of an existing package are
+// replaced instead of failing with ErrAlreadyExists.
+func (store *inMemoryStore) add(ctx context.Context, name string, deps []string, upsert bool) (addResult, error) {
+	return store.insert(ctx, name, deps, upsert, false)
+}
+
+// createGroup adds a group of packages like add does a package.
+func (store *inMemoryStore) createGroup(ctx context.Context, name string, members []string, upsert bool) (addResult, error) {
+	return store.insert(ctx, name, members, upsert, true)
+}
+
+func (store *inMemoryStore) insert(ctx context.Context, name string, deps []string, upsert, group bool) (addResult, error) {
+	if err := validatePackageName(name); err != nil {
+		return packageUnchanged, err
+	}
+	deps, err := normalizeDeps(name, deps)
+	if err != nil {
+		return packageUnchanged, err
+	}
+
+	store.lock()
 	defer store.Unlock()
 
-	if pkg, exists := store.packages[name]; exists {
-		return fmt.Errorf("package already exists: %s", pkg.String())
+	// the lock may have taken a while, don't mutate for a client that's gone
+	if err := ctx.Err(); err != nil {
+		return packageUnchanged, err
+	}
+	current := store.latest()
+	c, result, err := current.addChange(name, deps, upsert, group)
+	if err == nil && result == packageAdded {
+		err = current.checkQuota(name, store.quotas[namespaceOf(name)])
+	}
+	if err != nil {
+		return packageUnchanged, err
+	}
+	if c != nil {
+		store.commit(current, *c)
+	}
+	return result, nil
+}
+
+// checkQuota fails adding a package to a namespace already holding quota
+// packages, zero meaning no quota.
+func (snap *snapshot) checkQuota(name string, quota int) error {
+	if quota <= 0 {
+		return nil
+	}
+	ns, count := namespaceOf(name), 0
+	for existing := range snap.packages {
+		if namespaceOf(existing) == ns {
+			count++
+		}
+	}
+	return quotaExceeded(ns, count, quota)
+}
+
+func quotaExceeded(ns string, count, quota int) error {
+	if count >= quota {
+		return fmt.Errorf("%w: namespace %s holds %d packages, at most %d allowed", ErrQuotaExceeded, ns, count, quota)
 	}
+	return nil
+}
+
+// addChange decides what adding the package or group with validated and
+// deduplicated deps does to snap, no change when nothing. Groups among the
+// deps are replaced with their members, which must all exist.
+func (snap *snapshot) addChange(name string, deps []string, upsert, group bool) (*change, addResult, error) {
 	var validDeps []string
+	for _, dep := range deps {
+		pkg, exists := snap.packages[dep]
+		switch {
+		case !exists && group:
+			return nil, packageUnchanged, fmt.Errorf("%w: %s, a member of group %s", ErrNotFound, dep, name)
+		case !exists:
+		case pkg.group:
+			for _, member := range pkg.dependsOn {
+				if member == name {
+					return nil, packageUnchanged, fmt.Errorf("%w: %s cannot depend on itself, a member of group %s", ErrDependencyCycle, name, dep)
+				}
+				validDeps = insertName(validDeps, member)
+			}
+		default:
+			validDeps = insertName(validDeps, dep)
+		}
+	}
+	result := packageAdded
+	if pkg, exists := snap.packages[name]; exists {
+		if pkg.group != group {
+			return nil, packageUnchanged, fmt.Errorf("%w: %s", ErrAlreadyExists, pkg.String())
+		}
+		if equalNames(pkg.dependsOn, validDeps) {
+			return nil, packageUnchanged, nil
+		}
+		if !upsert {
+			return nil, packageUnchanged, fmt.Errorf("%w: %s", ErrAlreadyExists, pkg.String())
+		}
+		for _, dep := range validDeps {
+			if snap.dependsOn(dep, name) {
+				return nil, packageUnchanged, fmt.Errorf("%w: %s cannot depend on %s, which depends on %s", ErrDependencyCycle, name, dep, name)
+			}
+		}
+		result = packageUpdated
+	}
+	return &change{Op: opAdd, Name: name, Deps: validDeps, Group: group}, result, nil
+}
+
+// commit applies the change to a clone of current and publishes it, must be
+// called with the lock held.
+func (store *inMemoryStore) commit(current *snapshot, c change) {
+	next := current.clone()
+	c.Revision = next.revision
+	if c.Time.IsZero() {
+		c.Time = time.Now().UTC()
+	}
+	next.change = &c
+	pkg, existed := current.packages[c.Name]
+	var packages, edges int
+	switch c.Op {
+	case opAdd:
+		packages, edges = next.put(c.Name, c.Deps, c.Group)
+	case opRemove:
+		packages, edges = next.delete(c.Name)
+	}
+	store.publish(next, mutation{change: c, existed: existed, previous: pkg.dependsOn})
+	store.metrics.registryChanged(packages, edges)
+}
+
+// put adds a package or group or replaces its dependencies, and returns how
+// many packages and edges that added.
+func (snap *snapshot) put(name string, deps []string, group bool) (packages, edges int) {
+	pkg, exists := snap.packages[name]
+	if exists {
+		// tell old dependencies that this package is no longer depending on them
+		for _, dep := range pkg.dependsOn {
+			snap.removeRequiredBy(dep, name)
+		}
+		edges -= len(pkg.dependsOn)
+	} else {
+		pkg, packages = onePackage{name: name}, 1
+	}
 	// tell dependencies that this package is depending on them
 	for _, dep := range deps {
-		if pkg, exists := store.packages[dep]; exists {
-			pkg.requiredBy = append(pkg.requiredBy, name)
-			store.packages[dep] = pkg
-			validDeps = append(validDeps, dep)
+		snap.addRequiredBy(dep, name)
+	}
+	pkg.group, pkg.dependsOn = group, deps
+	snap.packages[name] = pkg
+	return packages, edges + len(deps)
+}
+
+// delete removes a package, and returns how many packages and edges that
+// removed as negative numbers.
+func (snap *snapshot) delete(name string) (packages, edges int) {
+	pkg, exists := snap.packages[name]
+	if !exists {
+		return 0, 0
+	}
+	// tell dependencies that this package is no longer depending on them
+	for _, dep := range pkg.dependsOn {
+		snap.removeRequiredBy(dep, name)
+	}
+	delete(snap.packages, name)
+	return -1, -len(pkg.dependsOn)
+}
+
+// dependsOn tells whether pkgName depends on target, directly or not.
+func (snap *snapshot) dependsOn(pkgName, target string) bool {
+	for _, dep := range snap.packages[pkgName].dependsOn {
+		if dep == target || snap.dependsOn(dep, target) {
+			return true
 		}
 	}
-	// add package to the registry
-	store.packages[name] = onePackage{
-		name:      name,
-		dependsOn: validDeps,
+	return false
+}
+
+func (snap *snapshot) addRequiredBy(pkgName, requiredBy string) {
+	if pkg, exists := snap.packages[pkgName]; exists {
+		pkg.requiredBy = insertName(pkg.requiredBy, requiredBy)
+		snap.packages[pkgName] = pkg
 	}
-	return nil
 }
 
-func (store *inMemoryStore) remove(name string) error {
-	store.Lock()
+func (snap *snapshot) removeRequiredBy(pkgName, notRequiredAnymore string) {
+	if pkg, exists := snap.packages[pkgName]; exists {
+		pkg.requiredBy = removeName(pkg.requiredBy, notRequiredAnymore)
+		snap.packages[pkgName] = pkg
+	}
+}
+
+func (store *inMemoryStore) remove(ctx context.Context, name string) error {
+	store.lock()
 	defer store.Unlock()
 
-	toRemove, exists := store.packages[name]
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	current := store.latest()
+	c, err := current.removeChange(name)
+	if err != nil {
+		return err
+	}
+	store.commit(current, *c)
+	return nil
+}
+
+func (snap *snapshot) removeChange(name string) (*change, error) {
+	toRemove, exists := snap.packages[name]
 	if !exists {
-		return fmt.Errorf("package not exists: %s", name)
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, name)
 	}
 	if len(toRemove.requiredBy) > 0 {
-		return fmt.Errorf("package %s cannot be removed, it's required by %q", name, toRemove.requiredBy)
+		return nil, &StillRequiredError{Name: name, RequiredBy: append([]string{}, toRemove.requiredBy...)}
 	}
-	// tell dependencies that this package is no longer depending on them
-	for _, dep := range toRemove.dependsOn {
-		store.removeRequiredBy(dep, name)
+	return &change{Op: opRemove, Name: name, Group: toRemove.group}, nil
+}
+
+// revertTarget is the revision to revert the registry to, or how many of the
+// latest revisions to revert.
+type revertTarget struct {
+	Revision uint64 `json:"revision,omitempty"`
+	Last     uint64 `json:"last,omitempty"`
+}
+
+func (target revertTarget) String() string {
+	if target.Last > 0 {
+		return fmt.Sprintf("last=%d", target.Last)
 	}
-	// remove package from registry
-	delete(store.packages, name)
-	return nil
+	return fmt.Sprintf("to=%d", target.Revision)
 }
 
-func (store *inMemoryStore) removeRequiredBy(pkgName, notRequiredAnymore string) {
-	if pkg, exists := store.packages[pkgName]; exists {
-		var stillRequiredBy []string
-		for _, requiredByPkgName := range pkg.requiredBy {
-			if requiredByPkgName != notRequiredAnymore {
-				stillRequiredBy = append(stillRequiredBy, requiredByPkgName)
+// revision returns the revision to revert to, which must be retained.
+func (target revertTarget) revision(latest, oldest uint64) (uint64, error) {
+	if target.Last > latest-oldest {
+		return 0, fmt.Errorf("%w: cannot revert the last %d revisions, %d are retained", ErrUnknownRevision, target.Last, latest-oldest)
+	}
+	to := target.Revision
+	if target.Last > 0 {
+		to = latest - target.Last
+	}
+	switch {
+	case to > latest:
+		return 0, fmt.Errorf("%w %d: the latest revision is %d", ErrUnknownRevision, to, latest)
+	case to < oldest:
+		return 0, fmt.Errorf("%w %d: the oldest retained revision is %d", ErrUnknownRevision, to, oldest)
+	}
+	return to, nil
+}
+
+// revertResult tells the revision the registry was reverted to, how many
+// changes that took and the revision they brought it to.
+type revertResult struct {
+	To       uint64 `json:"to"`
+	Changes  int    `json:"changes"`
+	Revision uint64 `json:"revision"`
+}
+
+// revertChanges decides the mutations undoing the given ones, the latest
+// last, on top of current. Each must still be valid once the ones before it
+// are made, or the whole revert fails.
+func revertChanges(current *snapshot, mutations []mutation) ([]mutation, error) {
+	work := current.clone()
+	reverts := make([]mutation, 0, len(mutations))
+	for i := len(mutations) - 1; i >= 0; i-- {
+		m := mutations[i]
+		var c *change
+		var err error
+		if m.existed {
+			for _, dep := range m.previous {
+				pkg, exists := work.packages[dep]
+				if !exists {
+					return nil, fmt.Errorf("cannot revert revision %d: %w: %s, which %s depended on", m.Revision, ErrNotFound, dep, m.Name)
+				}
+				if pkg.group {
+					return nil, fmt.Errorf("cannot revert revision %d: %w: %s, %s depended on a package of that name", m.Revision, ErrAlreadyExists, pkg.String(), m.Name)
+				}
 			}
+			c, _, err = work.addChange(m.Name, m.previous, true, m.Group)
+		} else {
+			c, err = work.removeChange(m.Name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot revert revision %d: %w", m.Revision, err)
+		}
+		if c == nil {
+			continue
+		}
+		pkg, existed := work.packages[c.Name]
+		reverts = append(reverts, mutation{change: *c, existed: existed, previous: pkg.dependsOn})
+		if c.Op == opAdd {
+			work.put(c.Name, c.Deps, c.Group)
+		} else {
+			work.delete(c.Name)
 		}
-		pkg.requiredBy = stillRequiredBy
-		store.packages[pkgName] = pkg
 	}
+	return reverts, nil
 }
 
-func (store *inMemoryStore) list() string {
-	store.RLock()
-	defer store.RUnlock()
+// revert undoes the revisions after the target one, each with a new
+// revision, all or none.
+func (store *inMemoryStore) revert(ctx context.Context, target revertTarget) (revertResult, error) {
+	store.lock()
+	defer store.Unlock()
 
-	output := "Packages and Dependencies\n"
-	if len(store.packages) == 0 {
-		output += "- No packages found"
-	} else {
-		pkgs := store.packages
-		keys := make([]string, 0, len(pkgs))
-		for key := range pkgs {
-			keys = append(keys, key)
+	if err := ctx.Err(); err != nil {
+		return revertResult{}, err
+	}
+	return store.revertTo(target, time.Now().UTC())
+}
+
+// revertTo commits the changes reverting to the target, made at the given
+// time, must be called with the lock held.
+func (store *inMemoryStore) revertTo(target revertTarget, at time.Time) (revertResult, error) {
+	h := store.history.Load().(*history)
+	current := h.snapshots[len(h.snapshots)-1]
+	to, err := target.revision(current.revision, h.oldest())
+	if err != nil {
+		return revertResult{}, err
+	}
+	reverts, err := revertChanges(current, h.mutations[to-h.oldest():])
+	if err != nil {
+		return revertResult{}, err
+	}
+	for _, m := range reverts {
+		m.Time = at
+		store.commit(store.latest(), m.change)
+	}
+	return revertResult{To: to, Changes: len(reverts), Revision: store.latest().revision}, nil
+}
+
+// list returns every package of the given revision sorted by name.
+func (store *inMemoryStore) list(ctx context.Context, rev uint64) ([]packageInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	snap, err := store.at(rev)
+	if err != nil {
+		return nil, err
+	}
+	return snap.infos(), nil
+}
+
+func (store *inMemoryStore) get(ctx context.Context, name string, rev uint64) (packageInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return packageInfo{}, err
+	}
+	snap, err := store.at(rev)
+	if err != nil {
+		return packageInfo{}, err
+	}
+	pkg, exists := snap.packages[name]
+	if !exists {
+		return packageInfo{}, fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	return pkg.info(), nil
+}
+
+func (store *inMemoryStore) names(ctx context.Context) []string {
+	if ctx.Err() != nil {
+		return nil
+	}
+	snap := store.latest()
+	names := make([]string, 0, len(snap.packages))
+	for name := range snap.packages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// check walks the whole graph and reports every dependsOn edge without a
+// matching requiredBy back-reference, and the other way around, and edges to
+// groups.
+func (store *inMemoryStore) check(ctx context.Context) ([]string, error) {
+	snap := store.latest()
+	names := make([]string, 0, len(snap.packages))
+	for name := range snap.packages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var problems []string
+	for _, name := range names {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		pkg := snap.packages[name]
+		if !sort.StringsAreSorted(pkg.dependsOn) || !sort.StringsAreSorted(pkg.requiredBy) {
+			problems = append(problems, fmt.Sprintf("%s has unsorted dependencies or dependents", name))
+		}
+		seen := make(map[string]bool, len(pkg.dependsOn))
+		for _, dep := range pkg.dependsOn {
+			switch {
+			case dep == name:
+				problems = append(problems, fmt.Sprintf("%s depends on itself", name))
+				continue
+			case seen[dep]:
+				problems = append(problems, fmt.Sprintf("%s depends on %s more than once", name, dep))
+				continue
+			}
+			seen[dep] = true
+			depPkg, exists := snap.packages[dep]
+			if !exists {
+				problems = append(problems, fmt.Sprintf("%s depends on missing package %s", name, dep))
+				continue
+			}
+			if depPkg.group {
+				problems = append(problems, fmt.Sprintf("%s depends on group %s instead of its members", name, dep))
+			}
+			switch n := countName(depPkg.requiredBy, name); {
+			case n == 0:
+				problems = append(problems, fmt.Sprintf("%s depends on %s, which is not required by %s", name, dep, name))
+			case n > 1:
+				problems = append(problems, fmt.Sprintf("%s is required by %s %d times", dep, name, n))
+			}
+		}
+		for _, requiredBy := range pkg.requiredBy {
+			dependent, exists := snap.packages[requiredBy]
+			if !exists {
+				problems = append(problems, fmt.Sprintf("%s is required by missing package %s", name, requiredBy))
+			} else if countName(dependent.dependsOn, name) == 0 {
+				problems = append(problems, fmt.Sprintf("%s is required by %s, which does not depend on %s", name, requiredBy, name))
+			}
 		}
-		sort.Strings(keys)
-		for _, key := range keys {
-			output += store.listOnePackage(key, 0)
+	}
+	return problems, nil
+}
+
+func countName(names []string, name string) int {
+	n := 0
+	for _, other := range names {
+		if other == name {
+			n++
 		}
 	}
-	return strings.TrimRight(output, "\n")
+	return n
 }
 
-func (store *inMemoryStore) listOnePackage(name string, level int) string {
-	pkg, exists := store.packages[name]
-	if !exists {
-		return ""
+// equalNames compares two sorted sets of names.
+func equalNames(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
 	}
-	indentation := strings.Repeat(" ", level*4)
-	output := indentation + fmt.Sprintf("- %s\n", pkg.name)
-	deps := pkg.dependsOn
-	sort.Strings(deps)
-	for _, dep := range deps {
-		if tree := store.listOnePackage(dep, level+1); tree != "" {
-			output += strings.TrimRight(tree, "\n") + "\n"
+	for i := range a {
+		if a[i] != b[i] {
+			return false
 		}
 	}
-	return output
+	return true
+}
+
+// insertName returns a new sorted set of names with name in it.
+func insertName(names []string, name string) []string {
+	i := sort.SearchStrings(names, name)
+	if i < len(names) && names[i] == name {
+		return names
+	}
+	inserted := make([]string, 0, len(names)+1)
+	inserted = append(inserted, names[:i]...)
+	inserted = append(inserted, name)
+	return append(inserted, names[i:]...)
+}
+
+// removeName returns a new sorted set of names without name in it, nil when
+// it was the last one.
+func removeName(names []string, name string) []string {
+	i := sort.SearchStrings(names, name)
+	if i == len(names) || names[i] != name {
+		return names
+	}
+	if len(names) == 1 {
+		return nil
+	}
+	removed := make([]string, 0, len(names)-1)
+	removed = append(removed, names[:i]...)
+	return append(removed, names[i+1:]...)
 }
@@ -1,13 +1,26 @@
 package main
 
 import (
-	"errors"
+	"context"
+	"fmt"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
+// newInMemoryStoreWith seeds a new registry with packages at revision 1 when
+// given.
+func newInMemoryStoreWith(m *metrics, retain int, pkgs map[string]onePackage) *inMemoryStore {
+	store := newInMemoryStore(m, retain, retain, nil)
+	if pkgs != nil {
+		store.history.Store(newHistory([]*snapshot{{generation: store.latest().generation, revision: 1, packages: pkgs}}))
+	}
+	return store
+}
+
 func TestOnePackageString(t *testing.T) {
 	t.Parallel()
 
@@ -49,67 +62,64 @@ func TestOnePackageString(t *testing.T) {
 	}
 }
 
-func TestInMemoryStoreAdd(t *testing.T) {
+func TestValidatePackageName(t *testing.T) {
 	t.Parallel()
 
 	tests := []struct {
 		name      string
-		givenPkgs map[string]onePackage
-		givenName string
-		givenDeps []string
+		given     string
 		wantError error
-		wantPkgs  map[string]onePackage
 	}{
 		{
-			name: "package already exists",
-			givenPkgs: map[string]onePackage{
-				"AAA": {name: "AAA"},
-			},
-			givenName: "AAA",
-			givenDeps: []string{},
-			wantError: errors.New("package already exists: package AAA with deps [] and required by []"),
-			wantPkgs: map[string]onePackage{
-				"AAA": {name: "AAA"},
-			},
+			name:  "letters and digits",
+			given: "AAA111",
 		},
 		{
-			name: "add a package without deps",
-			givenPkgs: map[string]onePackage{
-				"AAA": {name: "AAA"},
-			},
-			givenName: "BBB",
-			givenDeps: []string{},
-			wantError: nil,
-			wantPkgs: map[string]onePackage{
-				"AAA": {name: "AAA"},
-				"BBB": {name: "BBB"},
-			},
+			name:  "allowed punctuation and spaces",
+			given: "my package-1.0_rc+build@2:x",
 		},
 		{
-			name: "add a package with nonexistent deps",
-			givenPkgs: map[string]onePackage{
-				"AAA": {name: "AAA"},
-			},
-			givenName: "BBB",
-			givenDeps: []string{"CCC"},
-			wantError: nil,
-			wantPkgs: map[string]onePackage{
-				"AAA": {name: "AAA"},
-				"BBB": {name: "BBB"},
-			},
+			name:  "unicode letters",
+			given: "paquete-ñ",
 		},
 		{
-			name: "happy path",
-			givenPkgs: map[string]onePackage{
-				"AAA": {name: "AAA"},
-			},
-			givenName: "BBB",
-			givenDeps: []string{"AAA"},
-			wantError: nil,
-			wantPkgs: map[string]onePackage{
-				"AAA": {name: "AAA", requiredBy: []string{"BBB"}},
-				"BBB": {name: "BBB", dependsOn: []string{"AAA"}},
-			},
+			name:      "empty",
+			given:     "",
+			wantError: fmt.Errorf("%w %q: it is empty", ErrInvalidName, ""),
+		},
+		{
+			name:      "too long",
+			given:     strings.Repeat("A", MaxPackageNameLength+1),
+			wantError: fmt.Errorf("%w %q: it is 129 characters long, at most 128 allowed", ErrInvalidName, strings.Repeat("A", MaxPackageNameLength+1)),
+		},
+		{
+			name:      "leading space",
+			given:     " AAA",
+			wantError: fmt.Errorf("%w %q: it must start and end with a letter or digit", ErrInvalidName, " AAA"),
+		},
+		{
+			name:      "trailing punctuation",
+			given:     "AAA-",
+			wantError: fmt.Errorf("%w %q: it must start and end with a letter or digit", ErrInvalidName, "AAA-"),
+		},
+		{
+			name:  "namespaced",
+			given: "team-1/AAA",
+		},
+		{
+			name:      "invalid namespace",
+			given:     "-team/AAA",
+			wantError: fmt.Errorf("%w %q: invalid namespace %q: it must start and end with a letter or digit", ErrInvalidName, "-team/AAA", "-team"),
+		},
+		{
+			name:      "empty name in namespace",
+			given:     "team/",
+			wantError: fmt.Errorf("%w %q: it is empty", ErrInvalidName, "team/"),
+		},
+		{
+			name:      "invalid character",
+			given:     "AA\tA",
+			wantError: fmt.Errorf("%w %q: it contains invalid character %q", ErrInvalidName, "AA\tA", '\t'),
 		},
 	}
 
@@ -118,60 +128,75 @@ func TestInMemoryStoreAdd(t *testing.T) {
 		t.Run(tc.name, func(t *testing.T) {
 			t.Parallel()
 
-			store := newInMemoryStore()
-			store.packages = tc.givenPkgs
-
-			err := store.add(tc.givenName, tc.givenDeps)
+			err := validatePackageName(tc.given)
 			if tc.wantError != nil {
-				assert.EqualError(t, err, tc.wantError.Error())
+				assert.Equal(t, tc.wantError, err)
 			} else {
 				require.NoError(t, err)
-				assert.Equal(t, tc.wantPkgs, store.packages)
 			}
 		})
 	}
 }
 
-func TestInMemoryStoreRemove(t *testing.T) {
+func TestInMemoryStoreCheck(t *testing.T) {
 	t.Parallel()
 
 	tests := []struct {
 		name      string
 		givenPkgs map[string]onePackage
-		givenName string
-		wantError error
-		wantPkgs  map[string]onePackage
+		want      []string
 	}{
 		{
-			name: "package not exists",
+			name: "consistent graph",
 			givenPkgs: map[string]onePackage{
-				"AAA": {name: "AAA"},
+				"AAA": {name: "AAA", requiredBy: []string{"BBB", "CCC"}},
+				"BBB": {name: "BBB", dependsOn: []string{"AAA"}, requiredBy: []string{"CCC"}},
+				"CCC": {name: "CCC", dependsOn: []string{"AAA", "BBB"}},
 			},
-			givenName: "BBB",
-			wantError: errors.New("package not exists: BBB"),
 		},
 		{
-			name: "package cannot be removed when required by others",
+			name: "missing back-references",
 			givenPkgs: map[string]onePackage{
-				"AAA": {name: "AAA", requiredBy: []string{"BBB"}},
+				"AAA": {name: "AAA", requiredBy: []string{"CCC"}},
 				"BBB": {name: "BBB", dependsOn: []string{"AAA"}},
+				"CCC": {name: "CCC"},
+			},
+			want: []string{
+				"AAA is required by CCC, which does not depend on AAA",
+				"BBB depends on AAA, which is not required by BBB",
 			},
-			givenName: "AAA",
-			wantError: errors.New(`package AAA cannot be removed, it's required by ["BBB"]`),
 		},
 		{
-			name: "happy path",
+			name: "unsorted dependencies",
 			givenPkgs: map[string]onePackage{
-				"AAA": {name: "AAA", requiredBy: []string{"BBB", "CCC"}},
-				"BBB": {name: "BBB", dependsOn: []string{"AAA"}},
-				"CCC": {name: "CCC", dependsOn: []string{"AAA"}},
+				"AAA": {name: "AAA", requiredBy: []string{"CCC"}},
+				"BBB": {name: "BBB", requiredBy: []string{"CCC"}},
+				"CCC": {name: "CCC", dependsOn: []string{"BBB", "AAA"}},
 			},
-			givenName: "CCC",
-			wantError: nil,
-			wantPkgs: map[string]onePackage{
-				"AAA": {name: "AAA", requiredBy: []string{"BBB"}},
-				"BBB": {name: "BBB", dependsOn: []string{"AAA"}},
+			want: []string{"CCC has unsorted dependencies or dependents"},
+		},
+		{
+			name: "duplicated and dangling edges",
+			givenPkgs: map[string]onePackage{
+				"AAA": {name: "AAA", requiredBy: []string{"BBB", "BBB", "DDD"}},
+				"BBB": {name: "BBB", dependsOn: []string{"AAA", "AAA", "BBB", "EEE"}},
+			},
+			want: []string{
+				"AAA is required by missing package DDD",
+				"AAA is required by BBB 2 times",
+				"BBB depends on AAA more than once",
+				"BBB depends on itself",
+				"BBB depends on missing package EEE",
+			},
+		},
+		{
+			name: "dependency on a group",
+			givenPkgs: map[string]onePackage{
+				"AAA": {name: "AAA", requiredBy: []string{"GGG"}},
+				"BBB": {name: "BBB", dependsOn: []string{"GGG"}},
+				"GGG": {name: "GGG", group: true, dependsOn: []string{"AAA"}, requiredBy: []string{"BBB"}},
 			},
+			want: []string{"BBB depends on group GGG instead of its members"},
 		},
 	}
 
@@ -180,78 +205,54 @@ func TestInMemoryStoreRemove(t *testing.T) {
 		t.Run(tc.name, func(t *testing.T) {
 			t.Parallel()
 
-			store := newInMemoryStore()
-			store.packages = tc.givenPkgs
+			store := newInMemoryStoreWith(nil, 1, tc.givenPkgs)
 
-			err := store.remove(tc.givenName)
-			if tc.wantError != nil {
-				assert.EqualError(t, err, tc.wantError.Error())
-			} else {
-				require.NoError(t, err)
-				assert.Equal(t, tc.wantPkgs, store.packages)
-			}
+			problems, err := store.check(context.Background())
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, problems)
 		})
 	}
 }
 
-func TestInMemoryStoreList(t *testing.T) {
+func TestRevertChanges(t *testing.T) {
 	t.Parallel()
 
+	current := &snapshot{revision: 5, packages: map[string]onePackage{
+		"AAA": {name: "AAA", requiredBy: []string{"BBB"}},
+		"BBB": {name: "BBB", dependsOn: []string{"AAA"}},
+		"CCC": {name: "CCC"},
+	}}
 	tests := []struct {
-		name  string
-		given map[string]onePackage
-		want  string
+		name      string
+		mutations []mutation
+		want      []mutation
+		wantErr   string
 	}{
 		{
-			name:  "no packages",
-			given: map[string]onePackage{},
-			want: "Packages and Dependencies\n" +
-				"- No packages found",
+			name: "undone latest first",
+			mutations: []mutation{
+				{change: change{Revision: 4, Op: opRemove, Name: "DDD"}, existed: true, previous: []string{"CCC"}},
+				{change: change{Revision: 5, Op: opAdd, Name: "BBB", Deps: []string{"AAA"}}, existed: true, previous: []string{"CCC"}},
+			},
+			want: []mutation{
+				{change: change{Op: opAdd, Name: "BBB", Deps: []string{"CCC"}}, existed: true, previous: []string{"AAA"}},
+				{change: change{Op: opAdd, Name: "DDD", Deps: []string{"CCC"}}},
+			},
 		},
 		{
-			name: "one package no deps",
-			given: map[string]onePackage{
-				"AAA": {name: "AAA"},
-			},
-			want: "Packages and Dependencies\n" +
-				"- AAA",
+			name:      "package required since",
+			mutations: []mutation{{change: change{Revision: 2, Op: opAdd, Name: "AAA"}}},
+			wantErr:   `cannot revert revision 2: package AAA cannot be removed, it's required by ["BBB"]`,
 		},
 		{
-			name: "two packages and one depends another",
-			given: map[string]onePackage{
-				"AAA": {name: "AAA", requiredBy: []string{"BBB"}},
-				"BBB": {name: "BBB", dependsOn: []string{"AAA"}},
-			},
-			want: "Packages and Dependencies\n" +
-				"- AAA\n" +
-				"- BBB\n" +
-				"    - AAA",
+			name:      "dependency removed since",
+			mutations: []mutation{{change: change{Revision: 3, Op: opRemove, Name: "DDD"}, existed: true, previous: []string{"EEE"}}},
+			wantErr:   "cannot revert revision 3: package not exists: EEE, which DDD depended on",
 		},
 		{
-			name: "more packages and dependencies",
-			given: map[string]onePackage{
-				"AAA": {name: "AAA", requiredBy: []string{"BBB", "DDD"}},
-				"BBB": {name: "BBB", dependsOn: []string{"AAA"}, requiredBy: []string{"CCC", "DDD"}},
-				"CCC": {name: "CCC", dependsOn: []string{"BBB"}},
-				"DDD": {name: "DDD", dependsOn: []string{"AAA", "BBB"}},
-				"EEE": {name: "EEE", dependsOn: []string{"DDD"}},
-			},
-			want: "Packages and Dependencies\n" +
-				"- AAA\n" +
-				"- BBB\n" +
-				"    - AAA\n" +
-				"- CCC\n" +
-				"    - BBB\n" +
-				"        - AAA\n" +
-				"- DDD\n" +
-				"    - AAA\n" +
-				"    - BBB\n" +
-				"        - AAA\n" +
-				"- EEE\n" +
-				"    - DDD\n" +
-				"        - AAA\n" +
-				"        - BBB\n" +
-				"            - AAA",
+			name:      "dependency cycle",
+			mutations: []mutation{{change: change{Revision: 4, Op: opAdd, Name: "AAA"}, existed: true, previous: []string{"BBB"}}},
+			wantErr:   "cannot revert revision 4: dependency cycle: AAA cannot depend on BBB, which depends on AAA",
 		},
 	}
 
@@ -260,10 +261,82 @@ func TestInMemoryStoreList(t *testing.T) {
 		t.Run(tc.name, func(t *testing.T) {
 			t.Parallel()
 
-			store := newInMemoryStore()
-			store.packages = tc.given
-
-			assert.Equal(t, tc.want, store.list())
+			reverts, err := revertChanges(current, tc.mutations)
+			if tc.wantErr != "" {
+				assert.EqualError(t, err, tc.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, reverts)
 		})
 	}
 }
+
+func TestInMemoryStoreReadsDuringWrite(t *testing.T) {
+	t.Parallel()
+
+	store := newInMemoryStoreWith(nil, 1, map[string]onePackage{"AAA": {name: "AAA"}})
+
+	// readers go through the published snapshot, never waiting for a writer
+	store.lock()
+	defer store.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := store.list(context.Background(), latestRevision)
+		assert.NoError(t, err)
+		_, err = store.get(context.Background(), "AAA", latestRevision)
+		assert.NoError(t, err)
+		_, err = store.check(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"AAA"}, store.names(context.Background()))
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("reads blocked by the write lock")
+	}
+}
+
+func TestInMemoryStoreReadsPastSnapshots(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	store := newInMemoryStore(nil, 1, 4, nil)
+	_, err := store.add(ctx, "AAA", nil, false)
+	require.NoError(t, err)
+	_, err = store.add(ctx, "BBB", []string{"AAA"}, false)
+	require.NoError(t, err)
+	_, err = store.add(ctx, "BBB", nil, true)
+	require.NoError(t, err)
+	require.NoError(t, store.remove(ctx, "AAA"))
+
+	// older revisions are rebuilt by undoing the retained mutations
+	for rev, want := range map[uint64][]packageInfo{
+		2: {{Name: "AAA", DependsOn: []string{}, RequiredBy: []string{}}},
+		3: {
+			{Name: "AAA", DependsOn: []string{}, RequiredBy: []string{"BBB"}},
+			{Name: "BBB", DependsOn: []string{"AAA"}, RequiredBy: []string{}},
+		},
+		4: {
+			{Name: "AAA", DependsOn: []string{}, RequiredBy: []string{}},
+			{Name: "BBB", DependsOn: []string{}, RequiredBy: []string{}},
+		},
+		5: {{Name: "BBB", DependsOn: []string{}, RequiredBy: []string{}}},
+	} {
+		pkgs, err := store.list(ctx, rev)
+		require.NoError(t, err)
+		assert.Equal(t, want, pkgs, "revision %d", rev)
+	}
+	_, err = store.list(ctx, 1)
+	assert.Equal(t, fmt.Errorf("%w 1: the oldest retained revision is 2", ErrUnknownRevision), err)
+
+	// trimmed changes leave the history of a package, and earlier times
+	history, err := store.packageHistory(ctx, "AAA")
+	require.NoError(t, err)
+	require.Len(t, history.Changes, 1)
+	assert.Equal(t, packageWasRemoved, history.Changes[0].Op)
+	_, err = store.revisionAt(ctx, history.Changes[0].Time.Add(-time.Hour))
+	assert.Equal(t, "unknown_revision", errorCode(err))
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	opAdd    = "add"
+	opRemove = "remove"
+)
+
+// change is a mutation of the registry, replayed by followers. An add
+// carries every dependency the package ends up with, so it also replaces
+// the dependencies of an existing package. Group tells whether the package
+// added or removed is a group.
+type change struct {
+	Revision uint64    `json:"revision"`
+	Time     time.Time `json:"time"`
+	Op       string    `json:"op"`
+	Name     string    `json:"name"`
+	Deps     []string  `json:"deps,omitempty"`
+	Group    bool      `json:"group,omitempty"`
+}
+
+func newGeneration() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// replicationUpdate is streamed by the primary to its followers. The first
+// one carries a snapshot of the whole registry unless the follower can catch
+// up with changes alone, and updates without changes are heartbeats.
+type replicationUpdate struct {
+	Generation string        `json:"generation"`
+	Revision   uint64        `json:"revision"`
+	Time       time.Time     `json:"time"`
+	Snapshot   []packageInfo `json:"snapshot,omitempty"`
+	Changes    []change      `json:"changes,omitempty"`
+	// full tells an empty snapshot apart from no snapshot
+	Full bool `json:"full,omitempty"`
+	// Heartbeat is how often the primary sends updates without changes
+	Heartbeat time.Duration `json:"heartbeat,omitempty"`
+}
+
+func (update replicationUpdate) text() string {
+	return fmt.Sprintf("Revision %d with %d changes", update.Revision, len(update.Changes))
+}
+
+// follow returns what a follower at the given generation and revision is
+// missing, and a channel closed once there is more.
+func (store *inMemoryStore) follow(generation string, rev uint64) (replicationUpdate, <-chan struct{}) {
+	h := store.history.Load().(*history)
+	latest := h.snapshots[len(h.snapshots)-1]
+	update := replicationUpdate{Generation: latest.generation, Revision: latest.revision}
+	if generation == latest.generation {
+		if changes, ok := h.changesSince(rev); ok {
+			update.Changes = changes
+			return update, h.published
+		}
+	}
+	update.Snapshot = latest.infos()
+	update.Full = true
+	return update, h.published
+}
+
+// changesSince fails when the changes following rev are not retained.
+func (h *history) changesSince(rev uint64) ([]change, bool) {
+	oldest, latest := h.snapshots[0], h.snapshots[len(h.snapshots)-1]
+	if rev > latest.revision || rev+1 < oldest.revision {
+		return nil, false
+	}
+	var changes []change
+	for _, snap := range h.snapshots[rev+1-oldest.revision:] {
+		if snap.change == nil {
+			return nil, false
+		}
+		changes = append(changes, *snap.change)
+	}
+	return changes, true
+}
+
+// restore replaces the whole registry with a snapshot of the primary, along
+// with the mutations that made it when known. since is when the revision
+// before them was made, unknown when zero.
+func (store *inMemoryStore) restore(generation string, rev uint64, pkgs []packageInfo, mutations []mutation, since time.Time) {
+	store.lock()
+	defer store.Unlock()
+
+	current := store.latest()
+	next := &snapshot{generation: generation, revision: rev, packages: make(map[string]onePackage, len(pkgs))}
+	edges := 0
+	for _, pkg := range pkgs {
+		next.packages[pkg.Name] = onePackage{
+			name:       pkg.Name,
+			group:      pkg.Group,
+			dependsOn:  sortedNames(pkg.DependsOn),
+			requiredBy: sortedNames(pkg.RequiredBy),
+		}
+		edges += len(pkg.DependsOn)
+	}
+	currentEdges := 0
+	for _, pkg := range current.packages {
+		currentEdges += len(pkg.dependsOn)
+	}
+	// revisions of another generation cannot be read at anymore
+	previous := store.history.Load().(*history)
+	restored := newHistory([]*snapshot{next})
+	if trimmed := len(mutations) - store.historyRetain + 1; trimmed > 0 {
+		since = mutations[trimmed-1].Time
+		mutations = mutations[trimmed:]
+	}
+	restored.mutations = mutations
+	if !since.IsZero() {
+		restored.since = since
+	}
+	store.history.Store(restored)
+	close(previous.published)
+	store.metrics.registryChanged(len(next.packages)-len(current.packages), edges-currentEdges)
+}
+
+// apply replays a change of the primary, which must follow the latest
+// revision.
+func (store *inMemoryStore) apply(c change) error {
+	store.lock()
+	defer store.Unlock()
+
+	current := store.latest()
+	if c.Revision != current.revision+1 {
+		return fmt.Errorf("change of revision %d does not follow revision %d", c.Revision, current.revision)
+	}
+	if c.Op != opAdd && c.Op != opRemove {
+		return fmt.Errorf("unknown change operation %q", c.Op)
+	}
+	c.Deps = sortedNames(c.Deps)
+	store.commit(current, c)
+	return nil
+}
+
+// sortedNames returns a new sorted set of the names, nil when empty.
+func sortedNames(names []string) []string {
+	var sorted []string
+	for _, name := range names {
+		sorted = insertName(sorted, name)
+	}
+	return sorted
+}
+
+// replicationStatus tells whether this registry is the primary or follows
+// one, and how far behind it is.
+type replicationStatus struct {
+	Role            string    `json:"role"`
+	Primary         string    `json:"primary,omitempty"`
+	Connected       bool      `json:"connected"`
+	Revision        uint64    `json:"revision"`
+	PrimaryRevision uint64    `json:"primary_revision,omitempty"`
+	LastContact     time.Time `json:"last_contact"`
+	LagSeconds      float64   `json:"lag_seconds"`
+	// State, Leader and Members are those of a cluster node
+	State   string          `json:"state,omitempty"`
+	Leader  string          `json:"leader,omitempty"`
+	Members []clusterMember `json:"members,omitempty"`
+}
+
+const (
+	rolePrimary  = "primary"
+	roleFollower = "follower"
+	roleCluster  = "cluster"
+)
+
+func (status replicationStatus) text() string {
+	switch status.Role {
+	case rolePrimary:
+		return fmt.Sprintf("Replication\n- Role: primary\n- Revision: %d", status.Revision)
+	case roleCluster:
+		leader := status.Leader
+		if leader == "" {
+			leader = "none"
+		}
+		members := make([]string, 0, len(status.Members))
+		for _, member := range status.Members {
+			members = append(members, member.ID+" at "+member.Address)
+		}
+		return fmt.Sprintf("Replication\n- Role: cluster %s\n- Leader: %s\n- Members: %s\n- Revision: %d",
+			status.State, leader, strings.Join(members, ", "), status.Revision)
+	}
+	lastContact := "never"
+	if !status.LastContact.IsZero() {
+		lastContact = status.LastContact.UTC().Format(time.RFC3339)
+	}
+	return fmt.Sprintf("Replication\n- Role: follower of %s\n- Connected: %t\n- Revision: %d of %d\n- Last contact: %s\n- Lag: %.3fs",
+		status.Primary, status.Connected, status.Revision, status.PrimaryRevision, lastContact, status.LagSeconds)
+}
+
+func (store *inMemoryStore) replication() replicationStatus {
+	return replicationStatus{Role: rolePrimary, Connected: true, Revision: store.latest().revision}
+}
+
+// replica is the registry of a follower, a copy of the primary's registry
+// kept up to date by streaming from it. Writes are rejected, they go to the
+// primary.
+type replica struct {
+	*inMemoryStore
+	logger  *zap.Logger
+	config  *config
+	metrics *metrics
+	status  atomic.Value // replicationStatus
+}
+
+func newReplica(lg *zap.Logger, cfg *config, store *inMemoryStore, m *metrics) *replica {
+	r := &replica{
+		inMemoryStore: store,
+		logger:        lg,
+		config:        cfg,
+		metrics:       m,
+	}
+	r.status.Store(replicationStatus{Role: roleFollower, Primary: cfg.PrimaryAddr})
+	return r
+}
+
+func (r *replica) add(ctx context.Context, name string, deps []string, upsert bool) (addResult, error) {
+	return packageUnchanged, r.readOnly()
+}
+
+func (r *replica) createGroup(ctx context.Context, name string, members []string, upsert bool) (addResult, error) {
+	return packageUnchanged, r.readOnly()
+}
+
+func (r *replica) remove(ctx context.Context, name string) error {
+	return r.readOnly()
+}
+
+func (r *replica) revert(ctx context.Context, target revertTarget) (revertResult, error) {
+	return revertResult{}, r.readOnly()
+}
+
+func (r *replica) readOnly() error {
+	return fmt.Errorf("%w, send writes to the primary at %s", ErrReadOnly, r.config.PrimaryAddr)
+}
+
+func (r *replica) ready() error {
+	if r.replication().LastContact.IsZero() {
+		return fmt.Errorf("no snapshot received from the primary at %s yet", r.config.PrimaryAddr)
+	}
+	return nil
+}
+
+func (r *replica) replication() replicationStatus {
+	status := r.status.Load().(replicationStatus)
+	status.Revision = r.latest().revision
+	return status
+}
+
+func (r *replica) updateStatus(update func(*replicationStatus)) {
+	status := r.status.Load().(replicationStatus)
+	update(&status)
+	r.status.Store(status)
+	lag := float64(status.PrimaryRevision) - float64(r.latest().revision)
+	r.metrics.replicationChanged(status.Connected, maxFloat(lag, 0), status.LagSeconds)
+}
+
+// run follows the primary until ctx is done, reconnecting whenever the
+// stream breaks.
+func (r *replica) run(ctx context.Context) {
+	primaryField := zap.String("primary_addr", r.config.PrimaryAddr)
+	var retryDelay time.Duration
+	for {
+		err := r.stream(ctx)
+		if r.replication().Connected {
+			// the stream worked for a while, reconnect right away
+			retryDelay = 0
+		}
+		r.updateStatus(func(status *replicationStatus) {
+			status.Connected = false
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		if retryDelay == 0 {
+			retryDelay = 10 * time.Millisecond
+		} else {
+			retryDelay *= 2
+		}
+		if max := 5 * time.Second; retryDelay > max {
+			retryDelay = max
+		}
+		r.logger.Error("replication stream broke", primaryField, zap.Stringer("retry_in", retryDelay), zap.Error(err))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retryDelay):
+		}
+	}
+}
+
+// stream sends Replicate with the generation and revision this replica is at
+// and applies updates until the connection breaks or ctx is done. Responses
+// are switched to JSON first, so the primary refusing Replicate before it
+// runs, e.g. for lacking permission, is understood too.
+func (r *replica) stream(ctx context.Context) error {
+	connection, err := r.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer connection.Close()
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = connection.Close()
+		case <-stop:
+		}
+	}()
+
+	latest := r.latest()
+	replicate := fmt.Sprintf("%s json\n%s %s %d\n", Format, Replicate, latest.generation, latest.revision)
+	if _, err := connection.Write([]byte(replicate)); err != nil {
+		return err
+	}
+	r.logger.Info("following primary", zap.String("primary_addr", r.config.PrimaryAddr),
+		zap.String("generation", latest.generation), zap.Uint64("revision", latest.revision))
+
+	scanner := bufio.NewScanner(connection)
+	scanner.Buffer(make([]byte, 0, bufio.MaxScanTokenSize), maxReplicationLine)
+	formatted := false
+	heartbeat := r.config.ReplicaHeartbeat
+	for {
+		// the primary sends heartbeats at its own interval, a silent one is gone
+		if err := connection.SetReadDeadline(time.Now().Add(3 * heartbeat)); err != nil {
+			return err
+		}
+		if !scanner.Scan() {
+			if err := scanner.Err(); err != nil {
+				return err
+			}
+			return errors.New("primary closed the connection")
+		}
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var response struct {
+			Result json.RawMessage `json:"result"`
+			Error  string          `json:"error"`
+			Code   string          `json:"code"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &response); err != nil {
+			return fmt.Errorf("cannot parse replication update: %w", err)
+		}
+		if response.Error != "" {
+			return fmt.Errorf("primary refused to replicate: %s: %s", response.Code, response.Error)
+		}
+		if !formatted {
+			// the reply to Format comes before any update
+			formatted = true
+			continue
+		}
+		var update *replicationUpdate
+		if err := json.Unmarshal(response.Result, &update); err != nil {
+			return fmt.Errorf("cannot parse replication update: %w", err)
+		}
+		if update == nil {
+			return errors.New("primary sent an empty replication update")
+		}
+		if update.Heartbeat > 0 {
+			heartbeat = update.Heartbeat
+		}
+		if err := r.applyUpdate(*update); err != nil {
+			return err
+		}
+	}
+}
+
+// maxReplicationLine bounds the size of a replication update, which holds a
+// snapshot of the whole registry.
+const maxReplicationLine = 256 << 20
+
+func (r *replica) applyUpdate(update replicationUpdate) error {
+	if update.Full {
+		r.inMemoryStore.restore(update.Generation, update.Revision, update.Snapshot, nil, time.Time{})
+	} else if update.Generation != r.latest().generation {
+		return fmt.Errorf("primary sent changes of generation %s instead of %s", update.Generation, r.latest().generation)
+	}
+	for _, c := range update.Changes {
+		if err := r.inMemoryStore.apply(c); err != nil {
+			return err
+		}
+	}
+	r.updateStatus(func(status *replicationStatus) {
+		status.Connected = true
+		status.PrimaryRevision = update.Revision
+		status.LastContact = time.Now()
+		status.LagSeconds = maxFloat(status.LastContact.Sub(update.Time).Seconds(), 0)
+	})
+	return nil
+}
+
+func (r *replica) dial(ctx context.Context) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	if !r.config.UseMTLS {
+		return dialer.DialContext(ctx, "tcp", r.config.PrimaryAddr)
+	}
+	tlsConfig, err := r.config.peerTLS(r.config.PrimaryAddr)
+	if err != nil {
+		return nil, err
+	}
+	return (&tls.Dialer{NetDialer: dialer, Config: tlsConfig}).DialContext(ctx, "tcp", r.config.PrimaryAddr)
+}
+
+// parseReplicate reads the optional generation and revision a follower is
+// at, to only stream what it is missing.
+func parseReplicate(args []string) (string, uint64, error) {
+	if len(args) == 0 {
+		return "", 0, nil
+	}
+	if len(args) != 2 {
+		return "", 0, errors.New("expecting both a generation and a revision")
+	}
+	rev, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid revision %q, expecting a number", args[1])
+	}
+	return args[0], rev, nil
+}
+
+func maxFloat(a, b float64) float64 {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+)
+
+// untimed drops the time of the changes, which tests cannot know.
+func untimed(t *testing.T, changes []change) []change {
+	t.Helper()
+	for i := range changes {
+		assert.False(t, changes[i].Time.IsZero())
+		changes[i].Time = time.Time{}
+	}
+	return changes
+}
+
+func TestInMemoryStoreFollow(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	store := newInMemoryStore(nil, 2, 2, nil)
+	generation := store.latest().generation
+
+	update, _ := store.follow("", 0)
+	assert.Equal(t, replicationUpdate{Generation: generation, Revision: 1, Snapshot: []packageInfo{}, Full: true}, update)
+
+	_, err := store.add(ctx, "AAA", nil, false)
+	require.NoError(t, err)
+	_, err = store.add(ctx, "BBB", []string{"AAA"}, false)
+	require.NoError(t, err)
+
+	update, published := store.follow(generation, 1)
+	update.Changes = untimed(t, update.Changes)
+	assert.Equal(t, replicationUpdate{Generation: generation, Revision: 3, Changes: []change{
+		{Revision: 2, Op: opAdd, Name: "AAA"},
+		{Revision: 3, Op: opAdd, Name: "BBB", Deps: []string{"AAA"}},
+	}}, update)
+	select {
+	case <-published:
+		t.Fatal("nothing was published yet")
+	default:
+	}
+
+	require.NoError(t, store.remove(ctx, "BBB"))
+	<-published
+	update, _ = store.follow(generation, 3)
+	assert.Equal(t, []change{{Revision: 4, Op: opRemove, Name: "BBB"}}, untimed(t, update.Changes))
+
+	// the change to revision 2 is not retained anymore, nor are other generations
+	for _, given := range []struct {
+		generation string
+		rev        uint64
+	}{
+		{generation, 1},
+		{generation, 9},
+		{"other", 4},
+	} {
+		update, _ = store.follow(given.generation, given.rev)
+		assert.True(t, update.Full, "%s %d", given.generation, given.rev)
+		assert.Equal(t, []packageInfo{{Name: "AAA", DependsOn: []string{}, RequiredBy: []string{}}}, update.Snapshot)
+	}
+}
+
+func TestReplicaApplyUpdate(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	primary := newInMemoryStore(nil, 2, 2, nil)
+	replica := newReplica(zap.NewNop(), &config{PrimaryAddr: "primary:9000"}, newInMemoryStore(nil, 2, 2, nil), nil)
+	assert.EqualError(t, replica.ready(), "no snapshot received from the primary at primary:9000 yet")
+
+	_, err := primary.add(ctx, "AAA", nil, false)
+	require.NoError(t, err)
+	sync := func() {
+		update, _ := primary.follow(replica.latest().generation, replica.latest().revision)
+		require.NoError(t, replica.applyUpdate(update))
+		want, err := primary.list(ctx, latestRevision)
+		require.NoError(t, err)
+		got, err := replica.list(ctx, latestRevision)
+		require.NoError(t, err)
+		assert.Equal(t, want, got)
+		assert.Equal(t, primary.revision(ctx), replica.revision(ctx))
+	}
+	sync()
+	require.NoError(t, replica.ready())
+
+	_, err = primary.add(ctx, "BBB", []string{"AAA"}, false)
+	require.NoError(t, err)
+	_, err = primary.add(ctx, "CCC", []string{"BBB"}, false)
+	require.NoError(t, err)
+	_, err = primary.add(ctx, "CCC", []string{"AAA"}, true)
+	require.NoError(t, err)
+	require.NoError(t, primary.remove(ctx, "BBB"))
+	_, err = primary.createGroup(ctx, "base", []string{"AAA", "CCC"}, false)
+	require.NoError(t, err)
+	sync()
+
+	problems, err := replica.check(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, problems)
+
+	status := replica.replication()
+	assert.Equal(t, roleFollower, status.Role)
+	assert.True(t, status.Connected)
+	assert.Equal(t, uint64(7), status.Revision)
+	assert.Equal(t, uint64(7), status.PrimaryRevision)
+
+	_, err = replica.add(ctx, "DDD", nil, false)
+	assert.Equal(t, fmt.Errorf("%w, send writes to the primary at primary:9000", ErrReadOnly), err)
+	assert.Equal(t, "read_only", errorCode(replica.remove(ctx, "AAA")))
+	_, err = replica.revert(ctx, revertTarget{Last: 1})
+	assert.Equal(t, "read_only", errorCode(err))
+	_, err = replica.createGroup(ctx, "base", []string{"AAA"}, true)
+	assert.Equal(t, "read_only", errorCode(err))
+
+	err = replica.applyUpdate(replicationUpdate{Generation: "other", Revision: 7})
+	assert.EqualError(t, err, "primary sent changes of generation other instead of "+primary.latest().generation)
+	err = replica.applyUpdate(replicationUpdate{Generation: primary.latest().generation, Revision: 9, Changes: []change{{Revision: 9, Op: opRemove, Name: "AAA"}}})
+	assert.EqualError(t, err, "change of revision 9 does not follow revision 7")
+}
+
+func TestReplicationStream(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	cfg := &config{MaxLineLength: 1024, DefaultPermission: "admin", ReplicaHeartbeat: 500 * time.Millisecond}
+	primaryStore := newInMemoryStore(nil, 4, 4, nil)
+	primary := newPacman(zap.NewNop(), cfg, primaryStore, newAction(zap.NewNop(), cfg, primaryStore, nil), nil, nil)
+	defer primary.stop()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	accepted := atomic.NewInt32(0)
+	go func() {
+		for {
+			connection, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Inc()
+			go primary.handle(connection)
+		}
+	}()
+
+	_, err = primaryStore.add(ctx, "AAA", nil, false)
+	require.NoError(t, err)
+
+	// the follower waits for heartbeats at the interval of the primary
+	followerCfg := &config{PrimaryAddr: listener.Addr().String(), ReplicaHeartbeat: 50 * time.Millisecond}
+	follower := newReplica(zap.NewNop(), followerCfg, newInMemoryStore(nil, 4, 4, nil), newMetrics())
+	followerCtx, cancel := context.WithCancel(ctx)
+	stopped := make(chan struct{})
+	go func() {
+		follower.run(followerCtx)
+		close(stopped)
+	}()
+	defer func() {
+		cancel()
+		<-stopped
+	}()
+
+	caughtUp := func() bool {
+		status := follower.replication()
+		return status.Connected && status.Revision == primaryStore.revision(ctx)
+	}
+	require.Eventually(t, caughtUp, 5*time.Second, 10*time.Millisecond)
+
+	_, err = primaryStore.add(ctx, "BBB", []string{"AAA"}, false)
+	require.NoError(t, err)
+	require.Eventually(t, caughtUp, 5*time.Second, 10*time.Millisecond)
+
+	pkg, err := follower.get(ctx, "AAA", latestRevision)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"BBB"}, pkg.RequiredBy)
+	assert.NoError(t, follower.ready())
+
+	// heartbeats keep the follower in contact while nothing changes
+	lastContact := follower.replication().LastContact
+	require.Eventually(t, func() bool {
+		return follower.replication().LastContact.After(lastContact)
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, int32(1), accepted.Load())
+
+	cancel()
+	<-stopped
+	assert.False(t, follower.replication().Connected)
+}
+
+func TestReplicationStreamDenied(t *testing.T) {
+	t.Parallel()
+
+	cfg := &config{MaxLineLength: 1024, DefaultPermission: "read", ReplicaHeartbeat: 500 * time.Millisecond}
+	primaryStore := newInMemoryStore(nil, 4, 4, nil)
+	primary := newPacman(zap.NewNop(), cfg, primaryStore, newAction(zap.NewNop(), cfg, primaryStore, nil), nil, nil)
+	defer primary.stop()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		connection, err := listener.Accept()
+		if err == nil {
+			primary.handle(connection)
+		}
+	}()
+
+	followerCfg := &config{PrimaryAddr: listener.Addr().String(), ReplicaHeartbeat: 500 * time.Millisecond}
+	follower := newReplica(zap.NewNop(), followerCfg, newInMemoryStore(nil, 4, 4, nil), newMetrics())
+	err = follower.stream(context.Background())
+	assert.EqualError(t, err, "primary refused to replicate: permission_denied: permission denied, Replicate requires admin permission")
+}
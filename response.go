@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// result is what a command responds with. Every result renders itself as
+// text for the line protocol, and is marshalled as is for JSON.
+type result interface {
+	text() string
+}
+
+type message string
+
+func (m message) text() string {
+	return string(m)
+}
+
+var addedMessages = map[addResult]message{
+	packageAdded:     "Package added",
+	packageUnchanged: "Package already exists with the same dependencies",
+	packageUpdated:   "Package dependencies replaced",
+}
+
+var groupMessages = map[addResult]message{
+	packageAdded:     "Group created",
+	packageUnchanged: "Group already exists with the same members",
+	packageUpdated:   "Group members replaced",
+}
+
+type revisionInfo struct {
+	Revision uint64 `json:"revision"`
+}
+
+func (rev revisionInfo) text() string {
+	return fmt.Sprintf("Revision %d", rev.Revision)
+}
+
+func (reverted revertResult) text() string {
+	if reverted.Changes == 0 {
+		return fmt.Sprintf("Nothing to revert, already at revision %d", reverted.To)
+	}
+	return fmt.Sprintf("Reverted to revision %d with %d changes, now at revision %d", reverted.To, reverted.Changes, reverted.Revision)
+}
+
+type packageList []packageInfo
+
+func (pkgs packageList) text() string {
+	output := "Packages and Dependencies\n"
+	if len(pkgs) == 0 {
+		return output + "- No packages found"
+	}
+	byName := make(map[string]packageInfo, len(pkgs))
+	for _, pkg := range pkgs {
+		byName[pkg.Name] = pkg
+	}
+	for _, pkg := range pkgs {
+		output += pkgs.tree(byName, pkg.Name, 0)
+	}
+	return strings.TrimRight(output, "\n")
+}
+
+// tree shows dependencies out of the list, in other namespaces, as leaves,
+// and groups with their members.
+func (pkgs packageList) tree(byName map[string]packageInfo, name string, level int) string {
+	pkg, exists := byName[name]
+	if pkg.Group {
+		name += " (group)"
+	}
+	output := strings.Repeat(" ", level*4) + fmt.Sprintf("- %s\n", name)
+	if !exists {
+		return output
+	}
+	for _, dep := range pkg.DependsOn {
+		output += pkgs.tree(byName, dep, level+1)
+	}
+	return output
+}
+
+func (pkg packageInfo) text() string {
+	if pkg.Group {
+		return fmt.Sprintf("Group %s\n- Members: %s", pkg.Name, joinNames(pkg.DependsOn))
+	}
+	return fmt.Sprintf("Package %s\n- Depends on: %s\n- Required by: %s",
+		pkg.Name, joinNames(pkg.DependsOn), joinNames(pkg.RequiredBy))
+}
+
+func (history packageHistory) text() string {
+	output := fmt.Sprintf("Package %s History\n", history.Name)
+	if len(history.Changes) == 0 {
+		return output + "- No changes retained"
+	}
+	for _, c := range history.Changes {
+		output += fmt.Sprintf("- Revision %d at %s: %s", c.Revision, c.Time.Format(time.RFC3339), c.Op)
+		if c.Op != packageWasRemoved {
+			output += ", depends on: " + joinNames(c.DependsOn)
+		}
+		output += "\n"
+	}
+	return strings.TrimRight(output, "\n")
+}
+
+func joinNames(names []string) string {
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ", ")
+}
+
+type auditRecords []auditRecord
+
+func (records auditRecords) text() string {
+	output := "Audit Log\n"
+	if len(records) == 0 {
+		return output + "- No audit records found"
+	}
+	for _, r := range records {
+		output += "- " + r.String() + "\n"
+	}
+	return strings.TrimRight(output, "\n")
+}
+
+// graphProblems marshals as an empty list rather than null when the graph
+// is consistent.
+type graphProblems []string
+
+func (problems graphProblems) text() string {
+	output := "Graph Check\n"
+	if len(problems) == 0 {
+		return output + "- No problems found"
+	}
+	for _, problem := range problems {
+		output += "- " + problem + "\n"
+	}
+	return strings.TrimRight(output, "\n")
+}
+
+func (problems graphProblems) MarshalJSON() ([]byte, error) {
+	return json.Marshal(append([]string{}, problems...))
+}
+
+type outputFormat int
+
+const (
+	formatText outputFormat = iota
+	formatJSON
+)
+
+var outputFormatNames = map[outputFormat]string{
+	formatText: "text",
+	formatJSON: "json",
+}
+
+func (f outputFormat) String() string {
+	return outputFormatNames[f]
+}
+
+func parseOutputFormat(name string) (outputFormat, error) {
+	for f, n := range outputFormatNames {
+		if strings.EqualFold(n, name) {
+			return f, nil
+		}
+	}
+	return formatText, fmt.Errorf("unknown format %q, expecting text or json", name)
+}
+
+type jsonResponse struct {
+	Result result `json:"result,omitempty"`
+	Error  string `json:"error,omitempty"`
+	Code   string `json:"code,omitempty"`
+}
+
+// writeResponse writes either the result or the error with its code in the
+// given format, each response on its own line after an empty one.
+func writeResponse(connection net.Conn, format outputFormat, res result, err error) error {
+	var body string
+	switch {
+	case format == formatJSON:
+		response := jsonResponse{Result: res}
+		if err != nil {
+			response = jsonResponse{Error: err.Error(), Code: errorCode(err)}
+		}
+		encoded, marshalErr := json.Marshal(response)
+		if marshalErr != nil {
+			return marshalErr
+		}
+		body = string(encoded)
+	case err != nil:
+		body = "ERROR " + errorCode(err) + ": " + err.Error()
+	default:
+		body = res.text()
+	}
+	_, err = connection.Write([]byte("\n" + body + "\n"))
+	return err
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	gomock "github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteResponse(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name        string
+		givenFormat outputFormat
+		givenResult result
+		givenError  error
+		wantWrite   string
+	}{
+		{
+			name:        "text result",
+			givenFormat: formatText,
+			givenResult: message("Package added"),
+			wantWrite:   "\nPackage added\n",
+		},
+		{
+			name:        "text error",
+			givenFormat: formatText,
+			givenError:  fmt.Errorf("%w: AAA", ErrNotFound),
+			wantWrite:   "\nERROR not_found: package not exists: AAA\n",
+		},
+		{
+			name:        "text list with a dependency in another namespace",
+			givenFormat: formatText,
+			givenResult: packageList{
+				{Name: "AAA", DependsOn: []string{"other/CCC"}, RequiredBy: []string{"BBB"}},
+				{Name: "BBB", DependsOn: []string{"AAA"}},
+			},
+			wantWrite: "\nPackages and Dependencies\n- AAA\n    - other/CCC\n- BBB\n    - AAA\n        - other/CCC\n",
+		},
+		{
+			name:        "text list with a group",
+			givenFormat: formatText,
+			givenResult: packageList{
+				{Name: "AAA", RequiredBy: []string{"base"}},
+				{Name: "base", Group: true, DependsOn: []string{"AAA"}},
+			},
+			wantWrite: "\nPackages and Dependencies\n- AAA\n- base (group)\n    - AAA\n",
+		},
+		{
+			name:        "text group",
+			givenFormat: formatText,
+			givenResult: packageInfo{Name: "base", Group: true, DependsOn: []string{"AAA", "BBB"}},
+			wantWrite:   "\nGroup base\n- Members: AAA, BBB\n",
+		},
+		{
+			name:        "json result",
+			givenFormat: formatJSON,
+			givenResult: packageList{{Name: "AAA", DependsOn: []string{}, RequiredBy: []string{"BBB"}}},
+			wantWrite:   "\n" + `{"result":[{"name":"AAA","depends_on":[],"required_by":["BBB"]}]}` + "\n",
+		},
+		{
+			name:        "json error",
+			givenFormat: formatJSON,
+			givenError:  fmt.Errorf("%w: AAA", ErrNotFound),
+			wantWrite:   "\n" + `{"error":"package not exists: AAA","code":"not_found"}` + "\n",
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			netConnMock := NewNetConnMock(ctrl)
+			netConnMock.EXPECT().Write([]byte(tc.wantWrite)).Return(len(tc.wantWrite), nil)
+
+			require.NoError(t, writeResponse(netConnMock, tc.givenFormat, tc.givenResult, tc.givenError))
+		})
+	}
+}
+
+func TestParseOutputFormat(t *testing.T) {
+	t.Parallel()
+
+	f, err := parseOutputFormat("JSON")
+	require.NoError(t, err)
+	assert.Equal(t, formatJSON, f)
+
+	_, err = parseOutputFormat("xml")
+	assert.EqualError(t, err, `unknown format "xml", expecting text or json`)
+}
+
+func TestGraphProblems(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, "Graph Check\n- No problems found", graphProblems(nil).text())
+	assert.Equal(t, "Graph Check\n- AAA depends on itself\n- BBB depends on missing package CCC",
+		graphProblems{"AAA depends on itself", "BBB depends on missing package CCC"}.text())
+
+	encoded, err := json.Marshal(jsonResponse{Result: graphProblems(nil)})
+	require.NoError(t, err)
+	assert.Equal(t, `{"result":[]}`, string(encoded))
+}
+
+func TestPackageHistoryText(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, "Package AAA History\n- No changes retained", packageHistory{Name: "AAA"}.text())
+
+	at := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	history := packageHistory{Name: "BBB", Changes: []packageChange{
+		{Revision: 3, Time: at, Op: packageWasAdded, DependsOn: []string{}},
+		{Revision: 5, Time: at.Add(time.Hour), Op: packageWasUpdated, DependsOn: []string{"AAA", "CCC"}},
+		{Revision: 6, Time: at.Add(2 * time.Hour), Op: packageWasRemoved, DependsOn: []string{}},
+	}}
+	assert.Equal(t, "Package BBB History\n"+
+		"- Revision 3 at 2026-10-18T12:00:00Z: added, depends on: none\n"+
+		"- Revision 5 at 2026-10-18T13:00:00Z: updated, depends on: AAA, CCC\n"+
+		"- Revision 6 at 2026-10-18T14:00:00Z: removed", history.text())
+}
+
+func TestRevertResultText(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, "Nothing to revert, already at revision 4", revertResult{To: 4, Revision: 4}.text())
+	assert.Equal(t, "Reverted to revision 4 with 3 changes, now at revision 9", revertResult{To: 4, Changes: 3, Revision: 9}.text())
+}
+
+func TestAuditRecordsText(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, "Audit Log\n- No audit records found", auditRecords(nil).text())
+
+	records := auditRecords{
+		{
+			Time:       time.Date(2021, 11, 1, 0, 0, 0, 0, time.UTC),
+			Identity:   "pacman_client",
+			RemoteAddr: "127.0.0.1:1234",
+			Command:    AddPackage,
+			Args:       []string{"BBB", "AAA"},
+			Outcome:    outcomeSuccess,
+		},
+		{
+			Time:       time.Date(2021, 11, 2, 0, 0, 0, 0, time.UTC),
+			Identity:   "pacman_client",
+			RemoteAddr: "127.0.0.1:1234",
+			Command:    RemovePackage,
+			Args:       []string{"AAA"},
+			Outcome:    outcomeError,
+			Error:      "package AAA cannot be removed",
+		},
+	}
+	assert.Equal(t, "Audit Log\n"+
+		`- 2021-11-01T00:00:00Z pacman_client 127.0.0.1:1234 AddPackage ["BBB" "AAA"] success`+"\n"+
+		`- 2021-11-02T00:00:00Z pacman_client 127.0.0.1:1234 RemovePackage ["AAA"] error: package AAA cannot be removed`,
+		records.text())
+}
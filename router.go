@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+)
+
+type permission int
+
+const (
+	permissionRead permission = iota
+	permissionWrite
+	permissionAdmin
+)
+
+var permissionNames = map[permission]string{
+	permissionRead:  "read",
+	permissionWrite: "write",
+	permissionAdmin: "admin",
+}
+
+func (p permission) String() string {
+	return permissionNames[p]
+}
+
+func parsePermission(name string) (permission, error) {
+	for p, n := range permissionNames {
+		if strings.EqualFold(n, name) {
+			return p, nil
+		}
+	}
+	return permissionRead, fmt.Errorf("unknown permission %q, expecting read, write or admin", name)
+}
+
+// session holds the state of one client connection across its commands.
+type session struct {
+	interactive bool
+	quit        bool
+	format      outputFormat
+}
+
+type request struct {
+	// ctx is cancelled when the connection closes or shutdown starts
+	ctx        context.Context
+	connection net.Conn
+	remoteAddr net.Addr
+	session    *session
+	identity   string
+	command    string
+	args       []string
+	// permission is the one required by the command, set by the router
+	permission permission
+	// audited is set by the router for commands changing the registry or
+	// the cluster
+	audited bool
+	// failure is the error the command responded with, if any
+	failure error
+}
+
+// reply writes the command's response in the session's output format.
+func (req *request) reply(res result, err error) error {
+	if err != nil {
+		req.failure = err
+	}
+	format := formatText
+	if req.session != nil {
+		format = req.session.format
+	}
+	return writeResponse(req.connection, format, res, err)
+}
+
+func (req *request) failed() bool {
+	return req.failure != nil
+}
+
+type commandFunc func(req *request) error
+
+// unlimited is used as maxArgs for commands taking any number of arguments.
+const unlimited = -1
+
+type command struct {
+	name        string
+	usage       string
+	description string
+	minArgs     int
+	maxArgs     int
+	permission  permission
+	// audited commands are recorded in the audit log, even when refused
+	audited bool
+	// readOnly commands with request IDs may run concurrently with each other
+	readOnly bool
+	run      commandFunc
+}
+
+func (c command) checkArgs(n int) error {
+	switch {
+	case c.minArgs == c.maxArgs && n != c.minArgs:
+		return fmt.Errorf("%s expects %d %s, usage: %s", c.name, c.minArgs, plural(c.minArgs, "argument"), c.usage)
+	case n < c.minArgs:
+		return fmt.Errorf("%s expects at least %d %s, usage: %s", c.name, c.minArgs, plural(c.minArgs, "argument"), c.usage)
+	case c.maxArgs != unlimited && n > c.maxArgs:
+		return fmt.Errorf("%s expects at most %d %s, usage: %s", c.name, c.maxArgs, plural(c.maxArgs, "argument"), c.usage)
+	}
+	return nil
+}
+
+func plural(n int, word string) string {
+	if n == 1 {
+		return word
+	}
+	return word + "s"
+}
+
+// router looks up commands case-insensitively, checks their arguments, then
+// runs them wrapped in its middlewares.
+type router struct {
+	commands    map[string]command
+	names       []string
+	middlewares []middleware
+}
+
+func newRouter() *router {
+	return &router{
+		commands: make(map[string]command),
+	}
+}
+
+func (r *router) use(mws ...middleware) {
+	r.middlewares = append(r.middlewares, mws...)
+}
+
+func (r *router) register(cmd command) {
+	key := strings.ToLower(cmd.name)
+	if _, exists := r.commands[key]; exists {
+		panic("command registered twice: " + cmd.name)
+	}
+	r.commands[key] = cmd
+	r.names = append(r.names, cmd.name)
+}
+
+func (r *router) lookup(name string) (command, bool) {
+	cmd, found := r.commands[strings.ToLower(name)]
+	return cmd, found
+}
+
+// dispatch runs the command, or replies why it cannot through the
+// middlewares too, so unknown commands and invalid arguments are counted.
+func (r *router) dispatch(req *request) error {
+	cmd, found := r.lookup(req.command)
+	run := cmd.run
+	if !found {
+		run = replyError(fmt.Errorf("%w%s", ErrUnknownCommand, didYouMean(req.command, r.names)))
+		// any name a client sends would be another metric label value
+		req.command = commandUnknown
+	} else {
+		req.command = cmd.name
+		req.permission = cmd.permission
+		req.audited = cmd.audited
+		if err := cmd.checkArgs(len(req.args)); err != nil {
+			run = replyError(err)
+		}
+	}
+
+	for i := len(r.middlewares) - 1; i >= 0; i-- {
+		run = r.middlewares[i](run)
+	}
+	return run(req)
+}
+
+func replyError(err error) commandFunc {
+	return func(req *request) error {
+		return req.reply(nil, err)
+	}
+}
+
+func (r *router) help() string {
+	width := 0
+	for _, name := range r.names {
+		width = maxInt(width, len(r.commands[strings.ToLower(name)].usage))
+	}
+	output := "Commands\n"
+	for _, name := range r.names {
+		cmd := r.commands[strings.ToLower(name)]
+		output += fmt.Sprintf("- %-*s  %s\n", width, cmd.usage, cmd.description)
+	}
+	output += "Prefix a command with #id to get the id echoed back in its response, then with\n" +
+		"@namespace to name packages of that namespace instead of the default one."
+	return output
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	gomock "github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePermission(t *testing.T) {
+	t.Parallel()
+
+	for _, p := range []permission{permissionRead, permissionWrite, permissionAdmin} {
+		parsed, err := parsePermission(p.String())
+		require.NoError(t, err)
+		assert.Equal(t, p, parsed)
+	}
+	parsed, err := parsePermission("WRITE")
+	require.NoError(t, err)
+	assert.Equal(t, permissionWrite, parsed)
+
+	_, err = parsePermission("root")
+	assert.EqualError(t, err, `unknown permission "root", expecting read, write or admin`)
+}
+
+func TestCommandCheckArgs(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		given     command
+		givenArgs int
+		wantError error
+	}{
+		{
+			name:      "exact number of args",
+			given:     command{name: "Get", usage: "Get name", minArgs: 1, maxArgs: 1},
+			givenArgs: 1,
+		},
+		{
+			name:      "not exact number of args",
+			given:     command{name: "Get", usage: "Get name", minArgs: 1, maxArgs: 1},
+			givenArgs: 2,
+			wantError: errors.New("Get expects 1 argument, usage: Get name"),
+		},
+		{
+			name:      "no args expected",
+			given:     command{name: "List", usage: "List"},
+			givenArgs: 1,
+			wantError: errors.New("List expects 0 arguments, usage: List"),
+		},
+		{
+			name:      "too few args",
+			given:     command{name: "Add", usage: "Add name [dep ...]", minArgs: 1, maxArgs: unlimited},
+			givenArgs: 0,
+			wantError: errors.New("Add expects at least 1 argument, usage: Add name [dep ...]"),
+		},
+		{
+			name:      "unlimited args",
+			given:     command{name: "Add", usage: "Add name [dep ...]", minArgs: 1, maxArgs: unlimited},
+			givenArgs: 100,
+		},
+		{
+			name:      "too many args",
+			given:     command{name: "Log", usage: "Log [a] [b]", maxArgs: 2},
+			givenArgs: 3,
+			wantError: errors.New("Log expects at most 2 arguments, usage: Log [a] [b]"),
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			err := tc.given.checkArgs(tc.givenArgs)
+			if tc.wantError != nil {
+				assert.EqualError(t, err, tc.wantError.Error())
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestRouterDispatch(t *testing.T) {
+	t.Parallel()
+
+	newTestRouter := func(ran *[]string) *router {
+		r := newRouter()
+		r.use(authorization(func(identity string) permission {
+			if identity == "admin" {
+				return permissionAdmin
+			}
+			return permissionRead
+		}))
+		r.register(command{
+			name:       "GetThing",
+			usage:      "GetThing name",
+			minArgs:    1,
+			maxArgs:    1,
+			permission: permissionRead,
+			run: func(req *request) error {
+				*ran = append(*ran, req.command+" "+req.args[0])
+				return nil
+			},
+		})
+		r.register(command{
+			name:       "DropThing",
+			usage:      "DropThing",
+			permission: permissionAdmin,
+			run: func(req *request) error {
+				*ran = append(*ran, req.command)
+				return nil
+			},
+		})
+		return r
+	}
+
+	tests := []struct {
+		name         string
+		givenCommand string
+		givenArgs    []string
+		givenID      string
+		wantWrite    string
+		wantRan      []string
+	}{
+		{
+			name:         "case insensitive",
+			givenCommand: "getthing",
+			givenArgs:    []string{"AAA"},
+			wantRan:      []string{"GetThing AAA"},
+		},
+		{
+			name:         "unknown command with suggestion",
+			givenCommand: "GetThin",
+			wantWrite:    "\nERROR unknown_command: unknown action, did you mean GetThing?\n",
+		},
+		{
+			name:         "invalid args",
+			givenCommand: "GetThing",
+			wantWrite:    "\nERROR bad_request: GetThing expects 1 argument, usage: GetThing name\n",
+		},
+		{
+			name:         "permission denied",
+			givenCommand: "DropThing",
+			givenID:      "reader",
+			wantWrite:    "\nERROR permission_denied: permission denied, DropThing requires admin permission\n",
+		},
+		{
+			name:         "permission granted",
+			givenCommand: "DropThing",
+			givenID:      "admin",
+			wantRan:      []string{"DropThing"},
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			netConnMock := NewNetConnMock(ctrl)
+			if tc.wantWrite != "" {
+				netConnMock.EXPECT().Write([]byte(tc.wantWrite)).Return(0, nil)
+			}
+
+			var ran []string
+			r := newTestRouter(&ran)
+			err := r.dispatch(&request{
+				connection: netConnMock,
+				session:    &session{},
+				identity:   tc.givenID,
+				command:    tc.givenCommand,
+				args:       tc.givenArgs,
+			})
+			require.NoError(t, err)
+			assert.Equal(t, tc.wantRan, ran)
+		})
+	}
+}
+
+func TestRouterRegisterTwice(t *testing.T) {
+	t.Parallel()
+
+	r := newRouter()
+	r.register(command{name: "Ping"})
+	assert.PanicsWithValue(t, "command registered twice: PING", func() {
+		r.register(command{name: "PING"})
+	})
+}
+
+func TestRouterHelp(t *testing.T) {
+	t.Parallel()
+
+	r := newRouter()
+	r.register(command{name: "AddThing", usage: "AddThing name [dep ...]", description: "add a thing"})
+	r.register(command{name: "Ping", usage: "Ping", description: "check the server"})
+
+	assert.Equal(t, "Commands\n"+
+		"- AddThing name [dep ...]  add a thing\n"+
+		"- Ping                     check the server\n"+
+		"Prefix a command with #id to get the id echoed back in its response, then with\n"+
+		"@namespace to name packages of that namespace instead of the default one.", r.help())
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+const prompt = "pacman> "
+
+func interactive(req *request) error {
+	on := len(req.args) == 0 || strings.EqualFold(req.args[0], "on")
+	if !on && !strings.EqualFold(req.args[0], "off") {
+		return req.reply(nil, errors.New("expecting on or off"))
+	}
+	req.session.interactive = on
+	if on {
+		return req.reply(message("Interactive mode on, type Help for commands and Quit to exit"), nil)
+	}
+	return req.reply(message("Interactive mode off"), nil)
+}
+
+func format(req *request) error {
+	if len(req.args) == 0 {
+		return req.reply(message("Output format is "+req.session.format.String()), nil)
+	}
+	f, err := parseOutputFormat(req.args[0])
+	if err != nil {
+		return req.reply(nil, err)
+	}
+	req.session.format = f
+	return req.reply(message("Output format is "+f.String()), nil)
+}
+
+func quit(req *request) error {
+	req.session.quit = true
+	return req.reply(message("Bye"), nil)
+}
+
+// didYouMean suggests the candidates closest to the misspelled name, or
+// returns an empty string when none of them is close enough.
+func didYouMean(name string, candidates []string) string {
+	suggestions := similar(name, candidates)
+	if len(suggestions) == 0 {
+		return ""
+	}
+	return ", did you mean " + strings.Join(suggestions, " or ") + "?"
+}
+
+const maxSuggestions = 3
+
+func similar(name string, candidates []string) []string {
+	type scored struct {
+		name     string
+		distance int
+	}
+	lowered := strings.ToLower(name)
+	// allow roughly one typo for every four characters
+	threshold := maxInt(1, len([]rune(name))/4)
+	var matches []scored
+	for _, candidate := range candidates {
+		if candidate == name {
+			return nil
+		}
+		if d := levenshtein(lowered, strings.ToLower(candidate)); d <= threshold {
+			matches = append(matches, scored{candidate, d})
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].distance != matches[j].distance {
+			return matches[i].distance < matches[j].distance
+		}
+		return matches[i].name < matches[j].name
+	})
+	var suggestions []string
+	for i := 0; i < len(matches) && i < maxSuggestions; i++ {
+		suggestions = append(suggestions, matches[i].name)
+	}
+	return suggestions
+}
+
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	previous := make([]int, len(rb)+1)
+	current := make([]int, len(rb)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		current[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			current[j] = minInt(minInt(previous[j]+1, current[j-1]+1), previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(rb)]
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLevenshtein(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"AAA", "", 3},
+		{"", "AAA", 3},
+		{"AAA", "AAA", 0},
+		{"AAA", "AAB", 1},
+		{"kitten", "sitting", 3},
+		{"ñandú", "nandu", 2},
+	}
+
+	for _, tc := range tests {
+		assert.Equal(t, tc.want, levenshtein(tc.a, tc.b), "%q and %q", tc.a, tc.b)
+	}
+}
+
+func TestDidYouMean(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name            string
+		givenName       string
+		givenCandidates []string
+		want            string
+	}{
+		{
+			name:            "no candidates",
+			givenName:       "AAA",
+			givenCandidates: nil,
+			want:            "",
+		},
+		{
+			name:            "exact match",
+			givenName:       "AAA",
+			givenCandidates: []string{"AAA", "AAB"},
+			want:            "",
+		},
+		{
+			name:            "nothing close enough",
+			givenName:       "AAA",
+			givenCandidates: []string{"BBB", "CCC"},
+			want:            "",
+		},
+		{
+			name:            "one typo",
+			givenName:       "AddPackge",
+			givenCandidates: []string{AddPackage, RemovePackage, ListPackages},
+			want:            ", did you mean AddPackage?",
+		},
+		{
+			name:            "closest first",
+			givenName:       "AAAA",
+			givenCandidates: []string{"AABB", "AAAB", "AAAC"},
+			want:            ", did you mean AAAB or AAAC?",
+		},
+		{
+			name:            "case insensitive",
+			givenName:       "getpakage",
+			givenCandidates: []string{GetPackage},
+			want:            ", did you mean GetPackage?",
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			assert.Equal(t, tc.want, didYouMean(tc.givenName, tc.givenCandidates))
+		})
+	}
+}
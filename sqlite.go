@@ -0,0 +1,852 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"go.uber.org/zap"
+)
+
+// sqliteMigrations upgrade the schema in order, the user_version of the
+// database tells how many were applied. Applied migrations must not change.
+var sqliteMigrations = []string{
+	`CREATE TABLE registry (
+		id INTEGER PRIMARY KEY CHECK (id = 1),
+		generation TEXT NOT NULL,
+		revision INTEGER NOT NULL
+	);
+	INSERT INTO registry (id, generation, revision) VALUES (1, lower(hex(randomblob(8))), 1);
+	CREATE TABLE packages (
+		name TEXT PRIMARY KEY
+	);
+	CREATE TABLE dependencies (
+		package TEXT NOT NULL REFERENCES packages (name) ON DELETE CASCADE,
+		dependency TEXT NOT NULL REFERENCES packages (name) ON DELETE RESTRICT,
+		PRIMARY KEY (package, dependency),
+		CHECK (package <> dependency)
+	);
+	CREATE INDEX dependencies_dependency ON dependencies (dependency, package);
+	CREATE TABLE changes (
+		revision INTEGER PRIMARY KEY,
+		op TEXT NOT NULL,
+		name TEXT NOT NULL,
+		deps TEXT NOT NULL,
+		previous TEXT
+	);`,
+	// changes and the registry get times, earlier changes are dated to the migration
+	`ALTER TABLE changes ADD COLUMN time INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE registry ADD COLUMN since INTEGER NOT NULL DEFAULT 0;
+	UPDATE changes SET time = strftime('%s', 'now') * 1000000000;
+	UPDATE registry SET since = strftime('%s', 'now') * 1000000000;
+	CREATE INDEX changes_name ON changes (name, revision);`,
+	// groups are packages depending on their members
+	`ALTER TABLE packages ADD COLUMN is_group INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE changes ADD COLUMN is_group INTEGER NOT NULL DEFAULT 0;`,
+}
+
+// sqliteStore keeps the registry in a SQLite database, where foreign keys
+// make dependencies point to existing packages and keep required packages
+// from being removed. Writers are serialized by the mutex, readers go
+// through their own transactions and never wait for writers in WAL mode.
+// The changes of retained revisions are kept along with the previous
+// dependencies of their package, to undo them when reading at a revision,
+// and since tells when the revision before the oldest one was made.
+type sqliteStore struct {
+	sync.Mutex
+	logger    *zap.Logger
+	db        *sql.DB
+	retain    int
+	quotas    namespaceQuotas
+	metrics   *metrics
+	published atomic.Value // chan struct{}, closed on every write
+}
+
+func newSQLiteStore(lg *zap.Logger, cfg *config, m *metrics) (*sqliteStore, error) {
+	db, err := sql.Open("sqlite3", "file:"+cfg.SQLiteFile+"?_foreign_keys=on&_journal_mode=WAL&_busy_timeout=5000")
+	if err != nil {
+		return nil, fmt.Errorf("cannot open SQLite database: %w", err)
+	}
+	store := &sqliteStore{
+		logger:  lg,
+		db:      db,
+		retain:  maxInt(cfg.HistoryRetain, 1),
+		quotas:  cfg.NamespaceQuotas,
+		metrics: m,
+	}
+	store.published.Store(make(chan struct{}))
+	if err := store.migrate(context.Background()); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	var packages, edges int
+	err = db.QueryRow(`SELECT (SELECT count(*) FROM packages), (SELECT count(*) FROM dependencies)`).Scan(&packages, &edges)
+	if err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("cannot read SQLite database: %w", err)
+	}
+	m.registryChanged(packages, edges)
+	return store, nil
+}
+
+func (store *sqliteStore) migrate(ctx context.Context) error {
+	var version int
+	if err := store.db.QueryRowContext(ctx, `PRAGMA user_version`).Scan(&version); err != nil {
+		return fmt.Errorf("cannot read SQLite schema version: %w", err)
+	}
+	if version > len(sqliteMigrations) {
+		return fmt.Errorf("SQLite schema version %d is newer than the latest known version %d", version, len(sqliteMigrations))
+	}
+	for ; version < len(sqliteMigrations); version++ {
+		err := store.transaction(ctx, func(tx *sql.Tx) error {
+			if _, err := tx.ExecContext(ctx, sqliteMigrations[version]); err != nil {
+				return err
+			}
+			_, err := tx.ExecContext(ctx, fmt.Sprintf(`PRAGMA user_version = %d`, version+1))
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("cannot migrate SQLite schema to version %d: %w", version+1, err)
+		}
+		store.logger.Info("migrated SQLite schema", zap.Int("version", version+1))
+	}
+	return nil
+}
+
+func (store *sqliteStore) close() error {
+	return store.db.Close()
+}
+
+// transaction commits when fn succeeds and rolls back otherwise.
+func (store *sqliteStore) transaction(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := store.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// read runs fn in a transaction seeing a single revision of the registry.
+func (store *sqliteStore) read(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	tx, err := store.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return sqliteFailed(err)
+	}
+	defer tx.Rollback()
+	return sqliteFailed(fn(tx))
+}
+
+// sqliteFailed tells database failures apart from the errors of the
+// registry, which are returned as is.
+func sqliteFailed(err error) error {
+	var stillRequired *StillRequiredError
+	for _, known := range []error{nil, ErrAlreadyExists, ErrNotFound, ErrDependencyCycle, ErrUnknownRevision, ErrQuotaExceeded, context.Canceled, context.DeadlineExceeded} {
+		if errors.Is(err, known) {
+			return err
+		}
+	}
+	if errors.As(err, &stillRequired) {
+		return err
+	}
+	return fmt.Errorf("%w: sqlite: %s", ErrInternal, err)
+}
+
+func (store *sqliteStore) lock() {
+	start := time.Now()
+	store.Lock()
+	store.metrics.observeLockWait("write", start)
+}
+
+func (store *sqliteStore) ready() error {
+	if err := store.db.Ping(); err != nil {
+		return fmt.Errorf("cannot reach SQLite database: %w", err)
+	}
+	return nil
+}
+
+func (store *sqliteStore) revision(ctx context.Context) uint64 {
+	var rev uint64
+	if err := store.db.QueryRowContext(ctx, `SELECT revision FROM registry`).Scan(&rev); err != nil {
+		store.logger.Error("cannot read SQLite registry revision", zap.Error(err))
+	}
+	return rev
+}
+
+func (store *sqliteStore) add(ctx context.Context, name string, deps []string, upsert bool) (addResult, error) {
+	return store.insert(ctx, name, deps, upsert, false)
+}
+
+func (store *sqliteStore) createGroup(ctx context.Context, name string, members []string, upsert bool) (addResult, error) {
+	return store.insert(ctx, name, members, upsert, true)
+}
+
+func (store *sqliteStore) insert(ctx context.Context, name string, deps []string, upsert, group bool) (addResult, error) {
+	if err := validatePackageName(name); err != nil {
+		return packageUnchanged, err
+	}
+	deps, err := normalizeDeps(name, deps)
+	if err != nil {
+		return packageUnchanged, err
+	}
+
+	store.lock()
+	defer store.Unlock()
+
+	// the lock may have taken a while, don't mutate for a client that's gone
+	if err := ctx.Err(); err != nil {
+		return packageUnchanged, err
+	}
+	result := packageAdded
+	var packages, edges int
+	err = store.transaction(ctx, func(tx *sql.Tx) error {
+		validDeps, err := expandGroups(ctx, tx, name, deps, group)
+		if err != nil {
+			return err
+		}
+		exists, isGroup, err := packageKind(ctx, tx, name)
+		if err != nil {
+			return err
+		}
+		var previous []string
+		if exists {
+			if previous, err = dependenciesOf(ctx, tx, name); err != nil {
+				return err
+			}
+			if isGroup == group && equalNames(previous, validDeps) {
+				result = packageUnchanged
+				return nil
+			}
+			if !upsert || isGroup != group {
+				requiredBy, err := dependentsOf(ctx, tx, name)
+				if err != nil {
+					return err
+				}
+				pkg := onePackage{name: name, group: isGroup, dependsOn: previous, requiredBy: requiredBy}
+				return fmt.Errorf("%w: %s", ErrAlreadyExists, pkg.String())
+			}
+			for _, dep := range validDeps {
+				cycle, err := dependsOn(ctx, tx, dep, name)
+				if err != nil {
+					return err
+				}
+				if cycle {
+					return fmt.Errorf("%w: %s cannot depend on %s, which depends on %s", ErrDependencyCycle, name, dep, name)
+				}
+			}
+			result = packageUpdated
+		} else if err := store.checkQuota(ctx, tx, name); err != nil {
+			return err
+		}
+		packages, edges, err = store.write(ctx, tx, mutation{change{Op: opAdd, Name: name, Deps: validDeps, Group: group}, exists, previous})
+		return err
+	})
+	if err != nil {
+		return packageUnchanged, sqliteFailed(err)
+	}
+	if result != packageUnchanged {
+		store.publish(packages, edges)
+	}
+	return result, nil
+}
+
+func (store *sqliteStore) remove(ctx context.Context, name string) error {
+	store.lock()
+	defer store.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	var edges int
+	err := store.transaction(ctx, func(tx *sql.Tx) error {
+		exists, group, err := packageKind(ctx, tx, name)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("%w: %s", ErrNotFound, name)
+		}
+		requiredBy, err := dependentsOf(ctx, tx, name)
+		if err != nil {
+			return err
+		}
+		if len(requiredBy) > 0 {
+			return &StillRequiredError{Name: name, RequiredBy: requiredBy}
+		}
+		previous, err := dependenciesOf(ctx, tx, name)
+		if err != nil {
+			return err
+		}
+		_, edges, err = store.write(ctx, tx, mutation{change{Op: opRemove, Name: name, Group: group}, true, previous})
+		return err
+	})
+	if err != nil {
+		return sqliteFailed(err)
+	}
+	store.publish(-1, edges)
+	return nil
+}
+
+// revert undoes the revisions after the target one, each with a new
+// revision, all or none.
+func (store *sqliteStore) revert(ctx context.Context, target revertTarget) (revertResult, error) {
+	store.lock()
+	defer store.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return revertResult{}, err
+	}
+	var reverted revertResult
+	var packages, edges int
+	err := store.transaction(ctx, func(tx *sql.Tx) error {
+		current, err := load(ctx, tx, latestRevision)
+		if err != nil {
+			return err
+		}
+		_, oldest, err := revisions(ctx, tx)
+		if err != nil {
+			return err
+		}
+		to, err := target.revision(current.revision, oldest)
+		if err != nil {
+			return err
+		}
+		mutations, err := queryMutations(ctx, tx, `WHERE revision > ? ORDER BY revision`, to)
+		if err != nil {
+			return err
+		}
+		reverts, err := revertChanges(current, mutations)
+		if err != nil {
+			return err
+		}
+		for _, m := range reverts {
+			p, e, err := store.write(ctx, tx, m)
+			if err != nil {
+				return err
+			}
+			packages, edges = packages+p, edges+e
+		}
+		reverted = revertResult{To: to, Changes: len(reverts), Revision: current.revision + uint64(len(reverts))}
+		return nil
+	})
+	if err != nil {
+		return revertResult{}, sqliteFailed(err)
+	}
+	if reverted.Changes > 0 {
+		store.publish(packages, edges)
+	}
+	return reverted, nil
+}
+
+// checkQuota fails adding a package to a namespace already holding its
+// quota of packages.
+func (store *sqliteStore) checkQuota(ctx context.Context, tx *sql.Tx, name string) error {
+	ns := namespaceOf(name)
+	quota := store.quotas[ns]
+	if quota <= 0 {
+		return nil
+	}
+	// names of a namespace sort between ns/ and ns0, as '0' follows '/'
+	query, args := `SELECT count(*) FROM packages WHERE name >= ? AND name < ?`, []interface{}{ns + "/", ns + "0"}
+	if ns == defaultNamespace {
+		query, args = `SELECT count(*) FROM packages WHERE instr(name, '/') = 0`, nil
+	}
+	var count int
+	if err := tx.QueryRowContext(ctx, query, args...).Scan(&count); err != nil {
+		return err
+	}
+	return quotaExceeded(ns, count, quota)
+}
+
+// write makes the mutation and records it, and returns how many packages
+// and edges that added.
+func (store *sqliteStore) write(ctx context.Context, tx *sql.Tx, m mutation) (packages, edges int, err error) {
+	switch {
+	case m.Op == opRemove:
+		// its dependencies are deleted along with it
+		_, err = tx.ExecContext(ctx, `DELETE FROM packages WHERE name = ?`, m.Name)
+		packages = -1
+	case m.existed:
+		_, err = tx.ExecContext(ctx, `DELETE FROM dependencies WHERE package = ?`, m.Name)
+	default:
+		_, err = tx.ExecContext(ctx, `INSERT INTO packages (name, is_group) VALUES (?, ?)`, m.Name, m.Group)
+		packages = 1
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	edges = -len(m.previous)
+	if m.Op == opAdd {
+		for _, dep := range m.Deps {
+			if _, err := tx.ExecContext(ctx, `INSERT INTO dependencies (package, dependency) VALUES (?, ?)`, m.Name, dep); err != nil {
+				return 0, 0, err
+			}
+		}
+		edges += len(m.Deps)
+	}
+	return packages, edges, store.record(ctx, tx, m.change, m.existed, m.previous)
+}
+
+// record bumps the revision and keeps the change that made it, along with
+// when, whether the package existed and its previous dependencies. Only the
+// changes of retained revisions are kept.
+func (store *sqliteStore) record(ctx context.Context, tx *sql.Tx, c change, existed bool, previous []string) error {
+	if _, err := tx.ExecContext(ctx, `UPDATE registry SET revision = revision + 1`); err != nil {
+		return err
+	}
+	if err := tx.QueryRowContext(ctx, `SELECT revision FROM registry`).Scan(&c.Revision); err != nil {
+		return err
+	}
+	deps, err := json.Marshal(append([]string{}, c.Deps...))
+	if err != nil {
+		return err
+	}
+	var previousDeps sql.NullString
+	if existed {
+		encoded, err := json.Marshal(append([]string{}, previous...))
+		if err != nil {
+			return err
+		}
+		previousDeps = sql.NullString{String: string(encoded), Valid: true}
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO changes (revision, time, op, name, deps, previous, is_group) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		c.Revision, time.Now().UnixNano(), c.Op, c.Name, string(deps), previousDeps, c.Group)
+	if err != nil {
+		return err
+	}
+	trimmed := int64(c.Revision) - int64(store.retain) + 1
+	_, err = tx.ExecContext(ctx, `UPDATE registry SET since = coalesce((SELECT max(time) FROM changes WHERE revision <= ?), since)`, trimmed)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `DELETE FROM changes WHERE revision <= ?`, trimmed)
+	return err
+}
+
+// publish wakes followers up once a write is committed, must be called with
+// the lock held.
+func (store *sqliteStore) publish(packages, edges int) {
+	previous := store.published.Load().(chan struct{})
+	store.published.Store(make(chan struct{}))
+	close(previous)
+	store.metrics.registryChanged(packages, edges)
+}
+
+func packageExists(ctx context.Context, tx *sql.Tx, name string) (bool, error) {
+	var exists bool
+	err := tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM packages WHERE name = ?)`, name).Scan(&exists)
+	return exists, err
+}
+
+// packageKind tells whether a package exists and whether it is a group.
+func packageKind(ctx context.Context, tx *sql.Tx, name string) (exists, group bool, err error) {
+	err = tx.QueryRowContext(ctx, `SELECT is_group FROM packages WHERE name = ?`, name).Scan(&group)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, false, nil
+	}
+	return err == nil, group, err
+}
+
+// expandGroups returns the sorted set of deps that exist, with the members
+// of groups in place of the groups. The members of a group must all exist.
+func expandGroups(ctx context.Context, tx *sql.Tx, name string, deps []string, group bool) ([]string, error) {
+	var expanded []string
+	for _, dep := range deps {
+		exists, isGroup, err := packageKind(ctx, tx, dep)
+		switch {
+		case err != nil:
+			return nil, err
+		case !exists && group:
+			return nil, fmt.Errorf("%w: %s, a member of group %s", ErrNotFound, dep, name)
+		case !exists:
+		case isGroup:
+			members, err := dependenciesOf(ctx, tx, dep)
+			if err != nil {
+				return nil, err
+			}
+			for _, member := range members {
+				if member == name {
+					return nil, fmt.Errorf("%w: %s cannot depend on itself, a member of group %s", ErrDependencyCycle, name, dep)
+				}
+				expanded = insertName(expanded, member)
+			}
+		default:
+			expanded = insertName(expanded, dep)
+		}
+	}
+	return expanded, nil
+}
+
+func dependenciesOf(ctx context.Context, tx *sql.Tx, name string) ([]string, error) {
+	return queryNames(ctx, tx, `SELECT dependency FROM dependencies WHERE package = ? ORDER BY dependency`, name)
+}
+
+func dependentsOf(ctx context.Context, tx *sql.Tx, name string) ([]string, error) {
+	return queryNames(ctx, tx, `SELECT package FROM dependencies WHERE dependency = ? ORDER BY package`, name)
+}
+
+// dependsOn tells whether pkgName depends on target, directly or not.
+func dependsOn(ctx context.Context, tx *sql.Tx, pkgName, target string) (bool, error) {
+	var found bool
+	err := tx.QueryRowContext(ctx, `WITH RECURSIVE reachable (name) AS (
+			SELECT dependency FROM dependencies WHERE package = ?
+			UNION SELECT dependencies.dependency FROM dependencies JOIN reachable ON dependencies.package = reachable.name
+		)
+		SELECT EXISTS (SELECT 1 FROM reachable WHERE name = ?)`, pkgName, target).Scan(&found)
+	return found, err
+}
+
+// queryNames returns the first column of every row, nil without rows.
+func queryNames(ctx context.Context, tx *sql.Tx, query string, args ...interface{}) ([]string, error) {
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// revisions returns the generation and latest revision of the registry, and
+// the oldest revision its changes can be undone to.
+func revisions(ctx context.Context, tx *sql.Tx) (*snapshot, uint64, error) {
+	latest := &snapshot{packages: make(map[string]onePackage)}
+	var oldestChange sql.NullInt64
+	err := tx.QueryRowContext(ctx, `SELECT generation, revision, (SELECT min(revision) FROM changes) FROM registry`).
+		Scan(&latest.generation, &latest.revision, &oldestChange)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !oldestChange.Valid {
+		return latest, latest.revision, nil
+	}
+	return latest, uint64(oldestChange.Int64) - 1, nil
+}
+
+// load reads the registry of the given revision, or the latest one, by
+// undoing the changes that came after it.
+func load(ctx context.Context, tx *sql.Tx, rev uint64) (*snapshot, error) {
+	snap, oldest, err := revisions(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case rev == latestRevision:
+		rev = snap.revision
+	case rev > snap.revision:
+		return nil, fmt.Errorf("%w %d: the latest revision is %d", ErrUnknownRevision, rev, snap.revision)
+	case rev < oldest:
+		return nil, fmt.Errorf("%w %d: the oldest retained revision is %d", ErrUnknownRevision, rev, oldest)
+	}
+
+	pkgRows, err := tx.QueryContext(ctx, `SELECT name, is_group FROM packages`)
+	if err != nil {
+		return nil, err
+	}
+	defer pkgRows.Close()
+	for pkgRows.Next() {
+		var pkg onePackage
+		if err := pkgRows.Scan(&pkg.name, &pkg.group); err != nil {
+			return nil, err
+		}
+		snap.packages[pkg.name] = pkg
+	}
+	if err := pkgRows.Err(); err != nil {
+		return nil, err
+	}
+	rows, err := tx.QueryContext(ctx, `SELECT package, dependency FROM dependencies ORDER BY package, dependency`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name, dep string
+		if err := rows.Scan(&name, &dep); err != nil {
+			return nil, err
+		}
+		pkg := snap.packages[name]
+		pkg.dependsOn = append(pkg.dependsOn, dep)
+		snap.packages[name] = pkg
+		snap.addRequiredBy(dep, name)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	mutations, err := queryMutations(ctx, tx, `WHERE revision > ? ORDER BY revision`, rev)
+	if err != nil {
+		return nil, err
+	}
+	snap.undo(mutations)
+	snap.revision = rev
+	return snap, nil
+}
+
+// queryMutations returns the recorded changes matching the where clause.
+func queryMutations(ctx context.Context, tx *sql.Tx, where string, args ...interface{}) ([]mutation, error) {
+	rows, err := tx.QueryContext(ctx, `SELECT revision, time, op, name, deps, previous, is_group FROM changes `+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var changes []mutation
+	for rows.Next() {
+		var c mutation
+		var made int64
+		var deps string
+		var previous sql.NullString
+		if err := rows.Scan(&c.Revision, &made, &c.Op, &c.Name, &deps, &previous, &c.Group); err != nil {
+			return nil, err
+		}
+		c.Time = time.Unix(0, made).UTC()
+		if err := json.Unmarshal([]byte(deps), &c.Deps); err != nil {
+			return nil, err
+		}
+		c.Deps = sortedNames(c.Deps)
+		if previous.Valid {
+			if err := json.Unmarshal([]byte(previous.String), &c.previous); err != nil {
+				return nil, err
+			}
+			c.existed, c.previous = true, sortedNames(c.previous)
+		}
+		changes = append(changes, c)
+	}
+	return changes, rows.Err()
+}
+
+func (store *sqliteStore) list(ctx context.Context, rev uint64) ([]packageInfo, error) {
+	var pkgs []packageInfo
+	err := store.read(ctx, func(tx *sql.Tx) error {
+		snap, err := load(ctx, tx, rev)
+		if err != nil {
+			return err
+		}
+		pkgs = snap.infos()
+		return nil
+	})
+	return pkgs, err
+}
+
+func (store *sqliteStore) get(ctx context.Context, name string, rev uint64) (packageInfo, error) {
+	var pkg packageInfo
+	err := store.read(ctx, func(tx *sql.Tx) error {
+		if rev == latestRevision {
+			exists, group, err := packageKind(ctx, tx, name)
+			if err != nil || !exists {
+				return err
+			}
+			one := onePackage{name: name, group: group}
+			if one.dependsOn, err = dependenciesOf(ctx, tx, name); err != nil {
+				return err
+			}
+			if one.requiredBy, err = dependentsOf(ctx, tx, name); err != nil {
+				return err
+			}
+			pkg = one.info()
+			return nil
+		}
+		snap, err := load(ctx, tx, rev)
+		if err != nil {
+			return err
+		}
+		if one, exists := snap.packages[name]; exists {
+			pkg = one.info()
+		}
+		return nil
+	})
+	if err == nil && pkg.Name == "" {
+		err = fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	return pkg, err
+}
+
+func (store *sqliteStore) names(ctx context.Context) []string {
+	var names []string
+	err := store.read(ctx, func(tx *sql.Tx) error {
+		var err error
+		names, err = queryNames(ctx, tx, `SELECT name FROM packages ORDER BY name`)
+		return err
+	})
+	if err != nil {
+		return nil
+	}
+	return names
+}
+
+// check asks SQLite to verify the database and the dependencies refer to
+// existing packages, which foreign keys normally enforce, and reports
+// packages depending on themselves, directly or not, or on groups.
+func (store *sqliteStore) check(ctx context.Context) ([]string, error) {
+	var problems []string
+	err := store.read(ctx, func(tx *sql.Tx) error {
+		results, err := queryNames(ctx, tx, `PRAGMA quick_check`)
+		if err != nil {
+			return err
+		}
+		if len(results) != 1 || results[0] != "ok" {
+			problems = append(problems, results...)
+		}
+		rows, err := tx.QueryContext(ctx, `SELECT package, dependency FROM dependencies
+			WHERE package NOT IN (SELECT name FROM packages) OR dependency NOT IN (SELECT name FROM packages)
+			ORDER BY package, dependency`)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var name, dep string
+			if err := rows.Scan(&name, &dep); err != nil {
+				return err
+			}
+			problems = append(problems, fmt.Sprintf("%s depends on %s, either of which is missing", name, dep))
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		cycles, err := queryNames(ctx, tx, `WITH RECURSIVE reachable (origin, name) AS (
+				SELECT package, dependency FROM dependencies
+				UNION SELECT reachable.origin, dependencies.dependency FROM reachable JOIN dependencies ON dependencies.package = reachable.name
+			)
+			SELECT DISTINCT origin FROM reachable WHERE origin = name ORDER BY origin`)
+		if err != nil {
+			return err
+		}
+		for _, name := range cycles {
+			problems = append(problems, fmt.Sprintf("%s depends on itself", name))
+		}
+		onGroups, err := tx.QueryContext(ctx, `SELECT package, dependency FROM dependencies
+			JOIN packages ON packages.name = dependencies.dependency WHERE packages.is_group
+			ORDER BY package, dependency`)
+		if err != nil {
+			return err
+		}
+		defer onGroups.Close()
+		for onGroups.Next() {
+			var name, group string
+			if err := onGroups.Scan(&name, &group); err != nil {
+				return err
+			}
+			problems = append(problems, fmt.Sprintf("%s depends on group %s instead of its members", name, group))
+		}
+		return onGroups.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return problems, nil
+}
+
+// follow returns what a follower at the given generation and revision is
+// missing, and a channel closed once there is more. When the database cannot
+// be read, it is only a heartbeat and the follower asks again later.
+func (store *sqliteStore) follow(generation string, rev uint64) (replicationUpdate, <-chan struct{}) {
+	published := store.published.Load().(chan struct{})
+	ctx := context.Background()
+	var update replicationUpdate
+	err := store.read(ctx, func(tx *sql.Tx) error {
+		latest, oldest, err := revisions(ctx, tx)
+		if err != nil {
+			return err
+		}
+		update.Generation, update.Revision = latest.generation, latest.revision
+		if generation == latest.generation && rev >= oldest && rev <= latest.revision {
+			changes, err := queryMutations(ctx, tx, `WHERE revision > ? ORDER BY revision`, rev)
+			for _, c := range changes {
+				update.Changes = append(update.Changes, c.change)
+			}
+			return err
+		}
+		snap, err := load(ctx, tx, latestRevision)
+		if err != nil {
+			return err
+		}
+		update.Snapshot, update.Full = snap.infos(), true
+		return nil
+	})
+	if err != nil {
+		store.logger.Error("cannot read SQLite registry for followers", zap.Error(err))
+		return replicationUpdate{Generation: generation, Revision: rev}, published
+	}
+	return update, published
+}
+
+func (store *sqliteStore) revisionAt(ctx context.Context, at time.Time) (uint64, error) {
+	rev := latestRevision
+	err := store.read(ctx, func(tx *sql.Tx) error {
+		var made sql.NullInt64
+		if err := tx.QueryRowContext(ctx, `SELECT max(revision) FROM changes WHERE time <= ?`, at.UnixNano()).Scan(&made); err != nil {
+			return err
+		}
+		if made.Valid {
+			rev = uint64(made.Int64)
+			return nil
+		}
+		_, oldest, err := revisions(ctx, tx)
+		if err != nil {
+			return err
+		}
+		var since int64
+		if err := tx.QueryRowContext(ctx, `SELECT since FROM registry`).Scan(&since); err != nil {
+			return err
+		}
+		rev, err = revisionAt(at, nil, oldest, time.Unix(0, since).UTC())
+		return err
+	})
+	return rev, err
+}
+
+func (store *sqliteStore) packageHistory(ctx context.Context, name string) (packageHistory, error) {
+	found := packageHistory{Name: name, Changes: []packageChange{}}
+	err := store.read(ctx, func(tx *sql.Tx) error {
+		mutations, err := queryMutations(ctx, tx, `WHERE name = ? ORDER BY revision`, name)
+		if err != nil {
+			return err
+		}
+		for _, m := range mutations {
+			found.Changes = append(found.Changes, m.packageChange())
+		}
+		if len(found.Changes) > 0 {
+			return nil
+		}
+		exists, err := packageExists(ctx, tx, name)
+		if err == nil && !exists {
+			err = fmt.Errorf("%w: %s", ErrNotFound, name)
+		}
+		return err
+	})
+	if err != nil {
+		return packageHistory{}, err
+	}
+	return found, nil
+}
+
+func (store *sqliteStore) replication() replicationStatus {
+	return replicationStatus{Role: rolePrimary, Connected: true, Revision: store.revision(context.Background())}
+}
+
+func (store *sqliteStore) join(ctx context.Context, id, addr string) error {
+	return fmt.Errorf("%w, start it with a raft node ID", ErrNotClustered)
+}
+
+func (store *sqliteStore) leave(ctx context.Context, id string) error {
+	return fmt.Errorf("%w, start it with a raft node ID", ErrNotClustered)
+}
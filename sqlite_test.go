@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// newSQLiteStoreWith opens a new database in a temporary directory, seeded
+// with packages at revision 1 when given.
+func newSQLiteStoreWith(t *testing.T, m *metrics, retain int, pkgs map[string]onePackage) registry {
+	t.Helper()
+	store, err := newSQLiteStore(zap.NewNop(), &config{SQLiteFile: filepath.Join(t.TempDir(), "pacman.db"), HistoryRetain: retain}, m)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = store.close() })
+	err = store.transaction(context.Background(), func(tx *sql.Tx) error {
+		for name := range pkgs {
+			if _, err := tx.Exec(`INSERT INTO packages (name) VALUES (?)`, name); err != nil {
+				return err
+			}
+		}
+		for name, pkg := range pkgs {
+			for _, dep := range pkg.dependsOn {
+				if _, err := tx.Exec(`INSERT INTO dependencies (package, dependency) VALUES (?, ?)`, name, dep); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	return store
+}
+
+func TestSQLiteStoreReopen(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	cfg := &config{SQLiteFile: filepath.Join(t.TempDir(), "pacman.db"), HistoryRetain: 3}
+	store, err := newSQLiteStore(zap.NewNop(), cfg, nil)
+	require.NoError(t, err)
+	_, err = store.add(ctx, "AAA", nil, false)
+	require.NoError(t, err)
+	_, err = store.add(ctx, "BBB", []string{"AAA"}, false)
+	require.NoError(t, err)
+	before, _ := store.follow("", 0)
+	require.NoError(t, store.close())
+
+	// migrations are not applied again, the registry and its changes are kept
+	store, err = newSQLiteStore(zap.NewNop(), cfg, nil)
+	require.NoError(t, err)
+	defer store.close()
+	assert.Equal(t, uint64(3), store.revision(ctx))
+	pkgs, err := store.list(ctx, 2)
+	require.NoError(t, err)
+	assert.Equal(t, []packageInfo{{Name: "AAA", DependsOn: []string{}, RequiredBy: []string{}}}, pkgs)
+	update, _ := store.follow(before.Generation, 2)
+	assert.Equal(t, before.Generation, update.Generation)
+	assert.Equal(t, []change{{Revision: 3, Op: opAdd, Name: "BBB", Deps: []string{"AAA"}}}, untimed(t, update.Changes))
+}
+
+func TestSQLiteStoreSchema(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	store := newSQLiteStoreWith(t, nil, 1, map[string]onePackage{
+		"AAA": {name: "AAA", requiredBy: []string{"BBB"}},
+		"BBB": {name: "BBB", dependsOn: []string{"AAA"}},
+	}).(*sqliteStore)
+
+	// foreign keys hold even when writing to the database directly
+	_, err := store.db.ExecContext(ctx, `INSERT INTO dependencies (package, dependency) VALUES ('BBB', 'CCC')`)
+	assert.EqualError(t, err, "FOREIGN KEY constraint failed")
+	_, err = store.db.ExecContext(ctx, `DELETE FROM packages WHERE name = 'AAA'`)
+	assert.EqualError(t, err, "FOREIGN KEY constraint failed")
+	_, err = store.db.ExecContext(ctx, `INSERT INTO dependencies (package, dependency) VALUES ('AAA', 'AAA')`)
+	assert.EqualError(t, err, "CHECK constraint failed: package <> dependency")
+
+	// removing a package removes its dependencies
+	require.NoError(t, store.remove(ctx, "BBB"))
+	var edges int
+	require.NoError(t, store.db.QueryRowContext(ctx, `SELECT count(*) FROM dependencies`).Scan(&edges))
+	assert.Equal(t, 0, edges)
+
+	// a database written by a newer version is left alone
+	path := filepath.Join(t.TempDir(), "pacman.db")
+	newer, err := newSQLiteStore(zap.NewNop(), &config{SQLiteFile: path}, nil)
+	require.NoError(t, err)
+	_, err = newer.db.ExecContext(ctx, `PRAGMA user_version = 99`)
+	require.NoError(t, err)
+	require.NoError(t, newer.close())
+	_, err = newSQLiteStore(zap.NewNop(), &config{SQLiteFile: path}, nil)
+	assert.EqualError(t, err, "SQLite schema version 99 is newer than the latest known version 3")
+}
+
+func TestSQLiteStoreMigrateChangeTimes(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "pacman.db")
+	db, err := sql.Open("sqlite3", "file:"+path)
+	require.NoError(t, err)
+	_, err = db.ExecContext(ctx, sqliteMigrations[0])
+	require.NoError(t, err)
+	_, err = db.ExecContext(ctx, `PRAGMA user_version = 1;
+		UPDATE registry SET revision = 2;
+		INSERT INTO packages (name) VALUES ('AAA');
+		INSERT INTO changes (revision, op, name, deps) VALUES (2, 'add', 'AAA', '[]');`)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+	before := time.Now().Truncate(time.Second)
+
+	// changes recorded without a time count as made at the migration
+	store, err := newSQLiteStore(zap.NewNop(), &config{SQLiteFile: path, HistoryRetain: 4}, nil)
+	require.NoError(t, err)
+	defer store.close()
+	history, err := store.packageHistory(ctx, "AAA")
+	require.NoError(t, err)
+	require.Len(t, history.Changes, 1)
+	migrated := history.Changes[0].Time
+	assert.False(t, migrated.Before(before) || migrated.After(time.Now()), migrated)
+	rev, err := store.revisionAt(ctx, migrated)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), rev)
+	_, err = store.revisionAt(ctx, migrated.Add(-time.Second))
+	assert.Equal(t, "unknown_revision", errorCode(err))
+}
+
+func TestSQLiteStoreCheck(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	store := newSQLiteStoreWith(t, nil, 1, map[string]onePackage{
+		"AAA": {name: "AAA", requiredBy: []string{"BBB"}},
+		"BBB": {name: "BBB", dependsOn: []string{"AAA"}},
+	}).(*sqliteStore)
+	problems, err := store.check(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, problems)
+
+	// only a connection without foreign keys can break the registry
+	conn, err := store.db.Conn(ctx)
+	require.NoError(t, err)
+	defer conn.Close()
+	for _, query := range []string{
+		`PRAGMA foreign_keys = off`,
+		`INSERT INTO dependencies (package, dependency) VALUES ('AAA', 'BBB'), ('BBB', 'CCC')`,
+		`PRAGMA foreign_keys = on`,
+		`UPDATE packages SET is_group = 1 WHERE name = 'AAA'`,
+	} {
+		_, err = conn.ExecContext(ctx, query)
+		require.NoError(t, err)
+	}
+
+	problems, err = store.check(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"BBB depends on CCC, either of which is missing",
+		"AAA depends on itself",
+		"BBB depends on itself",
+		"BBB depends on group AAA instead of its members",
+	}, problems)
+}
+
+func TestSQLiteStoreFollow(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	store := newSQLiteStoreWith(t, nil, 2, nil).(*sqliteStore)
+	for _, name := range []string{"AAA", "BBB", "CCC"} {
+		_, err := store.add(ctx, name, nil, false)
+		require.NoError(t, err)
+	}
+
+	// followers too far behind get a snapshot
+	update, published := store.follow("", 0)
+	assert.True(t, update.Full)
+	assert.Equal(t, uint64(4), update.Revision)
+	assert.Len(t, update.Snapshot, 3)
+	behind, _ := store.follow(update.Generation, 2)
+	assert.True(t, behind.Full)
+
+	// others get the changes they are missing, and are told about the next
+	update, _ = store.follow(update.Generation, 3)
+	assert.Equal(t, []change{{Revision: 4, Op: opAdd, Name: "CCC"}}, untimed(t, update.Changes))
+	require.NoError(t, store.remove(ctx, "CCC"))
+	select {
+	case <-published:
+	default:
+		t.Fatal("followers were not told about the change")
+	}
+	update, _ = store.follow(update.Generation, 4)
+	assert.Equal(t, []change{{Revision: 5, Op: opRemove, Name: "CCC"}}, untimed(t, update.Changes))
+}
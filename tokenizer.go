@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+var (
+	errUnterminatedQuote = errors.New("unterminated quoted argument")
+	errTrailingBackslash = errors.New("trailing backslash")
+)
+
+// tokenize splits a command line into its command and arguments. Arguments are
+// separated by any run of whitespace and can be quoted: double quotes allow
+// backslash escapes, while single quotes take everything up to the closing
+// quote literally. Outside of single quotes a backslash escapes the next
+// character, where \n, \t and \r stand for newline, tab and carriage return.
+func tokenize(line string) ([]string, error) {
+	var (
+		tokens  []string
+		current strings.Builder
+		inToken bool
+		quote   rune
+		escaped bool
+	)
+	for _, r := range line {
+		switch {
+		case escaped:
+			unescaped, err := unescape(r)
+			if err != nil {
+				return nil, err
+			}
+			current.WriteRune(unescaped)
+			escaped = false
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				current.WriteRune(r)
+			}
+		case r == '\\':
+			escaped, inToken = true, true
+		case quote == '"':
+			if r == '"' {
+				quote = 0
+			} else {
+				current.WriteRune(r)
+			}
+		case r == '"' || r == '\'':
+			quote, inToken = r, true
+		case unicode.IsSpace(r):
+			if inToken {
+				tokens = append(tokens, current.String())
+				current.Reset()
+				inToken = false
+			}
+		default:
+			current.WriteRune(r)
+			inToken = true
+		}
+	}
+	if escaped {
+		return nil, errTrailingBackslash
+	}
+	if quote != 0 {
+		return nil, errUnterminatedQuote
+	}
+	if inToken {
+		tokens = append(tokens, current.String())
+	}
+	return tokens, nil
+}
+
+func unescape(r rune) (rune, error) {
+	switch r {
+	case 'n':
+		return '\n', nil
+	case 't':
+		return '\t', nil
+	case 'r':
+		return '\r', nil
+	case '\\', '"', '\'', ' ':
+		return r, nil
+	}
+	return 0, fmt.Errorf("unknown escape sequence \\%c", r)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenize(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		given     string
+		want      []string
+		wantError error
+	}{
+		{
+			name:  "empty",
+			given: "",
+			want:  nil,
+		},
+		{
+			name:  "only whitespace",
+			given: " \t \r ",
+			want:  nil,
+		},
+		{
+			name:  "single spaces",
+			given: "AddPackage CCC AAA BBB",
+			want:  []string{"AddPackage", "CCC", "AAA", "BBB"},
+		},
+		{
+			name:  "collapse whitespace",
+			given: "  AddPackage  CCC\tAAA \t BBB  ",
+			want:  []string{"AddPackage", "CCC", "AAA", "BBB"},
+		},
+		{
+			name:  "trailing carriage return",
+			given: "RemovePackage CCC\r",
+			want:  []string{"RemovePackage", "CCC"},
+		},
+		{
+			name:  "double quotes",
+			given: `AddPackage "my package" AAA`,
+			want:  []string{"AddPackage", "my package", "AAA"},
+		},
+		{
+			name:  "single quotes are literal",
+			given: `AddPackage 'my \package' AAA`,
+			want:  []string{"AddPackage", `my \package`, "AAA"},
+		},
+		{
+			name:  "escapes in double quotes",
+			given: `AddPackage "say \"hi\"\t\\"`,
+			want:  []string{"AddPackage", "say \"hi\"\t\\"},
+		},
+		{
+			name:  "escaped space",
+			given: `AddPackage my\ package`,
+			want:  []string{"AddPackage", "my package"},
+		},
+		{
+			name:  "adjacent quoted parts",
+			given: `AddPackage my" "'package'`,
+			want:  []string{"AddPackage", "my package"},
+		},
+		{
+			name:  "empty quoted argument",
+			given: `AddPackage ""`,
+			want:  []string{"AddPackage", ""},
+		},
+		{
+			name:      "unterminated double quote",
+			given:     `AddPackage "my package`,
+			wantError: errors.New("unterminated quoted argument"),
+		},
+		{
+			name:      "unterminated single quote",
+			given:     `AddPackage 'my package`,
+			wantError: errors.New("unterminated quoted argument"),
+		},
+		{
+			name:      "trailing backslash",
+			given:     `AddPackage AAA\`,
+			wantError: errors.New("trailing backslash"),
+		},
+		{
+			name:      "unknown escape sequence",
+			given:     `AddPackage A\xA`,
+			wantError: errors.New(`unknown escape sequence \x`),
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			tokens, err := tokenize(tc.given)
+			if tc.wantError != nil {
+				assert.EqualError(t, err, tc.wantError.Error())
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, tc.want, tokens)
+			}
+		})
+	}
+}
+
+func FuzzTokenize(f *testing.F) {
+	for _, seed := range []string{
+		"AddPackage CCC AAA BBB",
+		"  RemovePackage\tCCC\r",
+		`AddPackage "my package" 'lit\eral' my\ pkg`,
+		`AddPackage "unterminated`,
+		`AddPackage \`,
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, line string) {
+		tokens, err := tokenize(line)
+		if err != nil || !utf8.ValidString(line) {
+			return
+		}
+		if !strings.ContainsAny(line, `"'\`) {
+			// without quotes and escapes tokenizing is the same as splitting on whitespace
+			fields := strings.Fields(line)
+			if len(fields) > 0 || len(tokens) > 0 {
+				assert.Equal(t, fields, tokens)
+			}
+		}
+		for _, token := range tokens {
+			assert.True(t, utf8.ValidString(token))
+			assert.LessOrEqual(t, len(token), len(line))
+		}
+	})
+}